@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// CapacityReport ผลของการเปลี่ยนจำนวนที่นั่ง
+// RemovedStudents คือนักเรียนที่ถูกย้ายออกในโหมด force (ลงทะเบียนหลังสุดออกก่อน)
+type CapacityReport struct {
+	CourseID         int      `json:"course_id"`
+	PreviousCapacity int      `json:"previous_capacity"`
+	Capacity         int      `json:"capacity"`
+	Enrolled         int      `json:"enrolled"`
+	RemovedStudents  []string `json:"removed_students"`
+	State            string   `json:"state"`
+	StateChanged     bool     `json:"state_changed"`
+}
+
+// CapacityConflictError ลดที่นั่งต่ำกว่าจำนวนนักเรียนที่ลงทะเบียนแล้วโดยไม่ได้ระบุ force
+type CapacityConflictError struct {
+	Enrolled int
+	Capacity int
+}
+
+func (e *CapacityConflictError) Error() string {
+	return fmt.Sprintf("capacity %d is below the %d students already enrolled", e.Capacity, e.Enrolled)
+}
+
+// applyCapacityChange เปลี่ยนจำนวนที่นั่งภายใน transaction ที่ให้มา
+// ถ้าต่ำกว่าจำนวนที่ลงทะเบียนแล้วจะปฏิเสธ เว้นแต่ force ซึ่งจะย้ายนักเรียนที่ลงทะเบียนหลังสุดออกจนพอดี
+// หลังเปลี่ยนจะสลับ open <-> full ตามที่นั่งที่เหลือ (เพิ่มที่นั่งให้รายวิชาที่เต็มจะกลับมาเปิดเอง)
+func applyCapacityChange(ctx context.Context, tx pgx.Tx, courseID, capacity int, force bool) (*CapacityReport, error) {
+	var previous int
+	var currentStudents []string
+	err := tx.QueryRow(ctx,
+		`SELECT capacity, COALESCE(current_student, '{}'::text[]) FROM course WHERE course_id = $1 FOR UPDATE`,
+		courseID,
+	).Scan(&previous, &currentStudents)
+	if err == pgx.ErrNoRows {
+		return nil, errCourseNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	report := &CapacityReport{
+		CourseID:         courseID,
+		PreviousCapacity: previous,
+		Capacity:         capacity,
+		RemovedStudents:  []string{},
+	}
+
+	if len(currentStudents) > capacity {
+		if !force {
+			return nil, &CapacityConflictError{Enrolled: len(currentStudents), Capacity: capacity}
+		}
+		// current_student เรียงตามลำดับที่ลงทะเบียน ท้ายสุดคือคนที่ลงหลังสุด
+		report.RemovedStudents = append(report.RemovedStudents, currentStudents[capacity:]...)
+		currentStudents = currentStudents[:capacity]
+	}
+	report.Enrolled = len(currentStudents)
+
+	_, err = tx.Exec(ctx,
+		`UPDATE course SET capacity = $1, current_student = $2 WHERE course_id = $3`,
+		capacity, currentStudents, courseID,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	state, changed, err := syncSeatState(ctx, tx, courseID)
+	if err != nil {
+		return nil, err
+	}
+	if !changed {
+		if err := tx.QueryRow(ctx, `SELECT state FROM course WHERE course_id = $1`, courseID).Scan(&state); err != nil {
+			return nil, err
+		}
+	}
+	report.State = state
+	report.StateChanged = changed
+	return report, nil
+}
+
+// studentIDsOf แปลงรหัสนักเรียนใน current_student เป็นตัวเลข (ข้ามค่าที่ไม่ใช่ตัวเลข)
+func studentIDsOf(students []string) []int {
+	ids := make([]int, 0, len(students))
+	for _, s := range students {
+		if id, err := strconv.Atoi(s); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
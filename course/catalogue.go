@@ -0,0 +1,602 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+	"github.com/sony/gobreaker"
+)
+
+// CatalogueCourse รายวิชา 1 แถวในไฟล์นำเข้า/ส่งออก (ไม่มี current_student และ version)
+type CatalogueCourse struct {
+	CourseID int `json:"course_id" binding:"required,gt=0"`
+	CourseDocument
+	State string `json:"state"`
+}
+
+// catalogueColumns คอลัมน์ของไฟล์ CSV field ที่เป็น array คั่นด้วย ; เช่น 1;2
+var catalogueColumns = []string{"course_id", "subject", "credit", "section", "day_of_week", "start_time", "end_time", "capacity", "state", "prerequisite"}
+
+// catalogueOptionalColumns คอลัมน์ที่ไม่ต้องมีในไฟล์ก็ได้
+var catalogueOptionalColumns = map[string]bool{"state": true, "prerequisite": true}
+
+// catalogueImportStates สถานะที่นำเข้าได้ (รายวิชาใหม่ยังไม่มีนักเรียน จึงเป็น full ไม่ได้)
+var catalogueImportStates = map[string]bool{
+	CourseStateDraft:     true,
+	CourseStatePublished: true,
+	CourseStateOpen:      true,
+	CourseStateClosed:    true,
+}
+
+const catalogueListSeparator = ";"
+
+// CatalogueRowError ข้อผิดพลาดทั้งหมดของแถวหนึ่ง row นับจาก 1 ไม่รวมหัวตาราง
+type CatalogueRowError struct {
+	Row      int      `json:"row"`
+	CourseID int      `json:"course_id,omitempty"`
+	Errors   []string `json:"errors"`
+}
+
+// CatalogueImportReport ผลการนำเข้า ถ้ามีแถวผิดแม้แถวเดียวจะไม่บันทึกแถวใดเลย
+type CatalogueImportReport struct {
+	Format    string              `json:"format"`
+	DryRun    bool                `json:"dry_run"`
+	Total     int                 `json:"total"`
+	Valid     int                 `json:"valid"`
+	Imported  int                 `json:"imported"`
+	CourseIDs []int               `json:"course_ids"`
+	Errors    []CatalogueRowError `json:"errors"`
+}
+
+// catalogueRow แถวที่อ่านจากไฟล์พร้อมข้อผิดพลาดที่พบระหว่างอ่านและตรวจ
+type catalogueRow struct {
+	Row    int
+	Course CatalogueCourse
+	Errors []string
+}
+
+// courseBeginner ใช้ได้ทั้ง *pgx.Conn และ *pgxpool.Pool
+type courseBeginner interface {
+	Begin(ctx context.Context) (pgx.Tx, error)
+}
+
+// catalogueFormat เลือกรูปแบบจาก ?format= ก่อน แล้วจึงดูจาก Content-Type
+func catalogueFormat(format, contentType string) (string, error) {
+	if format == "" {
+		switch contentType {
+		case "text/csv":
+			format = "csv"
+		case "application/json", "":
+			format = "json"
+		}
+	}
+	if format != "csv" && format != "json" {
+		return "", fmt.Errorf("unsupported format %q, use csv or json", format)
+	}
+	return format, nil
+}
+
+// parseCatalogue อ่านไฟล์ตามรูปแบบ error ที่คืนเป็นปัญหาของทั้งไฟล์ ส่วนปัญหาของแต่ละแถวอยู่ใน catalogueRow
+func parseCatalogue(format string, body []byte) ([]*catalogueRow, error) {
+	if format == "csv" {
+		return parseCatalogueCSV(body)
+	}
+	return parseCatalogueJSON(body)
+}
+
+func parseCatalogueJSON(body []byte) ([]*catalogueRow, error) {
+	var items []json.RawMessage
+	if err := json.Unmarshal(body, &items); err != nil {
+		return nil, fmt.Errorf("JSON catalogue must be an array of courses: %v", err)
+	}
+
+	rows := make([]*catalogueRow, 0, len(items))
+	for i, item := range items {
+		row := &catalogueRow{Row: i + 1}
+		decoder := json.NewDecoder(bytes.NewReader(item))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&row.Course); err != nil {
+			row.Errors = append(row.Errors, "invalid course: "+err.Error())
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+func parseCatalogueCSV(body []byte) ([]*catalogueRow, error) {
+	reader := csv.NewReader(bytes.NewReader(body))
+	reader.TrimLeadingSpace = true
+	reader.FieldsPerRecord = -1
+
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil, fmt.Errorf("CSV catalogue is empty")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid CSV header: %v", err)
+	}
+
+	index := map[string]int{}
+	for i, name := range header {
+		name = strings.TrimSpace(strings.TrimPrefix(name, "\ufeff"))
+		if !isCatalogueColumn(name) {
+			return nil, fmt.Errorf("unknown column %q", name)
+		}
+		index[name] = i
+	}
+	for _, name := range catalogueColumns {
+		if _, ok := index[name]; !ok && !catalogueOptionalColumns[name] {
+			return nil, fmt.Errorf("missing column %q", name)
+		}
+	}
+
+	var rows []*catalogueRow
+	for n := 1; ; n++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		row := &catalogueRow{Row: n}
+		rows = append(rows, row)
+		if err != nil {
+			row.Errors = append(row.Errors, "invalid CSV row: "+err.Error())
+			continue
+		}
+		if len(record) != len(header) {
+			row.Errors = append(row.Errors, fmt.Sprintf("expected %d columns, got %d", len(header), len(record)))
+			continue
+		}
+
+		cell := func(name string) string {
+			if i, ok := index[name]; ok {
+				return strings.TrimSpace(record[i])
+			}
+			return ""
+		}
+		number := func(name string) int {
+			value := cell(name)
+			if value == "" {
+				return 0
+			}
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				row.Errors = append(row.Errors, fmt.Sprintf("%s must be a number, got %q", name, value))
+			}
+			return n
+		}
+
+		course := &row.Course
+		course.CourseID = number("course_id")
+		course.Subject = cell("subject")
+		course.Credit = number("credit")
+		course.Section = splitCatalogueList(cell("section"))
+		course.DayOfWeek = cell("day_of_week")
+		course.StartTime = cell("start_time")
+		course.EndTime = cell("end_time")
+		course.Capacity = number("capacity")
+		course.State = cell("state")
+		course.Prerequisite = splitCatalogueList(cell("prerequisite"))
+	}
+	return rows, nil
+}
+
+func isCatalogueColumn(name string) bool {
+	for _, column := range catalogueColumns {
+		if column == name {
+			return true
+		}
+	}
+	return false
+}
+
+// splitCatalogueList แยกค่าใน cell ที่คั่นด้วย ; (cell ว่างคือไม่มีค่า)
+func splitCatalogueList(value string) []string {
+	if value == "" {
+		return nil
+	}
+	var items []string
+	for _, item := range strings.Split(value, catalogueListSeparator) {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// validateCatalogue ตรวจทุกแถวด้วยกฎเดียวกับ POST /courses แล้วตามด้วยสถานะ รหัสซ้ำ และ prerequisite
+// prerequisite ต้องเป็นชื่อวิชาที่มีอยู่แล้วหรืออยู่ในไฟล์เดียวกัน
+func validateCatalogue(ctx context.Context, tx pgx.Tx, rows []*catalogueRow) error {
+	existingIDs := map[int]bool{}
+	subjects := map[string]bool{}
+	dbRows, err := tx.Query(ctx, `SELECT course_id, subject FROM course`)
+	if err != nil {
+		return err
+	}
+	for dbRows.Next() {
+		var id int
+		var subject string
+		if err := dbRows.Scan(&id, &subject); err != nil {
+			dbRows.Close()
+			return err
+		}
+		existingIDs[id] = true
+		subjects[subject] = true
+	}
+	dbRows.Close()
+	if err := dbRows.Err(); err != nil {
+		return err
+	}
+	for _, row := range rows {
+		if row.Course.Subject != "" {
+			subjects[row.Course.Subject] = true
+		}
+	}
+
+	seen := map[int]int{}
+	for _, row := range rows {
+		if len(row.Errors) > 0 {
+			continue
+		}
+		course := &row.Course
+		if invalid := validateStruct(course); invalid != nil {
+			row.Errors = append(row.Errors, invalid.Messages()...)
+		} else {
+			course.StartTime, _ = normalizeCourseTime("start_time", course.StartTime)
+			course.EndTime, _ = normalizeCourseTime("end_time", course.EndTime)
+		}
+
+		if course.State == "" {
+			course.State = CourseStateDraft
+		}
+		if !catalogueImportStates[course.State] {
+			row.Errors = append(row.Errors, fmt.Sprintf("state %q cannot be imported, use draft, published, open or closed", course.State))
+		}
+
+		if course.CourseID > 0 {
+			if existingIDs[course.CourseID] {
+				row.Errors = append(row.Errors, fmt.Sprintf("course_id %d already exists", course.CourseID))
+			}
+			if first, ok := seen[course.CourseID]; ok {
+				row.Errors = append(row.Errors, fmt.Sprintf("course_id %d is duplicated in row %d", course.CourseID, first))
+			} else {
+				seen[course.CourseID] = row.Row
+			}
+		}
+
+		for _, prerequisite := range course.Prerequisite {
+			if prerequisite == course.Subject {
+				row.Errors = append(row.Errors, fmt.Sprintf("prerequisite %q cannot be the course itself", prerequisite))
+			} else if !subjects[prerequisite] {
+				row.Errors = append(row.Errors, fmt.Sprintf("prerequisite %q does not match any course subject", prerequisite))
+			}
+		}
+	}
+	return nil
+}
+
+// importCatalogue ตรวจและเพิ่มรายวิชาทั้งหมดใน transaction เดียว
+// ถ้ามีแถวผิดหรือเป็น dry run จะ rollback ทั้งหมด (dry run ยังลอง insert จริงเพื่อให้เจอ constraint ของฐานข้อมูล)
+func importCatalogue(ctx context.Context, db courseBeginner, format string, rows []*catalogueRow, dryRun bool) (*CatalogueImportReport, error) {
+	report := &CatalogueImportReport{
+		Format:    format,
+		DryRun:    dryRun,
+		Total:     len(rows),
+		CourseIDs: []int{},
+		Errors:    []CatalogueRowError{},
+	}
+
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	if err := validateCatalogue(ctx, tx, rows); err != nil {
+		return nil, err
+	}
+
+	for _, row := range rows {
+		if len(row.Errors) > 0 {
+			continue
+		}
+		// savepoint เพื่อให้แถวที่ insert ไม่ผ่านไม่ทำให้ transaction ใช้ต่อไม่ได้
+		_, err := tx.Exec(ctx, `SAVEPOINT catalogue_row`)
+		if err != nil {
+			return nil, err
+		}
+		course := row.Course
+		_, err = tx.Exec(ctx,
+			`INSERT INTO course ("course_id", "subject", "credit", "section", "day_of_week", "start_time", "end_time", "capacity", "state", "current_student", "prerequisite")
+			VALUES ($1, $2, $3, $4, $5, $6::TIME, $7::TIME, $8, $9, NULL, $10)`,
+			course.CourseID,
+			course.Subject,
+			course.Credit,
+			course.Section,
+			course.DayOfWeek,
+			course.StartTime,
+			course.EndTime,
+			course.Capacity,
+			course.State,
+			course.Prerequisite,
+		)
+		if err != nil {
+			row.Errors = append(row.Errors, "failed to insert: "+err.Error())
+			if _, err := tx.Exec(ctx, `ROLLBACK TO SAVEPOINT catalogue_row`); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		report.CourseIDs = append(report.CourseIDs, course.CourseID)
+	}
+
+	for _, row := range rows {
+		if len(row.Errors) > 0 {
+			report.Errors = append(report.Errors, CatalogueRowError{Row: row.Row, CourseID: row.Course.CourseID, Errors: row.Errors})
+		}
+	}
+	report.Valid = report.Total - len(report.Errors)
+	if len(report.Errors) > 0 || dryRun {
+		return report, nil
+	}
+
+	// แจ้ง service อื่นเหมือนเพิ่มผ่าน POST /courses (บันทึกลง outbox พร้อมรายวิชา)
+	for _, courseID := range report.CourseIDs {
+		if err := enqueueCourseEvents(ctx, tx, courseID, EventCourseCreated); err != nil {
+			return nil, err
+		}
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return nil, err
+	}
+	report.Imported = len(report.CourseIDs)
+	return report, nil
+}
+
+// queryCatalogue รายวิชาทั้งหมดในรูปแบบเดียวกับไฟล์นำเข้า เรียงตามรหัสวิชา
+func queryCatalogue(ctx context.Context, q interface {
+	Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error)
+}) ([]CatalogueCourse, error) {
+	rows, err := q.Query(ctx, `SELECT "course_id", "subject", "credit", "section", "day_of_week", "start_time", "end_time", "capacity", "state", "prerequisite" FROM course ORDER BY "course_id"`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	courses := []CatalogueCourse{}
+	for rows.Next() {
+		var course Course
+		err := rows.Scan(
+			&course.CourseID,
+			&course.Subject,
+			&course.Credit,
+			&course.Section,
+			&course.DayOfWeek,
+			&course.StartTime,
+			&course.EndTime,
+			&course.Capacity,
+			&course.State,
+			&course.Prerequisite,
+		)
+		if err != nil {
+			return nil, err
+		}
+		courses = append(courses, CatalogueCourse{
+			CourseID: course.CourseID,
+			CourseDocument: CourseDocument{
+				Subject:      course.Subject,
+				Credit:       course.Credit,
+				Section:      course.Section,
+				DayOfWeek:    course.DayOfWeek,
+				StartTime:    course.StartTime.Format("15:04:05"),
+				EndTime:      course.EndTime.Format("15:04:05"),
+				Capacity:     course.Capacity,
+				Prerequisite: course.Prerequisite,
+			},
+			State: course.State,
+		})
+	}
+	return courses, rows.Err()
+}
+
+// writeCatalogueCSV เขียนรายวิชาเป็น CSV ที่นำเข้ากลับได้ทันที
+func writeCatalogueCSV(w io.Writer, courses []CatalogueCourse) error {
+	writer := csv.NewWriter(w)
+	if err := writer.Write(catalogueColumns); err != nil {
+		return err
+	}
+	for _, course := range courses {
+		record := []string{
+			strconv.Itoa(course.CourseID),
+			course.Subject,
+			strconv.Itoa(course.Credit),
+			strings.Join(course.Section, catalogueListSeparator),
+			course.DayOfWeek,
+			course.StartTime,
+			course.EndTime,
+			strconv.Itoa(course.Capacity),
+			course.State,
+			strings.Join(course.Prerequisite, catalogueListSeparator),
+		}
+		if err := writer.Write(record); err != nil {
+			return err
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+// registerCatalogueRoutes นำเข้า/ส่งออกรายวิชาทั้งชุด
+func registerCatalogueRoutes(r *gin.Engine, dbConns *DBConnections, events *EventPublisher, readCircuitBreaker, writeCircuitBreaker *gobreaker.CircuitBreaker, requireRegistrar gin.HandlerFunc) {
+	// POST /courses/import?format=csv|json&dry_run=true
+	r.POST("/courses/import", requireRegistrar, func(c *gin.Context) {
+		format, err := catalogueFormat(c.Query("format"), c.ContentType())
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		body, err := c.GetRawData()
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read body: " + err.Error()})
+			return
+		}
+		rows, err := parseCatalogue(format, body)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if len(rows) == 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Catalogue has no courses"})
+			return
+		}
+		dryRun := c.Query("dry_run") == "true"
+
+		var report *CatalogueImportReport
+		_, err = writeCircuitBreaker.Execute(func() (interface{}, error) {
+			result, err := importCatalogue(context.Background(), dbConns.Pool, format, rows, dryRun)
+			report = result
+			return result, err
+		})
+		if err == gobreaker.ErrOpenState {
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Service temporarily unavailable (circuit breaker is open)"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to import courses: " + err.Error()})
+			return
+		}
+
+		switch {
+		case len(report.Errors) > 0:
+			c.JSON(http.StatusUnprocessableEntity, report)
+		case dryRun:
+			c.JSON(http.StatusOK, report)
+		default:
+			events.Notify()
+			c.JSON(http.StatusCreated, report)
+		}
+	})
+
+	// GET /courses/export?format=csv|json
+	r.GET("/courses/export", func(c *gin.Context) {
+		format, err := catalogueFormat(c.DefaultQuery("format", "json"), "")
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		var courses []CatalogueCourse
+		_, err = readCircuitBreaker.Execute(func() (interface{}, error) {
+			result, err := queryCatalogue(context.Background(), dbConns.ReadConn)
+			courses = result
+			return result, err
+		})
+		if err == gobreaker.ErrOpenState {
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Service temporarily unavailable (circuit breaker is open)"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to query courses: " + err.Error()})
+			return
+		}
+
+		if format == "json" {
+			c.JSON(http.StatusOK, courses)
+			return
+		}
+		var buf bytes.Buffer
+		if err := writeCatalogueCSV(&buf, courses); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to write CSV: " + err.Error()})
+			return
+		}
+		c.Header("Content-Disposition", `attachment; filename="courses.csv"`)
+		c.Data(http.StatusOK, "text/csv; charset=utf-8", buf.Bytes())
+	})
+}
+
+// runCatalogueCommand คำสั่ง import-courses / export-courses สำหรับรันจาก command line
+// ใช้งาน: ./course-service import-courses [-dry-run] [-format csv|json] <file>
+//
+//	./course-service export-courses [-format csv|json] > courses.csv
+func runCatalogueCommand(args []string) {
+	command := args[0]
+	flags := flag.NewFlagSet(command, flag.ExitOnError)
+	format := flags.String("format", "", "csv or json (default from the file extension, json for export)")
+	dryRun := flags.Bool("dry-run", false, "validate and report without saving")
+	flags.Parse(args[1:])
+
+	writeConn := connectToWriteDB()
+	defer writeConn.Close(context.Background())
+
+	switch command {
+	case "import-courses":
+		if flags.NArg() != 1 {
+			log.Fatal("Usage: course-service import-courses [-dry-run] [-format csv|json] <file>")
+		}
+		path := flags.Arg(0)
+		if *format == "" {
+			*format = strings.TrimPrefix(filepath.Ext(path), ".")
+		}
+		body, err := os.ReadFile(path)
+		if err != nil {
+			log.Fatal("Failed to read catalogue: ", err)
+		}
+		fileFormat, err := catalogueFormat(*format, "")
+		if err != nil {
+			log.Fatal(err)
+		}
+		rows, err := parseCatalogue(fileFormat, body)
+		if err != nil {
+			log.Fatal("Invalid catalogue: ", err)
+		}
+
+		report, err := importCatalogue(context.Background(), writeConn, fileFormat, rows, *dryRun)
+		if err != nil {
+			log.Fatal("Failed to import courses: ", err)
+		}
+		out, _ := json.MarshalIndent(report, "", "  ")
+		fmt.Println(string(out))
+		if len(report.Errors) > 0 {
+			os.Exit(1)
+		}
+
+		// event course.created อยู่ใน course_event_outbox แล้ว course-service ที่รันอยู่จะส่งออกไปเอง
+		log.Printf("Imported %d of %d courses from %s (dry run: %v)", report.Imported, report.Total, path, *dryRun)
+	case "export-courses":
+		if *format == "" {
+			*format = "json"
+		}
+		fileFormat, err := catalogueFormat(*format, "")
+		if err != nil {
+			log.Fatal(err)
+		}
+		courses, err := queryCatalogue(context.Background(), writeConn)
+		if err != nil {
+			log.Fatal("Failed to export courses: ", err)
+		}
+		if fileFormat == "csv" {
+			err = writeCatalogueCSV(os.Stdout, courses)
+		} else {
+			encoder := json.NewEncoder(os.Stdout)
+			encoder.SetIndent("", "  ")
+			err = encoder.Encode(courses)
+		}
+		if err != nil {
+			log.Fatal("Failed to export courses: ", err)
+		}
+	default:
+		log.Fatalf("Unknown command: %s", command)
+	}
+}
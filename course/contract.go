@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"shared/contract"
+)
+
+// สัญญาของ RPC ระหว่าง enrollment-service กับ course-service อยู่ใน shared/contract
+// (schema ชุดเดียวที่ทั้งสอง service ใช้) ไฟล์นี้แปลงระหว่างข้อความกับ struct ของ course-service
+
+// รหัสข้อผิดพลาดใน enrollment.response (v2 ขึ้นไป)
+// รหัสทางธุรกิจหมายถึงลองใหม่ก็ได้ผลเดิม ส่วน INTERNAL_ERROR ลองใหม่ได้
+const (
+	ErrCodeCourseNotFound  = "COURSE_NOT_FOUND"
+	ErrCodeCourseClosed    = "COURSE_CLOSED"
+	ErrCodeCourseFull      = "COURSE_FULL"
+	ErrCodeAlreadyEnrolled = "ALREADY_ENROLLED"
+	ErrCodeNotEnrolled     = "NOT_ENROLLED" // v3: รายวิชาใน drop_course_ids ที่นักเรียนไม่ได้ลงไว้
+	ErrCodeInternal        = "INTERNAL_ERROR"
+)
+
+// rejectEnrollment คำตอบเมื่อถูกปฏิเสธตามเงื่อนไขทางธุรกิจ
+func rejectEnrollment(code string, courseID int, format string, args ...interface{}) EnrollmentResponse {
+	return EnrollmentResponse{
+		Success:  false,
+		Error:    fmt.Sprintf(format, args...),
+		Code:     code,
+		CourseID: courseID,
+	}
+}
+
+// internalEnrollmentError คำตอบเมื่อเกิดข้อผิดพลาดของระบบ
+func internalEnrollmentError(message string) EnrollmentResponse {
+	return EnrollmentResponse{
+		Success: false,
+		Error:   message,
+		Code:    ErrCodeInternal,
+	}
+}
+
+// decodeEnrollmentRequest อ่านและตรวจ request แล้วคืน payload พร้อมเวอร์ชันที่ผู้ส่งใช้
+// request แบบเก่าที่ไม่มี envelope ได้เวอร์ชัน contract.LegacyVersion
+func decodeEnrollmentRequest(body []byte) (EnrollmentMessage, int, error) {
+	var msg EnrollmentMessage
+	version, payload, err := contract.Decode(contract.RequestType, body)
+	if err != nil {
+		return msg, version, err
+	}
+	err = json.Unmarshal(payload, &msg)
+	return msg, version, err
+}
+
+// encodeEnrollmentResponse ตอบด้วยเวอร์ชันเดียวกับ request และตรวจกับ schema ก่อนส่ง
+func encodeEnrollmentResponse(version int, response EnrollmentResponse) ([]byte, error) {
+	if version < 2 {
+		// v1 และแบบเก่าไม่มี code, course_id และ duplicate
+		response.Code = ""
+		response.CourseID = 0
+		response.Duplicate = false
+	}
+	return contract.Encode(contract.ResponseType, version, response)
+}
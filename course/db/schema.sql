@@ -12,3 +12,82 @@ CREATE TABLE IF NOT EXISTS course (
 	"prerequisite" VARCHAR(255) ARRAY,
 	PRIMARY KEY("course_id")
 );
+
+-- version เพิ่มทุกครั้งที่แก้ไขผ่าน API ใช้เป็น ETag / If-Match กันการเขียนทับกัน
+ALTER TABLE course ADD COLUMN IF NOT EXISTS "version" INTEGER NOT NULL DEFAULT 1;
+
+-- สถานะของรายวิชา (ดู state.go) ใส่แยกเพื่อให้ฐานข้อมูลเดิมได้ constraint ด้วย
+ALTER TABLE course DROP CONSTRAINT IF EXISTS course_state_check;
+ALTER TABLE course ADD CONSTRAINT course_state_check
+	CHECK ("state" IN ('draft', 'published', 'open', 'full', 'closed', 'cancelled', 'archived'));
+
+-- ประวัติการเปลี่ยนสถานะของรายวิชา พร้อมเหตุผลและผู้เปลี่ยน (system = เปลี่ยนอัตโนมัติ open <-> full)
+CREATE TABLE IF NOT EXISTS course_state_transition (
+	"transition_id" SERIAL PRIMARY KEY,
+	"course_id" INTEGER NOT NULL REFERENCES course("course_id") ON DELETE CASCADE,
+	"from_state" VARCHAR(255) NOT NULL,
+	"to_state" VARCHAR(255) NOT NULL,
+	"reason" TEXT NOT NULL,
+	"actor" VARCHAR(255) NOT NULL,
+	"created_at" TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS course_state_transition_course_idx ON course_state_transition ("course_id", "created_at");
+
+-- correlation ID ของ enrollment request ที่ประมวลผลแล้ว พร้อมคำตอบเดิม (กันการประมวลผลซ้ำเมื่อข้อความถูกส่งซ้ำ)
+CREATE TABLE IF NOT EXISTS processed_enrollment_request (
+	"correlation_id" VARCHAR(255) NOT NULL UNIQUE,
+	"response" JSONB NOT NULL,
+	"processed_at" TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+	PRIMARY KEY("correlation_id")
+);
+
+-- จำนวนครั้งที่ broker ส่งข้อความ enrollment request แต่ละข้อความ (message ID) ใช้ตัดสินว่าเมื่อไรต้องย้ายเข้า DLQ
+-- นับต่อข้อความไม่ใช่ต่อ correlation ID เพราะ enrollment-service retry คำขอเดิมด้วย correlation ID เดิมแต่เป็นข้อความใหม่
+-- นับในฐานข้อมูลเพราะ classic queue ไม่มี x-delivery-count และเมื่อ channel ปิดก่อน ack/nack broker จะส่งข้อความเดิมกลับมาโดยไม่มีตัวนับ
+DROP TABLE IF EXISTS enrollment_request_attempt;
+CREATE TABLE IF NOT EXISTS enrollment_delivery_attempt (
+	"message_id" VARCHAR(255) NOT NULL,
+	"attempts" INTEGER NOT NULL DEFAULT 1,
+	"last_attempt_at" TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+	PRIMARY KEY("message_id")
+);
+
+-- การถือที่นั่งระหว่าง checkout (status: held, confirmed, released, expired)
+-- hold ที่ status = 'held' และยังไม่ถึง expires_at นับเป็นที่นั่งที่ไม่ว่าง
+CREATE TABLE IF NOT EXISTS seat_hold (
+	"hold_id" SERIAL PRIMARY KEY,
+	"course_id" INTEGER NOT NULL REFERENCES course("course_id") ON DELETE CASCADE,
+	"student_id" INTEGER NOT NULL,
+	"status" VARCHAR(20) NOT NULL DEFAULT 'held',
+	"expires_at" TIMESTAMPTZ NOT NULL,
+	"created_at" TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+	"updated_at" TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS seat_hold_active_idx ON seat_hold ("course_id", "student_id") WHERE "status" = 'held';
+
+-- ผู้สอนของรายวิชา (instructor_id คือ student_id ของบัญชีที่มี role instructor ใน student-service)
+CREATE TABLE IF NOT EXISTS course_instructor (
+	"course_id" INTEGER NOT NULL REFERENCES course("course_id") ON DELETE CASCADE,
+	"instructor_id" INTEGER NOT NULL,
+	PRIMARY KEY("course_id", "instructor_id")
+);
+
+CREATE INDEX IF NOT EXISTS course_instructor_instructor_idx ON course_instructor ("instructor_id");
+
+-- transactional outbox ของ domain event รายวิชา บันทึกใน transaction เดียวกับการเปลี่ยนแปลง
+-- relay ใน events.go ส่งออกไปตามลำดับ outbox_id และตั้ง published_at เมื่อ RabbitMQ ยืนยันแล้วเท่านั้น
+CREATE TABLE IF NOT EXISTS course_event_outbox (
+	"outbox_id" BIGSERIAL PRIMARY KEY,
+	"event_id" VARCHAR(255) NOT NULL UNIQUE,
+	"event_type" VARCHAR(255) NOT NULL,
+	"course_id" INTEGER NOT NULL,
+	"payload" JSONB NOT NULL,
+	"occurred_at" TIMESTAMPTZ NOT NULL,
+	"published_at" TIMESTAMPTZ,
+	"attempts" INTEGER NOT NULL DEFAULT 0,
+	"last_error" TEXT
+);
+
+CREATE INDEX IF NOT EXISTS course_event_outbox_pending_idx ON course_event_outbox ("outbox_id") WHERE "published_at" IS NULL;
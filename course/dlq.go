@@ -0,0 +1,402 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5/pgxpool"
+	amqp "github.com/rabbitmq/amqp091-go"
+
+	"shared/rabbitmq"
+)
+
+// topology ของคิว enrollment request และ dead-letter queue
+const (
+	enrollmentRequestQueue    = "course_enrollment_request"
+	enrollmentDeadLetterEx    = "course_enrollment_dlx"
+	enrollmentDeadLetterQueue = "course_enrollment_request.dlq"
+
+	// header บอกจำนวนครั้งที่ลองประมวลผลก่อนถูกย้ายเข้า DLQ (ตัวนับจริงคือ deliveryAttempt)
+	retryCountHeader = "x-retry-count"
+	// header ที่ quorum queue ใส่มาให้ บอกจำนวนครั้งที่ส่งข้อความนี้ไปแล้วก่อนครั้งนี้
+	deliveryCountHeader = "x-delivery-count"
+	// header บอกเหตุผลที่ข้อความถูกส่งเข้า DLQ
+	deadLetterReasonHeader = "x-dead-letter-reason"
+
+	// จำนวนครั้งสูงสุดที่จะลองประมวลผลก่อนย้ายไป DLQ
+	maxEnrollmentRetries = 3
+)
+
+// ชื่อ policy ที่ตั้ง dead-letter exchange ให้คิว request
+const enrollmentDeadLetterPolicy = "course-enrollment-request-dlx"
+
+// declareEnrollmentQueues ประกาศคิว request พร้อม dead-letter exchange และ DLQ
+// คิว request ประกาศโดยไม่มี argument เหมือนเดิม (broker ที่มีคิวนี้อยู่แล้วจะปฏิเสธการประกาศซ้ำด้วย argument ต่างกัน)
+// ส่วน dead-letter exchange ตั้งผ่าน policy ใน applyDeadLetterPolicy แทน
+func declareEnrollmentQueues(ch *amqp.Channel) error {
+	if err := ch.ExchangeDeclare(enrollmentDeadLetterEx, "direct", true, false, false, false, nil); err != nil {
+		return err
+	}
+	if _, err := ch.QueueDeclare(enrollmentDeadLetterQueue, true, false, false, false, nil); err != nil {
+		return err
+	}
+	if err := ch.QueueBind(enrollmentDeadLetterQueue, enrollmentRequestQueue, enrollmentDeadLetterEx, false, nil); err != nil {
+		return err
+	}
+
+	_, err := ch.QueueDeclare(enrollmentRequestQueue, true, false, false, false, nil)
+	return err
+}
+
+// rabbitManagementURL ที่อยู่ของ management API (ค่าเริ่มต้นคือ host เดียวกับ RABBITMQ_URL พอร์ต 15672)
+func rabbitManagementURL(amqpURL string) string {
+	if v := os.Getenv("RABBITMQ_MANAGEMENT_URL"); v != "" {
+		return strings.TrimSuffix(v, "/")
+	}
+	uri, err := amqp.ParseURI(amqpURL)
+	if err != nil {
+		return "http://localhost:15672"
+	}
+	return fmt.Sprintf("http://%s:15672", uri.Host)
+}
+
+// applyDeadLetterPolicy ตั้ง dead-letter exchange ของคิว request ผ่าน policy ของ RabbitMQ (management API)
+// policy เปลี่ยนได้โดยไม่ต้องลบคิว จึงใช้ได้กับ broker ที่มีคิวอยู่แล้ว
+// ใช้เป็นทางสำรองเมื่อ deadLetter ส่งข้อความเข้า DLQ เองไม่สำเร็จแล้วต้อง Nack ให้ broker ย้ายให้
+func applyDeadLetterPolicy(amqpURL, managementURL string) error {
+	uri, err := amqp.ParseURI(amqpURL)
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(map[string]interface{}{
+		"pattern":  "^" + regexp.QuoteMeta(enrollmentRequestQueue) + "$",
+		"apply-to": "queues",
+		"priority": 10,
+		"definition": map[string]string{
+			"dead-letter-exchange":    enrollmentDeadLetterEx,
+			"dead-letter-routing-key": enrollmentRequestQueue,
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	endpoint := fmt.Sprintf("%s/api/policies/%s/%s", managementURL, url.PathEscape(uri.Vhost), enrollmentDeadLetterPolicy)
+	req, err := http.NewRequest(http.MethodPut, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(uri.Username, uri.Password)
+	req.Header.Set("Content-Type", "application/json")
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("management API returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// deliveryKey ตัวระบุข้อความสำหรับนับจำนวนครั้ง แต่ละครั้งที่ enrollment-service retry จะได้ message ID ใหม่
+// ผู้ส่งรุ่นเก่าที่ไม่มี message ID ใช้ correlation ID แทน
+func deliveryKey(d amqp.Delivery) string {
+	if d.MessageId != "" {
+		return d.MessageId
+	}
+	return d.CorrelationId
+}
+
+// deliveryAttempt ครั้งที่ของการส่งข้อความนี้ (รวมครั้งนี้) นับต่อข้อความ ไม่ใช่ต่อ correlation ID
+// quorum queue ให้ x-delivery-count มา ส่วน classic queue ที่ไม่มีตัวนับจะนับในฐานข้อมูลเฉพาะเมื่อ broker ส่งซ้ำ (redelivered)
+// ไม่ใช้ header ของเราเอง เพราะเมื่อส่งคำตอบไม่สำเร็จ channel มักปิดไปแล้ว
+// ทั้งการ republish พร้อม header ใหม่และการ Nack จะล้มเหลว แล้ว broker ส่งข้อความเดิมกลับมาโดยไม่มีตัวนับเพิ่ม
+func deliveryAttempt(ctx context.Context, db outboxWriter, d amqp.Delivery) (int, error) {
+	switch v := d.Headers[deliveryCountHeader].(type) {
+	case int32:
+		return int(v) + 1, nil
+	case int64:
+		return int(v) + 1, nil
+	}
+	if !d.Redelivered {
+		return 1, nil
+	}
+	var attempts int
+	err := db.QueryRow(ctx,
+		`INSERT INTO enrollment_delivery_attempt ("message_id", "attempts") VALUES ($1, 2)
+		ON CONFLICT ("message_id") DO UPDATE SET "attempts" = enrollment_delivery_attempt."attempts" + 1, "last_attempt_at" = NOW()
+		RETURNING "attempts"`,
+		deliveryKey(d),
+	).Scan(&attempts)
+	return attempts, err
+}
+
+// resetDeliveryAttempts เริ่มนับใหม่ (เช่นเมื่อ admin replay ข้อความจาก DLQ)
+func resetDeliveryAttempts(ctx context.Context, db outboxWriter, d amqp.Delivery) error {
+	_, err := db.Exec(ctx, `DELETE FROM enrollment_delivery_attempt WHERE "message_id" = $1`, deliveryKey(d))
+	return err
+}
+
+// retryCount อ่านจำนวนครั้งที่ลองไปแล้วจาก header
+func retryCount(headers amqp.Table) int {
+	switch v := headers[retryCountHeader].(type) {
+	case int32:
+		return int(v)
+	case int64:
+		return int(v)
+	case int:
+		return v
+	}
+	return 0
+}
+
+// copyHeaders คัดลอก header เดิมพร้อมค่าที่ต้องการเปลี่ยน
+func copyHeaders(headers amqp.Table, overrides amqp.Table) amqp.Table {
+	out := amqp.Table{}
+	for k, v := range headers {
+		out[k] = v
+	}
+	for k, v := range overrides {
+		out[k] = v
+	}
+	return out
+}
+
+// republish ส่งข้อความเดิมกลับเข้า exchange/routing key ที่ระบุ โดยคง correlation id และ reply-to ไว้
+func republish(ch *amqp.Channel, d amqp.Delivery, exchange, routingKey string, headers amqp.Table) error {
+	return ch.PublishWithContext(context.Background(),
+		exchange,
+		routingKey,
+		false,
+		false,
+		amqp.Publishing{
+			Headers:       headers,
+			ContentType:   d.ContentType,
+			DeliveryMode:  amqp.Persistent,
+			CorrelationId: d.CorrelationId,
+			ReplyTo:       d.ReplyTo,
+			MessageId:     d.MessageId,
+			Timestamp:     d.Timestamp,
+			Body:          d.Body,
+		})
+}
+
+// deadLetter ย้ายข้อความไป DLQ พร้อมเหตุผลและจำนวนครั้งที่ลอง
+// ถ้าส่งไม่สำเร็จให้ broker dead-letter ให้แทนด้วย Nack (ผ่าน policy ใน applyDeadLetterPolicy)
+func deadLetter(ch *amqp.Channel, d amqp.Delivery, reason string, attempts int) {
+	headers := copyHeaders(d.Headers, amqp.Table{deadLetterReasonHeader: reason, retryCountHeader: int32(attempts)})
+	if err := republish(ch, d, enrollmentDeadLetterEx, enrollmentRequestQueue, headers); err != nil {
+		log.Printf("Failed to publish to DLQ, falling back to broker dead-lettering: %v", err)
+		d.Nack(false, false)
+		return
+	}
+	log.Printf("Message %s moved to DLQ: %s", d.CorrelationId, reason)
+	d.Ack(false)
+}
+
+// retryLater คืนข้อความเข้าคิวเพื่อลองใหม่ ถ้า channel ปิดไปแล้ว broker จะส่งกลับมาใหม่เองอยู่แล้ว
+// จำนวนครั้งถูกนับใน deliveryAttempt ตอนได้รับข้อความครั้งถัดไป
+func retryLater(d amqp.Delivery, attempts int, reason string) {
+	log.Printf("Message %s will be retried (attempt %d/%d): %s", d.CorrelationId, attempts, maxEnrollmentRetries, reason)
+	if err := d.Nack(false, true); err != nil {
+		log.Printf("Failed to requeue message %s, broker will redeliver it: %v", d.CorrelationId, err)
+	}
+}
+
+// DeadLetterMessage ข้อมูลของข้อความใน DLQ สำหรับ admin
+type DeadLetterMessage struct {
+	MessageID     string    `json:"message_id,omitempty"`
+	CorrelationID string    `json:"correlation_id"`
+	ReplyTo       string    `json:"reply_to,omitempty"`
+	Reason        string    `json:"reason,omitempty"`
+	RetryCount    int       `json:"retry_count"`
+	Timestamp     time.Time `json:"timestamp"`
+	Body          string    `json:"body"`
+}
+
+// DeadLetterAdmin จัดการ DLQ ผ่าน connection ของ RabbitMQ
+// ถ้าเป็น nil (เช่นตอนเทส) endpoint จะตอบ 503
+type DeadLetterAdmin struct {
+	rabbit *rabbitmq.Connection
+	pool   *pgxpool.Pool
+}
+
+func newDeadLetterAdmin(rabbit *rabbitmq.Connection, pool *pgxpool.Pool) *DeadLetterAdmin {
+	return &DeadLetterAdmin{rabbit: rabbit, pool: pool}
+}
+
+// withChannel เปิด channel ชั่วคราวสำหรับแต่ละคำสั่ง เมื่อปิด channel ข้อความที่ยังไม่ ack จะกลับเข้าคิวเอง
+func (a *DeadLetterAdmin) withChannel(fn func(ch *amqp.Channel) error) error {
+	ch, err := a.rabbit.Channel()
+	if err != nil {
+		return err
+	}
+	defer ch.Close()
+	return fn(ch)
+}
+
+// Inspect ดูข้อความใน DLQ โดยไม่เอาออกจากคิว
+func (a *DeadLetterAdmin) Inspect(limit int) ([]DeadLetterMessage, int, error) {
+	messages := []DeadLetterMessage{}
+	total := 0
+	err := a.withChannel(func(ch *amqp.Channel) error {
+		q, err := ch.QueueDeclarePassive(enrollmentDeadLetterQueue, true, false, false, false, nil)
+		if err != nil {
+			return err
+		}
+		total = q.Messages
+
+		for i := 0; i < limit; i++ {
+			d, ok, err := ch.Get(enrollmentDeadLetterQueue, false)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				break
+			}
+			reason, _ := d.Headers[deadLetterReasonHeader].(string)
+			messages = append(messages, DeadLetterMessage{
+				MessageID:     d.MessageId,
+				CorrelationID: d.CorrelationId,
+				ReplyTo:       d.ReplyTo,
+				Reason:        reason,
+				RetryCount:    retryCount(d.Headers),
+				Timestamp:     d.Timestamp,
+				Body:          string(d.Body),
+			})
+		}
+		return nil
+	})
+	return messages, total, err
+}
+
+// Replay ย้ายข้อความจาก DLQ กลับไปคิวหลักพร้อมรีเซ็ตตัวนับ (ทั้ง header และใน enrollment_delivery_attempt)
+// ถ้าระบุ correlationID จะ replay เฉพาะข้อความนั้น
+func (a *DeadLetterAdmin) Replay(limit int, correlationID string) (int, error) {
+	replayed := 0
+	err := a.withChannel(func(ch *amqp.Channel) error {
+		q, err := ch.QueueDeclarePassive(enrollmentDeadLetterQueue, true, false, false, false, nil)
+		if err != nil {
+			return err
+		}
+
+		// วนดูข้อความตามจำนวนที่มีอยู่ตอนเริ่ม เพื่อไม่ให้วนไม่จบกับข้อความที่ข้ามไป
+		for i := 0; i < q.Messages && replayed < limit; i++ {
+			d, ok, err := ch.Get(enrollmentDeadLetterQueue, false)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				break
+			}
+			if correlationID != "" && d.CorrelationId != correlationID {
+				continue
+			}
+
+			if err := resetDeliveryAttempts(context.Background(), a.pool, d); err != nil {
+				return err
+			}
+			headers := copyHeaders(d.Headers, amqp.Table{retryCountHeader: int32(0)})
+			delete(headers, deadLetterReasonHeader)
+			delete(headers, deliveryCountHeader)
+			if err := republish(ch, d, "", enrollmentRequestQueue, headers); err != nil {
+				return err
+			}
+			if err := d.Ack(false); err != nil {
+				return err
+			}
+			replayed++
+		}
+		return nil
+	})
+	return replayed, err
+}
+
+// Purge ลบข้อความทั้งหมดใน DLQ
+func (a *DeadLetterAdmin) Purge() (int, error) {
+	purged := 0
+	err := a.withChannel(func(ch *amqp.Channel) error {
+		n, err := ch.QueuePurge(enrollmentDeadLetterQueue, false)
+		purged = n
+		return err
+	})
+	return purged, err
+}
+
+// registerDeadLetterRoutes เพิ่ม endpoint สำหรับ admin จัดการ DLQ
+func registerDeadLetterRoutes(r *gin.Engine, dlq *DeadLetterAdmin, requireAdmin gin.HandlerFunc) {
+	admin := r.Group("/admin/dlq", requireAdmin)
+
+	limitParam := func(c *gin.Context) (int, bool) {
+		limit := 20
+		if v := c.Query("limit"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n <= 0 {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "limit ไม่ถูกต้อง"})
+				return 0, false
+			}
+			limit = n
+		}
+		return limit, true
+	}
+
+	available := func(c *gin.Context) bool {
+		if dlq == nil {
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "RabbitMQ is not available"})
+			return false
+		}
+		return true
+	}
+
+	admin.GET("", func(c *gin.Context) {
+		limit, ok := limitParam(c)
+		if !ok || !available(c) {
+			return
+		}
+		messages, total, err := dlq.Inspect(limit)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to inspect DLQ: " + err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"total": total, "messages": messages})
+	})
+
+	admin.POST("/replay", func(c *gin.Context) {
+		limit, ok := limitParam(c)
+		if !ok || !available(c) {
+			return
+		}
+		replayed, err := dlq.Replay(limit, c.Query("correlation_id"))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to replay DLQ: " + err.Error(), "replayed": replayed})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"replayed": replayed})
+	})
+
+	admin.DELETE("", func(c *gin.Context) {
+		if !available(c) {
+			return
+		}
+		purged, err := dlq.Purge()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to purge DLQ: " + err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"purged": purged})
+	})
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+)
+
+// errVersionMismatch version ใน If-Match ไม่ตรงกับข้อมูลปัจจุบัน (มีคนแก้ไปก่อนแล้ว)
+var errVersionMismatch = errors.New("version mismatch")
+
+// etagFor ETag ของข้อมูลที่ version ระบุ
+func etagFor(version int) string {
+	return fmt.Sprintf(`"%d"`, version)
+}
+
+// requireIfMatch อ่าน version จาก header If-Match (รับทั้ง "3" และ W/"3")
+// ถ้าไม่มีจะตอบ 428 ถ้ารูปแบบผิดจะตอบ 400 แล้วคืน false
+func requireIfMatch(c *gin.Context) (int, bool) {
+	header := strings.TrimSpace(c.GetHeader("If-Match"))
+	if header == "" {
+		c.JSON(http.StatusPreconditionRequired, gin.H{"error": "If-Match header is required, use the ETag from GET"})
+		return 0, false
+	}
+
+	version, err := strconv.Atoi(strings.Trim(strings.TrimPrefix(header, "W/"), `"`))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid If-Match header: " + header})
+		return 0, false
+	}
+	return version, true
+}
+
+// checkCourseVersion lock แถวของรายวิชาแล้วเทียบ version กับที่ client ส่งมา
+func checkCourseVersion(ctx context.Context, tx pgx.Tx, courseID, expected int) error {
+	var version int
+	err := tx.QueryRow(ctx, `SELECT "version" FROM course WHERE course_id = $1 FOR UPDATE`, courseID).Scan(&version)
+	if err == pgx.ErrNoRows {
+		return errCourseNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if version != expected {
+		return errVersionMismatch
+	}
+	return nil
+}
+
+// respondVersionMismatch ตอบ 412 พร้อม ETag ปัจจุบันให้ client ดึงข้อมูลใหม่แล้วลองอีกครั้ง
+func respondVersionMismatch(c *gin.Context, q courseQuerier, courseID int) {
+	var version int
+	if err := q.QueryRow(context.Background(), `SELECT "version" FROM course WHERE course_id = $1`, courseID).Scan(&version); err == nil {
+		c.Header("ETag", etagFor(version))
+	}
+	c.JSON(http.StatusPreconditionFailed, gin.H{"error": "Course was modified by someone else, reload and try again"})
+}
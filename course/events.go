@@ -0,0 +1,346 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+	amqp "github.com/rabbitmq/amqp091-go"
+
+	"shared/rabbitmq"
+)
+
+// courseEventsExchange topic exchange สำหรับ domain event ของรายวิชา
+// routing key คือชื่อ event เช่น course.created ให้ผู้รับ bind ด้วย course.* หรือ course.#
+const courseEventsExchange = "course_events"
+
+// courseEventVersion เวอร์ชันของ schema (ดู schemas/course_event.v1.json)
+const courseEventVersion = 1
+
+const (
+	EventCourseCreated         = "course.created"
+	EventCourseUpdated         = "course.updated"
+	EventCourseDeleted         = "course.deleted"
+	EventCourseClosed          = "course.closed"
+	EventCourseSeatChanged     = "course.seat_changed"
+	EventCourseStateChanged    = "course.state_changed"
+	EventCourseCancelled       = "course.cancelled"
+	EventCourseStudentsRemoved = "course.students_removed"
+)
+
+// CourseEvent ข้อความที่ publish ออกไปทุกครั้งที่ข้อมูลรายวิชาเปลี่ยน
+// Course เป็น snapshot ล่าสุดหลังการเปลี่ยนแปลง (ไม่มีสำหรับ course.deleted)
+// Reason มีเฉพาะ course.cancelled และ course.students_removed ส่วน StudentIDs มีเฉพาะ course.students_removed
+type CourseEvent struct {
+	EventID    string    `json:"event_id"`
+	Type       string    `json:"type"`
+	Version    int       `json:"version"`
+	OccurredAt time.Time `json:"occurred_at"`
+	CourseID   int       `json:"course_id"`
+	Course     *Course   `json:"course,omitempty"`
+	Reason     string    `json:"reason,omitempty"`
+	StudentIDs []int     `json:"student_ids,omitempty"`
+}
+
+// outboxWriter ใช้ได้ทั้ง pgx.Tx, *pgx.Conn และ *pgxpool.Pool
+// ปกติให้ส่ง transaction เดียวกับที่เปลี่ยนข้อมูลรายวิชา เพื่อให้ event ถูกบันทึกพร้อมกับการเปลี่ยนแปลงเสมอ
+type outboxWriter interface {
+	courseQuerier
+	Exec(ctx context.Context, sql string, arguments ...any) (pgconn.CommandTag, error)
+}
+
+// enqueueCourseEvent บันทึก event ลง course_event_outbox แล้ว EventPublisher จะส่งออกไปหลัง commit
+func enqueueCourseEvent(ctx context.Context, db outboxWriter, event CourseEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to marshal %s event for course %d: %v", event.Type, event.CourseID, err)
+	}
+	_, err = db.Exec(ctx,
+		`INSERT INTO course_event_outbox ("event_id", "event_type", "course_id", "payload", "occurred_at") VALUES ($1, $2, $3, $4, $5)`,
+		event.EventID, event.Type, event.CourseID, body, event.OccurredAt,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to store %s event for course %d: %v", event.Type, event.CourseID, err)
+	}
+	return nil
+}
+
+// enqueueCourseEvents โหลดข้อมูลล่าสุดของรายวิชา (ภายใน transaction) แล้วบันทึก event ทุกประเภทที่ระบุ
+func enqueueCourseEvents(ctx context.Context, db outboxWriter, courseID int, eventTypes ...string) error {
+	course, err := loadCourse(ctx, db, courseID)
+	if err != nil {
+		return fmt.Errorf("failed to load course %d for events %v: %v", courseID, eventTypes, err)
+	}
+	for _, eventType := range eventTypes {
+		if err := enqueueCourseEvent(ctx, db, newCourseEvent(eventType, courseID, course)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// enqueueCourseEventWithReason บันทึก event ที่ทำให้นักเรียนถูกถอนออกจากรายวิชา (course.cancelled, course.students_removed)
+// ให้ enrollment-service ถอนการลงทะเบียนและแจ้งเตือน studentIDs ว่างหมายถึงทุกคน
+func enqueueCourseEventWithReason(ctx context.Context, db outboxWriter, eventType string, courseID int, reason string, studentIDs []int) error {
+	course, err := loadCourse(ctx, db, courseID)
+	if err != nil {
+		return fmt.Errorf("failed to load course %d for %s event: %v", courseID, eventType, err)
+	}
+	event := newCourseEvent(eventType, courseID, course)
+	event.Reason = reason
+	event.StudentIDs = studentIDs
+	return enqueueCourseEvent(ctx, db, event)
+}
+
+func newCourseEvent(eventType string, courseID int, course *Course) CourseEvent {
+	now := time.Now().UTC()
+	return CourseEvent{
+		EventID:    fmt.Sprintf("%s-%d-%d", eventType, courseID, now.UnixNano()),
+		Type:       eventType,
+		Version:    courseEventVersion,
+		OccurredAt: now,
+		CourseID:   courseID,
+		Course:     course,
+	}
+}
+
+// outboxEvent event ใน course_event_outbox ที่ยังไม่ได้ส่ง
+type outboxEvent struct {
+	EventID    string
+	EventType  string
+	CourseID   int
+	Payload    []byte
+	OccurredAt time.Time
+}
+
+// ขนาดของแต่ละรอบที่ relay ส่ง และระยะเวลาที่เก็บ event ที่ส่งแล้วไว้ตรวจสอบย้อนหลัง
+const (
+	outboxRelayBatch     = 100
+	outboxRetention      = 7 * 24 * time.Hour
+	outboxConfirmTimeout = 5 * time.Second
+)
+
+// relayOutbox ส่ง event ที่ค้างอยู่ตามลำดับที่บันทึก และทำเครื่องหมายว่าส่งแล้วเมื่อ send สำเร็จเท่านั้น
+// ถ้าส่งไม่สำเร็จจะหยุดรอบนี้ไว้ (event ยังค้างอยู่ รอบถัดไปจะลองใหม่) เพื่อไม่ให้ event ของรายวิชาเดียวกันสลับลำดับ
+// lock แถวด้วย SKIP LOCKED เพื่อให้รันหลาย instance พร้อมกันได้โดยไม่ส่งซ้ำกัน
+func relayOutbox(ctx context.Context, db courseBeginner, send func(outboxEvent) error) (int, error) {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback(ctx)
+
+	rows, err := tx.Query(ctx,
+		`SELECT "outbox_id", "event_id", "event_type", "course_id", "payload", "occurred_at" FROM course_event_outbox
+		WHERE "published_at" IS NULL ORDER BY "outbox_id" LIMIT $1 FOR UPDATE SKIP LOCKED`,
+		outboxRelayBatch,
+	)
+	if err != nil {
+		return 0, err
+	}
+	var ids []int64
+	var pending []outboxEvent
+	for rows.Next() {
+		var id int64
+		var e outboxEvent
+		if err := rows.Scan(&id, &e.EventID, &e.EventType, &e.CourseID, &e.Payload, &e.OccurredAt); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		ids = append(ids, id)
+		pending = append(pending, e)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	sent := 0
+	var sendErr error
+	for i, e := range pending {
+		if sendErr = send(e); sendErr != nil {
+			_, err := tx.Exec(ctx,
+				`UPDATE course_event_outbox SET "attempts" = "attempts" + 1, "last_error" = $2 WHERE "outbox_id" = $1`,
+				ids[i], sendErr.Error(),
+			)
+			if err != nil {
+				return 0, err
+			}
+			break
+		}
+		if _, err := tx.Exec(ctx, `UPDATE course_event_outbox SET "published_at" = NOW() WHERE "outbox_id" = $1`, ids[i]); err != nil {
+			return 0, err
+		}
+		sent++
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return 0, err
+	}
+	if sendErr != nil {
+		return sent, fmt.Errorf("failed to publish %s event for course %d: %v", pending[sent].EventType, pending[sent].CourseID, sendErr)
+	}
+	return sent, nil
+}
+
+// EventPublisher ส่ง event จาก course_event_outbox ไปยัง RabbitMQ (transactional outbox)
+// channel อยู่ใน confirm mode และ event จะถูกนับว่าส่งแล้วก็ต่อเมื่อ broker ยืนยัน (ack) เท่านั้น
+// ระหว่าง RabbitMQ หลุด event จะค้างอยู่ในตารางแล้วถูกส่งเมื่อเชื่อมต่อใหม่ได้
+// ถ้าเป็น nil (เช่นตอนเทส) event จะค้างอยู่ในตารางโดยไม่มีใครส่ง
+type EventPublisher struct {
+	pool    *pgxpool.Pool
+	wake    chan struct{}
+	mu      sync.Mutex
+	channel *amqp.Channel
+}
+
+// newEventPublisher เปิด channel แบบ confirm mode สำหรับ publish event ประกาศ exchange แล้วเริ่ม relay เบื้องหลัง
+func newEventPublisher(rabbit *rabbitmq.Connection, pool *pgxpool.Pool) *EventPublisher {
+	p := &EventPublisher{pool: pool, wake: make(chan struct{}, 1)}
+	err := rabbit.OnChannel("event publisher", func(ch *amqp.Channel) error {
+		if err := declareCourseEventsExchange(ch); err != nil {
+			return err
+		}
+		if err := ch.Confirm(false); err != nil {
+			return err
+		}
+
+		p.mu.Lock()
+		p.channel = ch
+		p.mu.Unlock()
+		p.Notify()
+		return nil
+	})
+	if err != nil {
+		log.Fatal("RabbitMQ Event Channel Error:", err)
+	}
+	go p.run()
+	return p
+}
+
+func declareCourseEventsExchange(ch *amqp.Channel) error {
+	return ch.ExchangeDeclare(courseEventsExchange, "topic", true, false, false, false, nil)
+}
+
+// Notify ปลุก relay ให้ส่ง event ทันทีหลัง commit (ไม่เช่นนั้นจะถูกส่งในรอบถัดไปของ OUTBOX_RELAY_INTERVAL)
+func (p *EventPublisher) Notify() {
+	if p == nil {
+		return
+	}
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
+
+// run วนส่ง event ที่ค้างอยู่ทุกครั้งที่ถูกปลุกหรือครบรอบ และลบ event ที่ส่งแล้วเกิน outboxRetention
+func (p *EventPublisher) run() {
+	interval := 5 * time.Second
+	if v, err := time.ParseDuration(os.Getenv("OUTBOX_RELAY_INTERVAL")); err == nil && v > 0 {
+		interval = v
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	cleanup := time.NewTicker(time.Hour)
+	defer cleanup.Stop()
+
+	for {
+		select {
+		case <-p.wake:
+		case <-ticker.C:
+		case <-cleanup.C:
+			_, err := p.pool.Exec(context.Background(),
+				`DELETE FROM course_event_outbox WHERE "published_at" < $1`, time.Now().Add(-outboxRetention))
+			if err != nil {
+				log.Printf("Failed to clean up published course events: %v", err)
+			}
+			continue
+		}
+
+		for {
+			n, err := relayOutbox(context.Background(), p.pool, p.send)
+			if err != nil {
+				log.Printf("Course event relay: %v", err)
+				break
+			}
+			if n < outboxRelayBatch {
+				break
+			}
+		}
+	}
+}
+
+// send publish event 1 รายการแล้วรอให้ broker ยืนยัน
+func (p *EventPublisher) send(e outboxEvent) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.channel == nil || p.channel.IsClosed() {
+		return rabbitmq.ErrUnavailable
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), outboxConfirmTimeout)
+	defer cancel()
+
+	confirm, err := p.channel.PublishWithDeferredConfirmWithContext(ctx,
+		courseEventsExchange, // exchange
+		e.EventType,          // routing key
+		false,                // mandatory
+		false,                // immediate
+		amqp.Publishing{
+			ContentType:  "application/json",
+			DeliveryMode: amqp.Persistent,
+			MessageId:    e.EventID,
+			Type:         e.EventType,
+			Timestamp:    e.OccurredAt,
+			Body:         e.Payload,
+		})
+	if err != nil {
+		return err
+	}
+	acked, err := confirm.WaitContext(ctx)
+	if err != nil {
+		return fmt.Errorf("no publisher confirm: %v", err)
+	}
+	if !acked {
+		return fmt.Errorf("event nacked by broker")
+	}
+	log.Printf("Published %s event for course %d", e.EventType, e.CourseID)
+	return nil
+}
+
+// courseQuerier ใช้ได้ทั้ง *pgx.Conn, pgx.Tx และ *pgxpool.Pool
+type courseQuerier interface {
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+}
+
+// loadCourse ดึงข้อมูลรายวิชา 1 วิชา
+func loadCourse(ctx context.Context, q courseQuerier, courseID int) (*Course, error) {
+	var course Course
+	err := q.QueryRow(ctx,
+		`SELECT "course_id", "subject", "credit", "section", "day_of_week", "start_time", "end_time", "capacity", "state", "current_student", "prerequisite", "version" FROM course WHERE "course_id" = $1`,
+		courseID,
+	).Scan(
+		&course.CourseID,
+		&course.Subject,
+		&course.Credit,
+		&course.Section,
+		&course.DayOfWeek,
+		&course.StartTime,
+		&course.EndTime,
+		&course.Capacity,
+		&course.State,
+		&course.CurrentStudent,
+		&course.Prerequisite,
+		&course.Version,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &course, nil
+}
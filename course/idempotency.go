@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"os"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// lookupProcessedRequest หาคำตอบเดิมของ correlation ID นี้
+// ใช้ advisory lock ต่อ correlation ID เพื่อให้ข้อความซ้ำที่เข้ามาพร้อมกันรอกันเอง (ปล่อยเมื่อจบ transaction)
+func lookupProcessedRequest(ctx context.Context, tx pgx.Tx, correlationID string) (EnrollmentResponse, bool, error) {
+	var response EnrollmentResponse
+
+	if _, err := tx.Exec(ctx, `SELECT pg_advisory_xact_lock(hashtext($1))`, correlationID); err != nil {
+		return response, false, err
+	}
+	return findProcessedRequest(ctx, tx, correlationID)
+}
+
+// findProcessedRequest หาคำตอบเดิมของ correlation ID นี้โดยไม่ lock
+// consumer ใช้ตอบคำขอที่ enrollment-service retry ด้วย correlation ID เดิมก่อนนับจำนวนครั้งที่ได้รับ
+func findProcessedRequest(ctx context.Context, db outboxWriter, correlationID string) (EnrollmentResponse, bool, error) {
+	var response EnrollmentResponse
+	var body []byte
+	err := db.QueryRow(ctx,
+		`SELECT response FROM processed_enrollment_request WHERE correlation_id = $1`,
+		correlationID,
+	).Scan(&body)
+	if err == pgx.ErrNoRows {
+		return response, false, nil
+	}
+	if err != nil {
+		return response, false, err
+	}
+
+	if err := json.Unmarshal(body, &response); err != nil {
+		return response, false, err
+	}
+	return response, true, nil
+}
+
+// rememberProcessedRequest บันทึกคำตอบของ correlation ID นี้
+func rememberProcessedRequest(ctx context.Context, tx pgx.Tx, correlationID string, response EnrollmentResponse) error {
+	body, err := json.Marshal(response)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(ctx,
+		`INSERT INTO processed_enrollment_request (correlation_id, response) VALUES ($1, $2)
+		 ON CONFLICT (correlation_id) DO NOTHING`,
+		correlationID, body,
+	)
+	return err
+}
+
+// startProcessedRequestJanitor ลบ correlation ID และตัวนับจำนวนครั้งของแต่ละข้อความที่เก่ากว่า PROCESSED_REQUEST_RETENTION (ค่าเริ่มต้น 7 วัน) ทุกชั่วโมง
+func startProcessedRequestJanitor(pool *pgxpool.Pool) {
+	retention := 7 * 24 * time.Hour
+	if v, err := time.ParseDuration(os.Getenv("PROCESSED_REQUEST_RETENTION")); err == nil && v > 0 {
+		retention = v
+	}
+
+	go func() {
+		ticker := time.NewTicker(time.Hour)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			result, err := pool.Exec(context.Background(),
+				`DELETE FROM processed_enrollment_request WHERE processed_at < $1`,
+				time.Now().Add(-retention),
+			)
+			if err != nil {
+				log.Printf("Failed to clean up processed enrollment requests: %v", err)
+				continue
+			}
+			if n := result.RowsAffected(); n > 0 {
+				log.Printf("Cleaned up %d processed enrollment requests", n)
+			}
+
+			_, err = pool.Exec(context.Background(),
+				`DELETE FROM enrollment_delivery_attempt WHERE last_attempt_at < $1`,
+				time.Now().Add(-retention),
+			)
+			if err != nil {
+				log.Printf("Failed to clean up enrollment delivery attempts: %v", err)
+			}
+		}
+	}()
+}
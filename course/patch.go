@@ -0,0 +1,334 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// Content-Type ที่ PATCH รองรับ
+const (
+	contentTypeMergePatch = "application/merge-patch+json" // RFC 7396
+	contentTypeJSONPatch  = "application/json-patch+json"  // RFC 6902
+)
+
+// PatchError ใช้ patch กับเอกสารไม่ได้ เช่น path ไม่มีอยู่ หรือ op test ไม่ผ่าน
+type PatchError struct {
+	Index   int // ลำดับของ operation ที่ผิด (-1 ถ้าไม่ได้มาจาก operation ใด)
+	Message string
+	Failed  bool // op test ไม่ผ่าน (ตอบ 409 แทน 422)
+}
+
+func (e *PatchError) Error() string {
+	if e.Index < 0 {
+		return e.Message
+	}
+	return fmt.Sprintf("operation %d: %s", e.Index, e.Message)
+}
+
+// PatchOperation operation 1 รายการของ JSON Patch
+type PatchOperation struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	From  string          `json:"from,omitempty"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+// applyMergePatch ใช้ JSON Merge Patch (RFC 7396) กับเอกสาร ค่า null หมายถึงลบ field นั้นออก
+func applyMergePatch(target, patch interface{}) interface{} {
+	patchObject, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	targetObject, ok := target.(map[string]interface{})
+	if !ok {
+		targetObject = map[string]interface{}{}
+	}
+	for key, value := range patchObject {
+		if value == nil {
+			delete(targetObject, key)
+			continue
+		}
+		targetObject[key] = applyMergePatch(targetObject[key], value)
+	}
+	return targetObject
+}
+
+// decodeJSONPatch อ่าน JSON Patch และตรวจว่าแต่ละ operation มี field ที่จำเป็นครบ
+func decodeJSONPatch(body []byte) ([]PatchOperation, error) {
+	var ops []PatchOperation
+	if err := json.Unmarshal(body, &ops); err != nil {
+		return nil, fmt.Errorf("JSON Patch must be an array of operations: %v", err)
+	}
+	for i, op := range ops {
+		switch op.Op {
+		case "add", "replace", "test":
+			if len(op.Value) == 0 {
+				return nil, &PatchError{Index: i, Message: op.Op + " requires a value"}
+			}
+		case "move", "copy":
+			if _, err := parsePointer(op.From); err != nil {
+				return nil, &PatchError{Index: i, Message: err.Error()}
+			}
+		case "remove":
+		default:
+			return nil, &PatchError{Index: i, Message: "unknown op " + strconv.Quote(op.Op)}
+		}
+		if _, err := parsePointer(op.Path); err != nil {
+			return nil, &PatchError{Index: i, Message: err.Error()}
+		}
+	}
+	return ops, nil
+}
+
+// applyJSONPatch ใช้ JSON Patch (RFC 6902) ทีละ operation ถ้า operation ใดผิดจะไม่ใช้ทั้งหมด
+// (เอกสารที่ได้จะถูกทิ้งไปเพราะทำใน transaction เดียวกับการบันทึก)
+func applyJSONPatch(doc interface{}, ops []PatchOperation) (interface{}, error) {
+	for i, op := range ops {
+		path, _ := parsePointer(op.Path)
+		var err error
+		switch op.Op {
+		case "add", "replace", "test":
+			var value interface{}
+			if err := json.Unmarshal(op.Value, &value); err != nil {
+				return nil, &PatchError{Index: i, Message: "invalid value: " + err.Error()}
+			}
+			switch op.Op {
+			case "add":
+				doc, err = patchAdd(doc, path, value)
+			case "replace":
+				doc, err = patchReplace(doc, path, value)
+			case "test":
+				var current interface{}
+				current, err = patchGet(doc, path)
+				if err == nil && !reflect.DeepEqual(current, value) {
+					return nil, &PatchError{Index: i, Message: "test failed at " + op.Path, Failed: true}
+				}
+			}
+		case "remove":
+			doc, err = patchRemove(doc, path)
+		case "move", "copy":
+			from, _ := parsePointer(op.From)
+			var value interface{}
+			value, err = patchGet(doc, from)
+			if err != nil {
+				break
+			}
+			if op.Op == "move" {
+				if isPointerPrefix(from, path) {
+					return nil, &PatchError{Index: i, Message: "cannot move " + op.From + " into itself"}
+				}
+				if doc, err = patchRemove(doc, from); err != nil {
+					break
+				}
+			} else {
+				value = deepCopyJSON(value)
+			}
+			doc, err = patchAdd(doc, path, value)
+		}
+		if err != nil {
+			return nil, &PatchError{Index: i, Message: err.Error()}
+		}
+	}
+	return doc, nil
+}
+
+// parsePointer แยก JSON Pointer (RFC 6901) เป็น token "" คือทั้งเอกสาร
+func parsePointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return []string{}, nil
+	}
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, fmt.Errorf("invalid JSON pointer %q", pointer)
+	}
+	tokens := strings.Split(pointer[1:], "/")
+	for i, token := range tokens {
+		tokens[i] = strings.NewReplacer("~1", "/", "~0", "~").Replace(token)
+	}
+	return tokens, nil
+}
+
+// isPointerPrefix from เป็น parent ของ path หรือไม่ (ย้ายค่าไปไว้ในตัวเองไม่ได้)
+func isPointerPrefix(from, path []string) bool {
+	if len(from) >= len(path) {
+		return false
+	}
+	for i := range from {
+		if from[i] != path[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// arrayIndex แปลง token เป็น index ของ array "-" คือต่อท้าย (ใช้ได้เฉพาะ add)
+func arrayIndex(token string, length int, allowEnd bool) (int, error) {
+	if token == "-" && allowEnd {
+		return length, nil
+	}
+	index, err := strconv.Atoi(token)
+	if err != nil || index < 0 || (token != "0" && strings.HasPrefix(token, "0")) {
+		return 0, fmt.Errorf("invalid array index %q", token)
+	}
+	limit := length - 1
+	if allowEnd {
+		limit = length
+	}
+	if index > limit {
+		return 0, fmt.Errorf("array index %d out of range", index)
+	}
+	return index, nil
+}
+
+// patchGet อ่านค่าที่ path
+func patchGet(doc interface{}, path []string) (interface{}, error) {
+	node := doc
+	for _, token := range path {
+		switch n := node.(type) {
+		case map[string]interface{}:
+			value, ok := n[token]
+			if !ok {
+				return nil, fmt.Errorf("path /%s does not exist", strings.Join(path, "/"))
+			}
+			node = value
+		case []interface{}:
+			index, err := arrayIndex(token, len(n), false)
+			if err != nil {
+				return nil, err
+			}
+			node = n[index]
+		default:
+			return nil, fmt.Errorf("path /%s does not exist", strings.Join(path, "/"))
+		}
+	}
+	return node, nil
+}
+
+// patchUpdate เดินไปยัง parent ของ path แล้วให้ leaf แก้ค่า คืน node ใหม่
+// (slice อาจได้ header ใหม่หลังเพิ่ม/ลบสมาชิก จึงต้องเขียนกลับเข้า parent ทุกชั้น)
+func patchUpdate(node interface{}, path []string, leaf func(parent interface{}, token string) (interface{}, error)) (interface{}, error) {
+	if len(path) == 1 {
+		return leaf(node, path[0])
+	}
+	switch n := node.(type) {
+	case map[string]interface{}:
+		child, ok := n[path[0]]
+		if !ok {
+			return nil, fmt.Errorf("path segment %q does not exist", path[0])
+		}
+		updated, err := patchUpdate(child, path[1:], leaf)
+		if err != nil {
+			return nil, err
+		}
+		n[path[0]] = updated
+		return n, nil
+	case []interface{}:
+		index, err := arrayIndex(path[0], len(n), false)
+		if err != nil {
+			return nil, err
+		}
+		updated, err := patchUpdate(n[index], path[1:], leaf)
+		if err != nil {
+			return nil, err
+		}
+		n[index] = updated
+		return n, nil
+	default:
+		return nil, fmt.Errorf("path segment %q is not an object or array", path[0])
+	}
+}
+
+func patchAdd(doc interface{}, path []string, value interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+	return patchUpdate(doc, path, func(parent interface{}, token string) (interface{}, error) {
+		switch n := parent.(type) {
+		case map[string]interface{}:
+			n[token] = value
+			return n, nil
+		case []interface{}:
+			index, err := arrayIndex(token, len(n), true)
+			if err != nil {
+				return nil, err
+			}
+			n = append(n, nil)
+			copy(n[index+1:], n[index:])
+			n[index] = value
+			return n, nil
+		default:
+			return nil, fmt.Errorf("cannot add %q to a non-container value", token)
+		}
+	})
+}
+
+func patchRemove(doc interface{}, path []string) (interface{}, error) {
+	if len(path) == 0 {
+		return nil, fmt.Errorf("cannot remove the whole document")
+	}
+	return patchUpdate(doc, path, func(parent interface{}, token string) (interface{}, error) {
+		switch n := parent.(type) {
+		case map[string]interface{}:
+			if _, ok := n[token]; !ok {
+				return nil, fmt.Errorf("path segment %q does not exist", token)
+			}
+			delete(n, token)
+			return n, nil
+		case []interface{}:
+			index, err := arrayIndex(token, len(n), false)
+			if err != nil {
+				return nil, err
+			}
+			return append(n[:index], n[index+1:]...), nil
+		default:
+			return nil, fmt.Errorf("cannot remove %q from a non-container value", token)
+		}
+	})
+}
+
+func patchReplace(doc interface{}, path []string, value interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+	return patchUpdate(doc, path, func(parent interface{}, token string) (interface{}, error) {
+		switch n := parent.(type) {
+		case map[string]interface{}:
+			if _, ok := n[token]; !ok {
+				return nil, fmt.Errorf("path segment %q does not exist", token)
+			}
+			n[token] = value
+			return n, nil
+		case []interface{}:
+			index, err := arrayIndex(token, len(n), false)
+			if err != nil {
+				return nil, err
+			}
+			n[index] = value
+			return n, nil
+		default:
+			return nil, fmt.Errorf("cannot replace %q in a non-container value", token)
+		}
+	})
+}
+
+// deepCopyJSON คัดลอกค่าที่ได้จาก encoding/json เพื่อไม่ให้ copy แล้วแชร์ map/slice เดียวกัน
+func deepCopyJSON(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		copied := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			copied[key] = deepCopyJSON(item)
+		}
+		return copied
+	case []interface{}:
+		copied := make([]interface{}, len(v))
+		for i, item := range v {
+			copied[i] = deepCopyJSON(item)
+		}
+		return copied
+	default:
+		return v
+	}
+}
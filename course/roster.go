@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/sony/gobreaker"
+
+	"shared/auth"
+)
+
+// CourseRoster รายชื่อนักเรียนของรายวิชา เห็นได้เฉพาะผู้สอนของวิชานั้น registrar และ admin
+type CourseRoster struct {
+	CourseID      int    `json:"course_id"`
+	Subject       string `json:"subject"`
+	Capacity      int    `json:"capacity"`
+	InstructorIDs []int  `json:"instructor_ids"`
+	StudentIDs    []int  `json:"student_ids"`
+}
+
+// courseRows ใช้ได้ทั้ง *pgx.Conn, *pgxpool.Pool และ pgx.Tx
+type courseRows interface {
+	Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error)
+}
+
+// queryInstructors รหัสผู้สอนของรายวิชา
+func queryInstructors(ctx context.Context, db courseRows, courseID int) ([]int, error) {
+	rows, err := db.Query(ctx, `SELECT instructor_id FROM course_instructor WHERE course_id = $1 ORDER BY instructor_id`, courseID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := []int{}
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// rosterAccess บอกว่าผู้เรียกเห็นรายชื่อนักเรียน (current_student) ของรายวิชาใดได้บ้าง
+// ไม่ได้ login หรือเป็นนักเรียนจะไม่เห็นของวิชาใดเลย
+func rosterAccess(ctx context.Context, db courseRows, c *gin.Context) (func(courseID int) bool, error) {
+	id, ok := auth.IdentityFrom(c)
+	switch {
+	case !ok:
+		return func(int) bool { return false }, nil
+	case id.HasRole(auth.RoleRegistrar):
+		return func(int) bool { return true }, nil
+	case !id.HasRole(auth.RoleInstructor):
+		return func(int) bool { return false }, nil
+	}
+
+	rows, err := db.Query(ctx, `SELECT course_id FROM course_instructor WHERE instructor_id = $1`, id.StudentID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	teaching := map[int]bool{}
+	for rows.Next() {
+		var courseID int
+		if err := rows.Scan(&courseID); err != nil {
+			return nil, err
+		}
+		teaching[courseID] = true
+	}
+	return func(courseID int) bool { return teaching[courseID] }, rows.Err()
+}
+
+// hideRosters ล้าง current_student ของรายวิชาที่ผู้เรียกไม่มีสิทธิ์เห็น
+func hideRosters(courses []Course, canSee func(courseID int) bool) {
+	for i := range courses {
+		if !canSee(courses[i].CourseID) {
+			courses[i].CurrentStudent = nil
+		}
+	}
+}
+
+// setInstructors แทนที่ผู้สอนทั้งหมดของรายวิชา
+func setInstructors(ctx context.Context, pool *pgxpool.Pool, courseID int, instructorIDs []int) error {
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	var exists bool
+	if err := tx.QueryRow(ctx, `SELECT EXISTS (SELECT 1 FROM course WHERE course_id = $1)`, courseID).Scan(&exists); err != nil {
+		return err
+	}
+	if !exists {
+		return errCourseNotFound
+	}
+	if _, err := tx.Exec(ctx, `DELETE FROM course_instructor WHERE course_id = $1`, courseID); err != nil {
+		return err
+	}
+	for _, instructorID := range instructorIDs {
+		if _, err := tx.Exec(ctx, `INSERT INTO course_instructor (course_id, instructor_id) VALUES ($1, $2)`, courseID, instructorID); err != nil {
+			return err
+		}
+	}
+	return tx.Commit(ctx)
+}
+
+// registerRosterRoutes ผู้สอนของรายวิชา (registrar กำหนด) และรายชื่อนักเรียนสำหรับผู้สอน
+func registerRosterRoutes(r *gin.Engine, pool *pgxpool.Pool, writeCircuitBreaker *gobreaker.CircuitBreaker, verifier *auth.TokenVerifier) {
+	courseID := func(c *gin.Context) (int, bool) {
+		if pool == nil {
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Course rosters are not available"})
+			return 0, false
+		}
+		id, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid course ID"})
+			return 0, false
+		}
+		return id, true
+	}
+
+	r.GET("/courses/:id/instructors", func(c *gin.Context) {
+		id, ok := courseID(c)
+		if !ok {
+			return
+		}
+		ids, err := queryInstructors(c.Request.Context(), pool, id)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to query instructors: " + err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"course_id": id, "instructor_ids": ids})
+	})
+
+	// รหัสผู้สอนคือ student_id ของบัญชีที่มี role instructor ใน student-service
+	r.PUT("/courses/:id/instructors", auth.RoleRequired(verifier, auth.RoleRegistrar), func(c *gin.Context) {
+		id, ok := courseID(c)
+		if !ok {
+			return
+		}
+		var body struct {
+			InstructorIDs []int `json:"instructor_ids" binding:"required,unique,dive,gt=0"`
+		}
+		if !bindAndValidate(c, &body) {
+			return
+		}
+		sort.Ints(body.InstructorIDs)
+
+		_, err := writeCircuitBreaker.Execute(func() (interface{}, error) {
+			return nil, setInstructors(c.Request.Context(), pool, id, body.InstructorIDs)
+		})
+		switch {
+		case err == gobreaker.ErrOpenState:
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Service temporarily unavailable (circuit breaker is open)"})
+		case err == errCourseNotFound:
+			c.JSON(http.StatusNotFound, gin.H{"error": "Course not found"})
+		case err != nil:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to set instructors: " + err.Error()})
+		default:
+			c.JSON(http.StatusOK, gin.H{"course_id": id, "instructor_ids": body.InstructorIDs})
+		}
+	})
+
+	r.GET("/courses/:id/roster", auth.AuthRequired(verifier), func(c *gin.Context) {
+		id, ok := courseID(c)
+		if !ok {
+			return
+		}
+		ctx := c.Request.Context()
+		canSee, err := rosterAccess(ctx, pool, c)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check roster access: " + err.Error()})
+			return
+		}
+		if !canSee(id) {
+			auth.RespondForbidden(c)
+			return
+		}
+
+		course, err := loadCourse(ctx, pool, id)
+		if err == pgx.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Course not found"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load course: " + err.Error()})
+			return
+		}
+		instructors, err := queryInstructors(ctx, pool, id)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to query instructors: " + err.Error()})
+			return
+		}
+
+		roster := CourseRoster{
+			CourseID:      course.CourseID,
+			Subject:       course.Subject,
+			Capacity:      course.Capacity,
+			InstructorIDs: instructors,
+			StudentIDs:    []int{},
+		}
+		for _, student := range course.CurrentStudent {
+			if studentID, err := strconv.Atoi(student); err == nil {
+				roster.StudentIDs = append(roster.StudentIDs, studentID)
+			}
+		}
+		sort.Ints(roster.StudentIDs)
+		c.JSON(http.StatusOK, roster)
+	})
+}
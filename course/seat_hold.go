@@ -0,0 +1,478 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/sony/gobreaker"
+
+	"shared/auth"
+)
+
+// สถานะของ seat hold
+// held = ถือที่นั่งอยู่ (นับเป็นที่นั่งที่ไม่ว่างจนถึง expires_at), confirmed = ลงทะเบียนแล้ว
+const (
+	HoldStatusHeld      = "held"
+	HoldStatusConfirmed = "confirmed"
+	HoldStatusReleased  = "released"
+	HoldStatusExpired   = "expired"
+)
+
+// ระยะเวลาถือที่นั่งสูงสุดที่ขอได้
+const maxSeatHoldTTL = 30 * time.Minute
+
+// รหัสที่ถูกปฏิเสธเฉพาะการถือที่นั่ง (ไม่อยู่ใน contract ของการลงทะเบียน)
+const (
+	ErrCodeHoldLimitReached    = "HOLD_LIMIT_REACHED"    // ถือที่นั่งครบจำนวนสูงสุดต่อนักเรียนแล้ว
+	ErrCodeHoldLifetimeReached = "HOLD_LIFETIME_REACHED" // ถือที่นั่งวิชานี้ครบเวลาสูงสุดแล้ว ต้องรอ cooldown ก่อนถือใหม่
+)
+
+var (
+	errHoldNotFound  = errors.New("seat hold not found")
+	errHoldNotActive = errors.New("seat hold is no longer active")
+)
+
+// SeatHold การถือที่นั่ง 1 ที่ในรายวิชา 1 วิชาให้นักเรียน 1 คน
+type SeatHold struct {
+	HoldID    int       `json:"hold_id"`
+	CourseID  int       `json:"course_id"`
+	StudentID int       `json:"student_id"`
+	Status    string    `json:"status"`
+	ExpiresAt time.Time `json:"expires_at"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+const seatHoldColumns = `"hold_id", "course_id", "student_id", "status", "expires_at", "created_at"`
+
+// scanSeatHold อ่าน hold 1 แถว hold ที่หมดเวลาแต่ reaper ยังไม่ได้ปรับจะแสดงเป็น expired
+func scanSeatHold(row pgx.Row) (SeatHold, error) {
+	var h SeatHold
+	err := row.Scan(&h.HoldID, &h.CourseID, &h.StudentID, &h.Status, &h.ExpiresAt, &h.CreatedAt)
+	if err == nil && h.Status == HoldStatusHeld && !h.ExpiresAt.After(time.Now()) {
+		h.Status = HoldStatusExpired
+	}
+	return h, err
+}
+
+// seatHoldTTL ระยะเวลาถือที่นั่ง ใช้ ttl_seconds จาก request ถ้ามี ไม่งั้นใช้ SEAT_HOLD_TTL (ค่าเริ่มต้น 10 นาที)
+func seatHoldTTL(requestedSeconds int) time.Duration {
+	ttl := 10 * time.Minute
+	if v, err := time.ParseDuration(os.Getenv("SEAT_HOLD_TTL")); err == nil && v > 0 {
+		ttl = v
+	}
+	if requestedSeconds > 0 {
+		ttl = time.Duration(requestedSeconds) * time.Second
+	}
+	return min(ttl, maxSeatHoldTTL)
+}
+
+// seatHoldLimits ขีดจำกัดการถือที่นั่งต่อนักเรียน
+// MaxActive = จำนวน hold ที่ active พร้อมกันได้, MaxLifetime = เวลาถือรวมนับจาก created_at (ต่ออายุเกินนี้ไม่ได้)
+// Cooldown = ระยะที่ถือวิชาเดิมใหม่ไม่ได้หลัง hold ที่ถือจนครบ MaxLifetime หมดอายุ เพื่อไม่ให้ถือต่อโดยสร้าง hold ใหม่ทันที
+type seatHoldLimits struct {
+	MaxActive   int
+	MaxLifetime time.Duration
+	Cooldown    time.Duration
+}
+
+// loadSeatHoldLimits อ่านขีดจำกัดจาก SEAT_HOLD_MAX_PER_STUDENT (ค่าเริ่มต้น 10), SEAT_HOLD_MAX_LIFETIME (1 ชั่วโมง)
+// และ SEAT_HOLD_COOLDOWN (10 นาที)
+func loadSeatHoldLimits() seatHoldLimits {
+	limits := seatHoldLimits{MaxActive: 10, MaxLifetime: time.Hour, Cooldown: 10 * time.Minute}
+	if v, err := strconv.Atoi(os.Getenv("SEAT_HOLD_MAX_PER_STUDENT")); err == nil && v > 0 {
+		limits.MaxActive = v
+	}
+	if v, err := time.ParseDuration(os.Getenv("SEAT_HOLD_MAX_LIFETIME")); err == nil && v > 0 {
+		limits.MaxLifetime = v
+	}
+	if v, err := time.ParseDuration(os.Getenv("SEAT_HOLD_COOLDOWN")); err == nil && v >= 0 {
+		limits.Cooldown = v
+	}
+	return limits
+}
+
+// heldSeatsByOthers จำนวนที่นั่งในรายวิชาที่นักเรียนคนอื่นถืออยู่และยังไม่หมดอายุ
+func heldSeatsByOthers(ctx context.Context, tx pgx.Tx, courseID, studentID int) (int, error) {
+	var held int
+	err := tx.QueryRow(ctx,
+		`SELECT COUNT(*) FROM seat_hold
+		 WHERE course_id = $1 AND student_id <> $2 AND status = 'held' AND expires_at > NOW()`,
+		courseID, studentID,
+	).Scan(&held)
+	return held, err
+}
+
+// confirmSeatHold เปลี่ยน hold ของนักเรียนในรายวิชาเป็น confirmed เมื่อลงทะเบียนสำเร็จ
+func confirmSeatHold(ctx context.Context, tx pgx.Tx, courseID, studentID int) error {
+	_, err := tx.Exec(ctx,
+		`UPDATE seat_hold SET status = 'confirmed', updated_at = NOW()
+		 WHERE course_id = $1 AND student_id = $2 AND status = 'held' AND expires_at > NOW()`,
+		courseID, studentID,
+	)
+	return err
+}
+
+// createSeatHolds ถือที่นั่งให้นักเรียนในทุกวิชาที่ขอ ได้ครบทุกวิชาหรือไม่ได้เลย
+// ถ้านักเรียนถือที่นั่งในวิชานั้นอยู่แล้วจะต่ออายุแทนการสร้างใหม่ แต่ expires_at ไม่เกิน created_at + MaxLifetime
+// คืน rejection เมื่อถูกปฏิเสธตามเงื่อนไข (ใช้รหัสเดียวกับการลงทะเบียน หรือรหัสขีดจำกัดของ hold)
+func createSeatHolds(ctx context.Context, pool *pgxpool.Pool, studentID int, courseIDs []int, ttl time.Duration, limits seatHoldLimits) ([]SeatHold, *EnrollmentResponse, error) {
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	// lock ต่อนักเรียนเพื่อให้คำขอพร้อมกันของนักเรียนคนเดียวนับจำนวน hold ตรงกัน
+	if _, err := tx.Exec(ctx, `SELECT pg_advisory_xact_lock(hashtext('seat_hold'), $1)`, studentID); err != nil {
+		return nil, nil, err
+	}
+
+	// hold ในวิชาที่ขอจะถูกต่ออายุหรือสร้างใหม่ จึงนับเฉพาะ hold ที่ active ในวิชาอื่น
+	requested := map[int]bool{}
+	for _, courseID := range courseIDs {
+		requested[courseID] = true
+	}
+	var otherHolds int
+	if err := tx.QueryRow(ctx,
+		`SELECT COUNT(*) FROM seat_hold
+		 WHERE student_id = $1 AND status = 'held' AND expires_at > NOW() AND course_id <> ALL($2)`,
+		studentID, courseIDs,
+	).Scan(&otherHolds); err != nil {
+		return nil, nil, err
+	}
+	if otherHolds+len(requested) > limits.MaxActive {
+		rejection := rejectEnrollment(ErrCodeHoldLimitReached, courseIDs[0], "Student %d can hold at most %d seats", studentID, limits.MaxActive)
+		return nil, &rejection, nil
+	}
+
+	// lock ตามลำดับ course_id เหมือน processEnrollment เพื่อไม่ให้เกิด deadlock
+	sorted := append([]int(nil), courseIDs...)
+	sort.Ints(sorted)
+	if _, err := tx.Exec(ctx, `SELECT course_id FROM course WHERE course_id = ANY($1) ORDER BY course_id FOR UPDATE`, sorted); err != nil {
+		return nil, nil, err
+	}
+
+	expiresAt := time.Now().Add(ttl)
+	studentIDStr := strconv.Itoa(studentID)
+	holds := []SeatHold{}
+
+	for _, courseID := range courseIDs {
+		var capacity int
+		var currentStudents []string
+		var state string
+		err := tx.QueryRow(ctx,
+			`SELECT capacity, COALESCE(current_student, '{}'::text[]), state FROM course WHERE course_id = $1`,
+			courseID,
+		).Scan(&capacity, &currentStudents, &state)
+		if err == pgx.ErrNoRows {
+			rejection := rejectEnrollment(ErrCodeCourseNotFound, courseID, "Course ID %d not found", courseID)
+			return nil, &rejection, nil
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if rejection := enrollmentStateRejection(courseID, state); rejection != nil {
+			return nil, rejection, nil
+		}
+		for _, existing := range currentStudents {
+			if existing == studentIDStr {
+				rejection := rejectEnrollment(ErrCodeAlreadyEnrolled, courseID, "Student %d already enrolled in course %d", studentID, courseID)
+				return nil, &rejection, nil
+			}
+		}
+
+		held, err := heldSeatsByOthers(ctx, tx, courseID, studentID)
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(currentStudents)+held >= capacity {
+			rejection := rejectEnrollment(ErrCodeCourseFull, courseID, "Course ID %d is full", courseID)
+			return nil, &rejection, nil
+		}
+
+		// ต่ออายุ hold เดิมถ้ามี (ไม่เกิน created_at + MaxLifetime) ไม่งั้นสร้างใหม่
+		hold, err := scanSeatHold(tx.QueryRow(ctx,
+			`UPDATE seat_hold SET expires_at = LEAST($3, created_at + $4::interval), updated_at = NOW()
+			 WHERE course_id = $1 AND student_id = $2 AND status = 'held' AND expires_at > NOW()
+			 RETURNING `+seatHoldColumns,
+			courseID, studentID, expiresAt, limits.MaxLifetime,
+		))
+		if err == pgx.ErrNoRows {
+			// hold ก่อนหน้าที่ถือจนครบ MaxLifetime ต้องหมดอายุเกิน Cooldown ก่อนจึงถือวิชาเดิมใหม่ได้
+			var coolingDown bool
+			if err := tx.QueryRow(ctx,
+				`SELECT EXISTS (SELECT 1 FROM seat_hold
+				 WHERE course_id = $1 AND student_id = $2 AND status IN ('held', 'expired')
+				   AND expires_at >= created_at + $3::interval AND expires_at > NOW() - $4::interval)`,
+				courseID, studentID, limits.MaxLifetime, limits.Cooldown,
+			).Scan(&coolingDown); err != nil {
+				return nil, nil, err
+			}
+			if coolingDown {
+				rejection := rejectEnrollment(ErrCodeHoldLifetimeReached, courseID, "Student %d held course %d for the maximum time, try again later", studentID, courseID)
+				return nil, &rejection, nil
+			}
+			hold, err = scanSeatHold(tx.QueryRow(ctx,
+				`INSERT INTO seat_hold ("course_id", "student_id", "status", "expires_at")
+				 VALUES ($1, $2, 'held', $3)
+				 RETURNING `+seatHoldColumns,
+				courseID, studentID, expiresAt,
+			))
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		holds = append(holds, hold)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, nil, err
+	}
+	return holds, nil, nil
+}
+
+// releaseSeatHold คืนที่นั่งที่ถืออยู่ก่อนหมดเวลา
+func releaseSeatHold(ctx context.Context, pool *pgxpool.Pool, holdID int) (SeatHold, error) {
+	hold, err := scanSeatHold(pool.QueryRow(ctx,
+		`UPDATE seat_hold SET status = 'released', updated_at = NOW()
+		 WHERE hold_id = $1 AND status = 'held' AND expires_at > NOW()
+		 RETURNING `+seatHoldColumns,
+		holdID,
+	))
+	if err != pgx.ErrNoRows {
+		return hold, err
+	}
+
+	// ไม่มี hold ที่ยัง active แยกให้ออกว่าไม่มีอยู่เลยหรือหมดอายุ/ถูกใช้ไปแล้ว
+	hold, err = scanSeatHold(pool.QueryRow(ctx, `SELECT `+seatHoldColumns+` FROM seat_hold WHERE hold_id = $1`, holdID))
+	if err == pgx.ErrNoRows {
+		return hold, errHoldNotFound
+	}
+	if err != nil {
+		return hold, err
+	}
+	return hold, errHoldNotActive
+}
+
+// expireSeatHolds เปลี่ยน hold ที่หมดเวลาแล้วเป็น expired
+func expireSeatHolds(ctx context.Context, pool *pgxpool.Pool) (int64, error) {
+	result, err := pool.Exec(ctx,
+		`UPDATE seat_hold SET status = 'expired', updated_at = NOW()
+		 WHERE status = 'held' AND expires_at <= NOW()`,
+	)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected(), nil
+}
+
+// startSeatHoldReaper ปล่อย hold ที่หมดเวลาทุก SEAT_HOLD_REAPER_INTERVAL (ค่าเริ่มต้น 30 วินาที)
+// hold ที่หมดเวลาไม่ถูกนับเป็นที่นั่งที่ไม่ว่างอยู่แล้ว reaper แค่ปรับสถานะให้ตรง
+func startSeatHoldReaper(pool *pgxpool.Pool) {
+	interval := 30 * time.Second
+	if v, err := time.ParseDuration(os.Getenv("SEAT_HOLD_REAPER_INTERVAL")); err == nil && v > 0 {
+		interval = v
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			n, err := expireSeatHolds(context.Background(), pool)
+			if err != nil {
+				log.Printf("Failed to expire seat holds: %v", err)
+				continue
+			}
+			if n > 0 {
+				log.Printf("Expired %d seat holds", n)
+			}
+		}
+	}()
+}
+
+// holdRejectionStatus HTTP status ของรหัสที่ถูกปฏิเสธตอนถือที่นั่ง
+func holdRejectionStatus(code string) int {
+	if code == ErrCodeCourseNotFound {
+		return http.StatusNotFound
+	}
+	return http.StatusConflict
+}
+
+// registerSeatHoldRoutes เพิ่ม endpoint สำหรับถือ/คืนที่นั่งระหว่าง checkout
+// การยืนยัน (confirm) เกิดขึ้นตอนลงทะเบียนผ่าน enrollment-service ซึ่งจะใช้ hold ของนักเรียนคนนั้น
+func registerSeatHoldRoutes(r *gin.Engine, pool *pgxpool.Pool, writeCircuitBreaker *gobreaker.CircuitBreaker, requireAuth gin.HandlerFunc) {
+	available := func(c *gin.Context) bool {
+		if pool == nil {
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Seat holds are not available"})
+			return false
+		}
+		return true
+	}
+
+	// นักเรียนจัดการได้เฉพาะ hold ของตัวเอง registrar จัดการแทนได้
+	canManage := func(c *gin.Context, studentID int) bool {
+		id, _ := auth.IdentityFrom(c)
+		if !id.IsSelfOr(studentID, auth.RoleRegistrar) {
+			auth.RespondForbidden(c)
+			return false
+		}
+		return true
+	}
+
+	holdID := func(c *gin.Context) (int, bool) {
+		id, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid hold ID"})
+			return 0, false
+		}
+		return id, true
+	}
+
+	// ถือที่นั่ง
+	r.POST("/holds", requireAuth, func(c *gin.Context) {
+		var body struct {
+			StudentID  int   `json:"student_id" binding:"required"`
+			CourseIDs  []int `json:"course_ids" binding:"required,min=1"`
+			TTLSeconds int   `json:"ttl_seconds"`
+		}
+		if err := c.ShouldBindJSON(&body); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON body: " + err.Error()})
+			return
+		}
+		if !canManage(c, body.StudentID) || !available(c) {
+			return
+		}
+
+		ttl := seatHoldTTL(body.TTLSeconds)
+		limits := loadSeatHoldLimits()
+		var rejection *EnrollmentResponse
+		result, err := writeCircuitBreaker.Execute(func() (interface{}, error) {
+			holds, rej, err := createSeatHolds(context.Background(), pool, body.StudentID, body.CourseIDs, ttl, limits)
+			rejection = rej
+			return holds, err
+		})
+
+		if err == gobreaker.ErrOpenState {
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Service temporarily unavailable (circuit breaker is open)"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to hold seats: " + err.Error()})
+			return
+		}
+		if rejection != nil {
+			c.JSON(holdRejectionStatus(rejection.Code), gin.H{
+				"error":     rejection.Error,
+				"code":      rejection.Code,
+				"course_id": rejection.CourseID,
+			})
+			return
+		}
+
+		holds := result.([]SeatHold)
+		c.JSON(http.StatusCreated, gin.H{"holds": holds, "expires_at": holds[0].ExpiresAt})
+	})
+
+	// ดู hold ที่ยัง active ของนักเรียน
+	r.GET("/holds", requireAuth, func(c *gin.Context) {
+		studentID, err := strconv.Atoi(c.Query("student_id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "student_id is required"})
+			return
+		}
+		if !canManage(c, studentID) || !available(c) {
+			return
+		}
+
+		rows, err := pool.Query(context.Background(),
+			`SELECT `+seatHoldColumns+` FROM seat_hold
+			 WHERE student_id = $1 AND status = 'held' AND expires_at > NOW()
+			 ORDER BY hold_id`,
+			studentID,
+		)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list seat holds: " + err.Error()})
+			return
+		}
+		defer rows.Close()
+
+		holds := []SeatHold{}
+		for rows.Next() {
+			hold, err := scanSeatHold(rows)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read seat hold: " + err.Error()})
+				return
+			}
+			holds = append(holds, hold)
+		}
+		c.JSON(http.StatusOK, gin.H{"holds": holds})
+	})
+
+	// ดู hold 1 รายการ
+	r.GET("/holds/:id", requireAuth, func(c *gin.Context) {
+		id, ok := holdID(c)
+		if !ok || !available(c) {
+			return
+		}
+
+		hold, err := scanSeatHold(pool.QueryRow(context.Background(), `SELECT `+seatHoldColumns+` FROM seat_hold WHERE hold_id = $1`, id))
+		if err == pgx.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Seat hold not found"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get seat hold: " + err.Error()})
+			return
+		}
+		if !canManage(c, hold.StudentID) {
+			return
+		}
+		c.JSON(http.StatusOK, hold)
+	})
+
+	// คืนที่นั่ง
+	r.DELETE("/holds/:id", requireAuth, func(c *gin.Context) {
+		id, ok := holdID(c)
+		if !ok || !available(c) {
+			return
+		}
+
+		// ตรวจเจ้าของก่อนคืนที่นั่ง
+		var owner int
+		err := pool.QueryRow(context.Background(), `SELECT student_id FROM seat_hold WHERE hold_id = $1`, id).Scan(&owner)
+		if err == pgx.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Seat hold not found"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get seat hold: " + err.Error()})
+			return
+		}
+		if !canManage(c, owner) {
+			return
+		}
+
+		hold, err := releaseSeatHold(context.Background(), pool, id)
+		switch {
+		case errors.Is(err, errHoldNotFound):
+			c.JSON(http.StatusNotFound, gin.H{"error": "Seat hold not found"})
+		case errors.Is(err, errHoldNotActive):
+			c.JSON(http.StatusConflict, gin.H{"error": "Seat hold is already " + hold.Status, "hold": hold})
+		case err != nil:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to release seat hold: " + err.Error()})
+		default:
+			c.JSON(http.StatusOK, gin.H{"message": "Seat hold released", "hold": hold})
+		}
+	})
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/sony/gobreaker"
+
+	"shared/auth"
+)
+
+// สถานะของรายวิชา รับลงทะเบียนได้เฉพาะ open
+// open <-> full เปลี่ยนอัตโนมัติตามจำนวนที่นั่ง ส่วนที่เหลือเปลี่ยนผ่าน transition endpoint เท่านั้น
+const (
+	CourseStateDraft     = "draft"
+	CourseStatePublished = "published"
+	CourseStateOpen      = "open"
+	CourseStateFull      = "full"
+	CourseStateClosed    = "closed"
+	CourseStateCancelled = "cancelled"
+	CourseStateArchived  = "archived"
+)
+
+// courseTransitions การเปลี่ยนสถานะที่ทำด้วยมือได้ (from -> to)
+var courseTransitions = map[string][]string{
+	CourseStateDraft:     {CourseStatePublished, CourseStateCancelled},
+	CourseStatePublished: {CourseStateDraft, CourseStateOpen, CourseStateCancelled},
+	CourseStateOpen:      {CourseStateClosed, CourseStateCancelled},
+	CourseStateFull:      {CourseStateClosed, CourseStateCancelled},
+	CourseStateClosed:    {CourseStateOpen, CourseStateCancelled, CourseStateArchived},
+	CourseStateCancelled: {CourseStateArchived},
+	CourseStateArchived:  {},
+}
+
+// courseStateActions path ของ transition endpoint -> สถานะปลายทาง
+var courseStateActions = map[string]string{
+	"publish":   CourseStatePublished,
+	"unpublish": CourseStateDraft,
+	"open":      CourseStateOpen,
+	"close":     CourseStateClosed,
+	"cancel":    CourseStateCancelled,
+	"archive":   CourseStateArchived,
+}
+
+// actor ของการเปลี่ยนสถานะที่ระบบทำเอง
+const systemActor = "system"
+
+var errCourseNotFound = errors.New("course not found")
+
+// errCourseHasStudents ลบรายวิชาที่ยังมีนักเรียนลงทะเบียนอยู่ไม่ได้
+var errCourseHasStudents = errors.New("course has enrolled students")
+
+// InvalidTransitionError เปลี่ยนจากสถานะปัจจุบันไปสถานะที่ขอไม่ได้
+type InvalidTransitionError struct {
+	From string
+	To   string
+}
+
+func (e *InvalidTransitionError) Error() string {
+	return fmt.Sprintf("cannot transition course from %s to %s", e.From, e.To)
+}
+
+// CourseStateTransition ประวัติการเปลี่ยนสถานะ 1 ครั้ง
+type CourseStateTransition struct {
+	TransitionID int       `json:"transition_id"`
+	CourseID     int       `json:"course_id"`
+	FromState    string    `json:"from_state"`
+	ToState      string    `json:"to_state"`
+	Reason       string    `json:"reason"`
+	Actor        string    `json:"actor"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// isCourseState เช็คว่าเป็นสถานะที่รู้จัก
+func isCourseState(state string) bool {
+	_, ok := courseTransitions[state]
+	return ok
+}
+
+// canTransition เช็คว่าเปลี่ยนสถานะด้วยมือจาก from ไป to ได้หรือไม่
+func canTransition(from, to string) bool {
+	for _, allowed := range courseTransitions[from] {
+		if allowed == to {
+			return true
+		}
+	}
+	return false
+}
+
+// enrollmentStateRejection คำตอบเมื่อสถานะของรายวิชาไม่รับลงทะเบียน (nil ถ้ารับได้)
+func enrollmentStateRejection(courseID int, state string) *EnrollmentResponse {
+	switch state {
+	case CourseStateOpen:
+		return nil
+	case CourseStateFull:
+		rejection := rejectEnrollment(ErrCodeCourseFull, courseID, "Course ID %d is full", courseID)
+		return &rejection
+	default:
+		rejection := rejectEnrollment(ErrCodeCourseClosed, courseID, "Course ID %d is not open for enrollment (state: %s)", courseID, state)
+		return &rejection
+	}
+}
+
+// courseExecer ใช้ได้ทั้ง *pgx.Conn, pgx.Tx และ *pgxpool.Pool
+type courseExecer interface {
+	courseQuerier
+	Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error)
+}
+
+// recordStateTransition บันทึกประวัติการเปลี่ยนสถานะ
+func recordStateTransition(ctx context.Context, db courseExecer, courseID int, from, to, reason, actor string) error {
+	_, err := db.Exec(ctx,
+		`INSERT INTO course_state_transition ("course_id", "from_state", "to_state", "reason", "actor") VALUES ($1, $2, $3, $4, $5)`,
+		courseID, from, to, reason, actor,
+	)
+	return err
+}
+
+// transitionCourse เปลี่ยนสถานะด้วยมือภายใน transaction ที่ให้มา คืนสถานะก่อนหน้า
+// ถ้าเปิดรายวิชาที่ที่นั่งเต็มอยู่แล้ว จะกลายเป็น full ทันที
+func transitionCourse(ctx context.Context, tx pgx.Tx, courseID int, to, reason, actor string) (string, error) {
+	var from string
+	err := tx.QueryRow(ctx, `SELECT state FROM course WHERE course_id = $1 FOR UPDATE`, courseID).Scan(&from)
+	if err == pgx.ErrNoRows {
+		return "", errCourseNotFound
+	}
+	if err != nil {
+		return "", err
+	}
+	if !canTransition(from, to) {
+		return from, &InvalidTransitionError{From: from, To: to}
+	}
+
+	if _, err := tx.Exec(ctx, `UPDATE course SET state = $1, "version" = "version" + 1 WHERE course_id = $2`, to, courseID); err != nil {
+		return from, err
+	}
+	if err := recordStateTransition(ctx, tx, courseID, from, to, reason, actor); err != nil {
+		return from, err
+	}
+	switch to {
+	case CourseStateOpen:
+		if _, _, err := syncSeatState(ctx, tx, courseID); err != nil {
+			return from, err
+		}
+	case CourseStateCancelled:
+		if err := releaseCancelledCourse(ctx, tx, courseID); err != nil {
+			return from, err
+		}
+	}
+	return from, nil
+}
+
+// releaseCancelledCourse ถอนนักเรียนทั้งหมดและคืน hold ของรายวิชาที่ถูกยกเลิก
+// ฝั่ง enrollment-service จะถอนรายวิชาออกจากการลงทะเบียนเมื่อได้รับ course.cancelled
+func releaseCancelledCourse(ctx context.Context, tx pgx.Tx, courseID int) error {
+	if _, err := tx.Exec(ctx, `UPDATE course SET current_student = '{}' WHERE course_id = $1`, courseID); err != nil {
+		return err
+	}
+	_, err := tx.Exec(ctx,
+		`UPDATE seat_hold SET status = 'released', updated_at = NOW() WHERE course_id = $1 AND status = 'held'`,
+		courseID,
+	)
+	return err
+}
+
+// syncSeatState เปลี่ยน open -> full เมื่อที่นั่งเต็ม และ full -> open เมื่อมีที่นั่งว่าง
+// คืนสถานะปัจจุบันและบอกว่ามีการเปลี่ยนหรือไม่ สถานะอื่นไม่ถูกแตะ
+func syncSeatState(ctx context.Context, db courseExecer, courseID int) (string, bool, error) {
+	var state string
+	err := db.QueryRow(ctx,
+		`UPDATE course SET state = CASE WHEN state = 'open' THEN 'full' ELSE 'open' END
+		 WHERE course_id = $1 AND (
+			(state = 'open' AND COALESCE(cardinality(current_student), 0) >= capacity) OR
+			(state = 'full' AND COALESCE(cardinality(current_student), 0) < capacity))
+		 RETURNING state`,
+		courseID,
+	).Scan(&state)
+	if err == pgx.ErrNoRows {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+
+	from, reason := CourseStateOpen, "all seats taken"
+	if state == CourseStateOpen {
+		from, reason = CourseStateFull, "seats available"
+	}
+	if err := recordStateTransition(ctx, db, courseID, from, state, reason, systemActor); err != nil {
+		return state, false, err
+	}
+	return state, true, nil
+}
+
+// queryStateTransitions ประวัติการเปลี่ยนสถานะของรายวิชา เรียงจากเก่าไปใหม่
+func queryStateTransitions(ctx context.Context, pool *pgxpool.Pool, courseID int) ([]CourseStateTransition, error) {
+	rows, err := pool.Query(ctx,
+		`SELECT "transition_id", "course_id", "from_state", "to_state", "reason", "actor", "created_at"
+		 FROM course_state_transition WHERE course_id = $1 ORDER BY created_at, transition_id`,
+		courseID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	transitions := []CourseStateTransition{}
+	for rows.Next() {
+		var t CourseStateTransition
+		if err := rows.Scan(&t.TransitionID, &t.CourseID, &t.FromState, &t.ToState, &t.Reason, &t.Actor, &t.CreatedAt); err != nil {
+			return nil, err
+		}
+		transitions = append(transitions, t)
+	}
+	return transitions, rows.Err()
+}
+
+func registerCourseStateRoutes(r *gin.Engine, pool *pgxpool.Pool, events *EventPublisher, writeCircuitBreaker *gobreaker.CircuitBreaker, requireRegistrar gin.HandlerFunc) {
+	for action, to := range courseStateActions {
+		r.POST("/courses/:id/"+action, requireRegistrar, courseTransitionHandler(pool, events, writeCircuitBreaker, to))
+	}
+
+	// ประวัติการเปลี่ยนสถานะ
+	r.GET("/courses/:id/transitions", func(c *gin.Context) {
+		if pool == nil {
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Course state transitions are not available"})
+			return
+		}
+		courseID, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid course ID"})
+			return
+		}
+
+		transitions, err := queryStateTransitions(c.Request.Context(), pool, courseID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to query transitions: " + err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, transitions)
+	})
+}
+
+// courseTransitionHandler POST /courses/:id/<action> body {"reason": "..."}
+func courseTransitionHandler(pool *pgxpool.Pool, events *EventPublisher, writeCircuitBreaker *gobreaker.CircuitBreaker, to string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if pool == nil {
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Course state transitions are not available"})
+			return
+		}
+		courseID, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid course ID"})
+			return
+		}
+
+		var body struct {
+			Reason string `json:"reason" binding:"required"`
+		}
+		if err := c.ShouldBindJSON(&body); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON body: " + err.Error()})
+			return
+		}
+		// ผู้กระทำมาจาก token ไม่ใช่ header ที่ใครก็ตั้งได้
+		id, _ := auth.IdentityFrom(c)
+		actor := id.Actor()
+
+		var from string
+		_, err = writeCircuitBreaker.Execute(func() (interface{}, error) {
+			ctx := c.Request.Context()
+			tx, err := pool.Begin(ctx)
+			if err != nil {
+				return nil, err
+			}
+			defer tx.Rollback(ctx)
+
+			from, err = transitionCourse(ctx, tx, courseID, to, body.Reason, actor)
+			if err != nil {
+				return nil, err
+			}
+			eventTypes := []string{EventCourseStateChanged}
+			if to == CourseStateClosed {
+				eventTypes = append(eventTypes, EventCourseClosed)
+			}
+			if err := enqueueCourseEvents(ctx, tx, courseID, eventTypes...); err != nil {
+				return nil, err
+			}
+			// enrollment-service ถอนนักเรียนเมื่อได้ course.cancelled จึงต้องบันทึกพร้อมการยกเลิก ไม่ใช่หลัง commit
+			if to == CourseStateCancelled {
+				if err := enqueueCourseEventWithReason(ctx, tx, EventCourseCancelled, courseID, body.Reason, nil); err != nil {
+					return nil, err
+				}
+			}
+			return nil, tx.Commit(ctx)
+		})
+
+		var invalid *InvalidTransitionError
+		switch {
+		case err == gobreaker.ErrOpenState:
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Service temporarily unavailable (circuit breaker is open)"})
+			return
+		case errors.Is(err, errCourseNotFound):
+			c.JSON(http.StatusNotFound, gin.H{"error": "Course not found"})
+			return
+		case errors.As(err, &invalid):
+			c.JSON(http.StatusConflict, gin.H{
+				"error":   invalid.Error(),
+				"from":    invalid.From,
+				"to":      invalid.To,
+				"allowed": courseTransitions[invalid.From],
+			})
+			return
+		case err != nil:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to change course state: " + err.Error()})
+			return
+		}
+
+		events.Notify()
+
+		course, err := loadCourse(c.Request.Context(), pool, courseID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load course: " + err.Error()})
+			return
+		}
+		c.Header("ETag", etagFor(course.Version))
+		c.JSON(http.StatusOK, gin.H{"course_id": courseID, "from": from, "state": course.State})
+	}
+}
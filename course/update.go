@@ -0,0 +1,348 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+	"github.com/sony/gobreaker"
+)
+
+// CourseDocument ข้อมูลของรายวิชาที่แก้ไขผ่าน PUT / PATCH ได้
+// PUT ต้องส่งครบทุก field (field ที่ไม่ส่งจะถูกล้าง เช่น prerequisite)
+type CourseDocument struct {
+	Subject      string   `json:"subject"      binding:"required,max=255"`
+	Credit       int      `json:"credit"       binding:"required,gt=0,lte=12"`
+	Section      []string `json:"section"      binding:"required,min=1,unique,dive,required,max=255"`
+	DayOfWeek    string   `json:"day_of_week"  binding:"required,dayofweek"`
+	StartTime    string   `json:"start_time"   binding:"required,timeofday"`
+	EndTime      string   `json:"end_time"     binding:"required,timeofday"`
+	Capacity     int      `json:"capacity"     binding:"required,gt=0"`
+	Prerequisite []string `json:"prerequisite" binding:"omitempty,unique,dive,required,max=255"`
+}
+
+// Validate เวลาจบต้องหลังเวลาเริ่ม
+func (d CourseDocument) Validate() []FieldError {
+	start, startErr := normalizeCourseTime("start_time", d.StartTime)
+	end, endErr := normalizeCourseTime("end_time", d.EndTime)
+	if startErr == nil && endErr == nil && end <= start {
+		return []FieldError{{Field: "end_time", Message: "end_time must be after start_time"}}
+	}
+	return nil
+}
+
+// courseReadOnlyFields field ที่ส่งมาได้ (เช่นส่งผลจาก GET กลับมาทั้งก้อน) แต่ห้ามเปลี่ยนค่า
+var courseReadOnlyFields = map[string]string{
+	"course_id":       "course_id cannot be changed",
+	"state":           "state cannot be set directly, use POST /courses/:id/{publish,unpublish,open,close,cancel,archive}",
+	"current_student": "current_student is managed by enrollment and cannot be edited",
+	"version":         "version is managed by the server, send it in If-Match instead",
+}
+
+// courseDocumentBuilder สร้างเอกสารใหม่ของรายวิชาจากเอกสารปัจจุบัน
+type courseDocumentBuilder func(current map[string]interface{}) (interface{}, error)
+
+// courseUpdateResult ผลของการแก้ไขรายวิชา Capacity เป็น nil ถ้าจำนวนที่นั่งไม่เปลี่ยน
+type courseUpdateResult struct {
+	Version      int
+	Capacity     *CapacityReport
+	StateChanged bool
+}
+
+// courseDocumentOf เอกสาร JSON ของรายวิชา (เวลาเป็น HH:MM:SS) ใช้เป็นต้นฉบับให้ patch
+func courseDocumentOf(course *Course) (map[string]interface{}, error) {
+	copied := *course
+	if copied.CurrentStudent == nil {
+		copied.CurrentStudent = []string{}
+	}
+	raw, err := json.Marshal(copied)
+	if err != nil {
+		return nil, err
+	}
+	var doc map[string]interface{}
+	if err := json.Unmarshal(raw, &doc); err != nil {
+		return nil, err
+	}
+	doc["start_time"] = course.StartTime.Format("15:04:05")
+	doc["end_time"] = course.EndTime.Format("15:04:05")
+	return doc, nil
+}
+
+// normalizeCourseTime รับเวลาแบบ HH:MM:SS, HH:MM หรือแบบที่ GET ตอบกลับ (RFC 3339) แล้วแปลงเป็น HH:MM:SS
+func normalizeCourseTime(field, value string) (string, error) {
+	for _, layout := range []string{"15:04:05", "15:04", time.RFC3339} {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t.Format("15:04:05"), nil
+		}
+	}
+	return "", newValidationError(field, "%s must be a time in HH:MM:SS format, got %q", field, value)
+}
+
+// decodeCourseDocument ตรวจเอกสารใหม่เทียบกับต้นฉบับ field ที่อ่านอย่างเดียวต้องไม่เปลี่ยน
+// field ที่ไม่รู้จักถือว่าผิด แล้วตรวจทุก field ก่อนคืน CourseDocument
+func decodeCourseDocument(target interface{}, original map[string]interface{}) (*CourseDocument, error) {
+	fields, ok := target.(map[string]interface{})
+	if !ok {
+		return nil, newValidationError("", "course must be a JSON object")
+	}
+	for field, message := range courseReadOnlyFields {
+		value, ok := fields[field]
+		if !ok {
+			continue
+		}
+		if !reflect.DeepEqual(value, original[field]) {
+			return nil, newValidationError(field, "%s", message)
+		}
+		delete(fields, field)
+	}
+
+	raw, err := json.Marshal(fields)
+	if err != nil {
+		return nil, err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.DisallowUnknownFields()
+	var doc CourseDocument
+	if err := decoder.Decode(&doc); err != nil {
+		return nil, &ValidationError{Fields: fieldErrorsOf(err)}
+	}
+	if invalid := validateStruct(doc); invalid != nil {
+		return nil, invalid
+	}
+	// ผ่านการตรวจแล้ว แปลงเวลาให้อยู่ในรูปแบบเดียวกัน
+	doc.StartTime, _ = normalizeCourseTime("start_time", doc.StartTime)
+	doc.EndTime, _ = normalizeCourseTime("end_time", doc.EndTime)
+	return &doc, nil
+}
+
+// replaceCourse เขียนทุก field ที่แก้ไขได้ตาม doc (ไม่ใช้ COALESCE จึงล้างค่าได้) และเพิ่ม version
+// ถ้าจำนวนที่นั่งเปลี่ยนจะตรวจกับนักเรียนที่ลงทะเบียนแล้วผ่าน applyCapacityChange
+func replaceCourse(ctx context.Context, tx pgx.Tx, current *Course, doc *CourseDocument, force bool) (*courseUpdateResult, error) {
+	result := &courseUpdateResult{}
+	err := tx.QueryRow(ctx,
+		`UPDATE course SET
+			"subject"      = $1,
+			"credit"       = $2,
+			"section"      = $3,
+			"day_of_week"  = $4,
+			"start_time"   = $5::TIME,
+			"end_time"     = $6::TIME,
+			"prerequisite" = $7,
+			"version"      = "version" + 1
+		WHERE course_id = $8
+		RETURNING "version"`,
+		doc.Subject,
+		doc.Credit,
+		doc.Section,
+		doc.DayOfWeek,
+		doc.StartTime,
+		doc.EndTime,
+		doc.Prerequisite,
+		current.CourseID,
+	).Scan(&result.Version)
+	if err != nil {
+		return nil, err
+	}
+
+	if doc.Capacity != current.Capacity {
+		report, err := applyCapacityChange(ctx, tx, current.CourseID, doc.Capacity, force)
+		if err != nil {
+			return nil, err
+		}
+		result.Capacity = report
+		result.StateChanged = report.StateChanged
+	}
+	return result, nil
+}
+
+// replaceCourseBody PUT: body คือเอกสารใหม่ทั้งก้อน
+func replaceCourseBody(c *gin.Context) (courseDocumentBuilder, bool) {
+	raw, err := c.GetRawData()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON body: " + err.Error()})
+		return nil, false
+	}
+	var body interface{}
+	if err := json.Unmarshal(raw, &body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON body: " + err.Error()})
+		return nil, false
+	}
+	return func(map[string]interface{}) (interface{}, error) {
+		return body, nil
+	}, true
+}
+
+// patchCourseBody PATCH: เลือกชนิดของ patch จาก Content-Type
+func patchCourseBody(c *gin.Context) (courseDocumentBuilder, bool) {
+	raw, err := c.GetRawData()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid patch body: " + err.Error()})
+		return nil, false
+	}
+
+	switch c.ContentType() {
+	case contentTypeMergePatch:
+		var patch interface{}
+		if err := json.Unmarshal(raw, &patch); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid merge patch: " + err.Error()})
+			return nil, false
+		}
+		return func(current map[string]interface{}) (interface{}, error) {
+			return applyMergePatch(current, patch), nil
+		}, true
+	case contentTypeJSONPatch:
+		ops, err := decodeJSONPatch(raw)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON Patch: " + err.Error()})
+			return nil, false
+		}
+		return func(current map[string]interface{}) (interface{}, error) {
+			return applyJSONPatch(current, ops)
+		}, true
+	default:
+		c.Header("Accept-Patch", contentTypeMergePatch+", "+contentTypeJSONPatch)
+		c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": "Content-Type must be " + contentTypeMergePatch + " or " + contentTypeJSONPatch})
+		return nil, false
+	}
+}
+
+// courseUpdateHandler ใช้ร่วมกันระหว่าง PUT และ PATCH ต่างกันที่วิธีสร้างเอกสารใหม่
+// เอกสารที่ไม่ถูกต้องตอบ invalidStatus (PUT 400, PATCH 422 ตาม RFC 5789)
+func courseUpdateHandler(dbConns *DBConnections, events *EventPublisher, writeCircuitBreaker *gobreaker.CircuitBreaker, invalidStatus int, parse func(c *gin.Context) (courseDocumentBuilder, bool)) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		courseID, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid course ID"})
+			return
+		}
+		// ต้องส่ง ETag ที่ได้จาก GET มาใน If-Match เพื่อไม่ให้เขียนทับการแก้ไขของคนอื่น
+		expectedVersion, ok := requireIfMatch(c)
+		if !ok {
+			return
+		}
+		// force=true ยอมให้ลดที่นั่งต่ำกว่าจำนวนที่ลงทะเบียนแล้ว โดยย้ายนักเรียนที่ลงหลังสุดออก
+		force := c.Query("force") == "true"
+
+		build, ok := parse(c)
+		if !ok {
+			return
+		}
+
+		var result *courseUpdateResult
+		_, err = writeCircuitBreaker.Execute(func() (interface{}, error) {
+			ctx := context.Background()
+			tx, err := dbConns.Pool.Begin(ctx)
+			if err != nil {
+				return nil, err
+			}
+			defer tx.Rollback(ctx)
+
+			if err := checkCourseVersion(ctx, tx, courseID, expectedVersion); err != nil {
+				return nil, err
+			}
+			current, err := loadCourse(ctx, tx, courseID)
+			if err != nil {
+				return nil, err
+			}
+			original, err := courseDocumentOf(current)
+			if err != nil {
+				return nil, err
+			}
+			working, err := courseDocumentOf(current)
+			if err != nil {
+				return nil, err
+			}
+
+			target, err := build(working)
+			if err != nil {
+				return nil, err
+			}
+			doc, err := decodeCourseDocument(target, original)
+			if err != nil {
+				return nil, err
+			}
+			if result, err = replaceCourse(ctx, tx, current, doc, force); err != nil {
+				return nil, err
+			}
+
+			// แจ้ง event ให้ service อื่นรู้ว่ารายวิชาเปลี่ยน (บันทึกพร้อมการแก้ไข ส่งออกไปหลัง commit)
+			eventTypes := []string{EventCourseUpdated}
+			if result.Capacity != nil {
+				eventTypes = append(eventTypes, EventCourseSeatChanged)
+			}
+			if result.StateChanged {
+				eventTypes = append(eventTypes, EventCourseStateChanged)
+			}
+			if err := enqueueCourseEvents(ctx, tx, courseID, eventTypes...); err != nil {
+				return nil, err
+			}
+			// นักเรียนที่ถูกย้ายออกต้องถูกถอนการลงทะเบียนฝั่ง enrollment-service ด้วย
+			// บันทึกพร้อมการลดที่นั่ง เพื่อไม่ให้ที่นั่งลดไปแล้วแต่ไม่มีใครได้รับแจ้ง
+			if report := result.Capacity; report != nil && len(report.RemovedStudents) > 0 {
+				reason := fmt.Sprintf("capacity reduced from %d to %d", report.PreviousCapacity, report.Capacity)
+				if err := enqueueCourseEventWithReason(ctx, tx, EventCourseStudentsRemoved, courseID, reason, studentIDsOf(report.RemovedStudents)); err != nil {
+					return nil, err
+				}
+			}
+			return nil, tx.Commit(ctx)
+		})
+
+		var conflict *CapacityConflictError
+		var patchErr *PatchError
+		var invalid *ValidationError
+		if err == gobreaker.ErrOpenState {
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Service temporarily unavailable (circuit breaker is open)"})
+			return
+		}
+		if err == errVersionMismatch {
+			respondVersionMismatch(c, dbConns.Pool, courseID)
+			return
+		}
+		if errors.As(err, &patchErr) {
+			status := http.StatusUnprocessableEntity
+			if patchErr.Failed {
+				status = http.StatusConflict
+			}
+			c.JSON(status, gin.H{"error": patchErr.Error()})
+			return
+		}
+		if errors.As(err, &invalid) {
+			respondValidation(c, invalidStatus, invalid)
+			return
+		}
+		if errors.As(err, &conflict) {
+			c.JSON(http.StatusConflict, gin.H{
+				"error":    conflict.Error() + ", use ?force=true to move out the latest enrolled students",
+				"enrolled": conflict.Enrolled,
+				"capacity": conflict.Capacity,
+			})
+			return
+		}
+		if errors.Is(err, errCourseNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Course not found"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update course: " + err.Error()})
+			return
+		}
+
+		events.Notify()
+		c.Header("ETag", etagFor(result.Version))
+		report := result.Capacity
+		if report == nil {
+			c.JSON(http.StatusOK, gin.H{"message": "Course updated successfully"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"message": "Course updated successfully", "capacity": report})
+	}
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/go-playground/validator/v10"
+)
+
+// daysOfWeek วันที่ใช้ใน day_of_week ได้
+var daysOfWeek = []string{"Monday", "Tuesday", "Wednesday", "Thursday", "Friday", "Saturday", "Sunday"}
+
+// FieldError ข้อผิดพลาดของ field หนึ่ง (ชื่อตาม JSON) message อ่านได้ด้วยตัวเองโดยไม่ต้องดู field
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// ValidationError รวมทุก field ที่ไม่ผ่านการตรวจ
+type ValidationError struct {
+	Fields []FieldError
+}
+
+func (e *ValidationError) Error() string {
+	return strings.Join(e.Messages(), "; ")
+}
+
+// Messages ข้อความของทุก field (ใช้ในรายงานนำเข้ารายแถว)
+func (e *ValidationError) Messages() []string {
+	messages := make([]string, 0, len(e.Fields))
+	for _, field := range e.Fields {
+		messages = append(messages, field.Message)
+	}
+	return messages
+}
+
+func newValidationError(field, format string, args ...interface{}) *ValidationError {
+	return &ValidationError{Fields: []FieldError{{Field: field, Message: fmt.Sprintf(format, args...)}}}
+}
+
+// crossFieldValidator กฎที่ต้องดูหลาย field พร้อมกัน เช่นเวลาเริ่ม-จบ
+type crossFieldValidator interface {
+	Validate() []FieldError
+}
+
+func init() {
+	engine, ok := binding.Validator.Engine().(*validator.Validate)
+	if !ok {
+		return
+	}
+	// รายงานชื่อ field ตาม JSON แทนชื่อใน struct
+	engine.RegisterTagNameFunc(func(field reflect.StructField) string {
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if name == "-" {
+			return ""
+		}
+		return name
+	})
+	engine.RegisterValidation("dayofweek", func(fl validator.FieldLevel) bool {
+		return isDayOfWeek(fl.Field().String())
+	})
+	engine.RegisterValidation("timeofday", func(fl validator.FieldLevel) bool {
+		_, err := normalizeCourseTime("", fl.Field().String())
+		return err == nil
+	})
+	engine.RegisterValidation("coursestate", func(fl validator.FieldLevel) bool {
+		return isCourseState(fl.Field().String())
+	})
+}
+
+func isDayOfWeek(day string) bool {
+	for _, d := range daysOfWeek {
+		if d == day {
+			return true
+		}
+	}
+	return false
+}
+
+// validateStruct ตรวจตาม binding tag แล้วตามด้วยกฎหลาย field คืน nil ถ้าผ่านทั้งหมด
+func validateStruct(value interface{}) *ValidationError {
+	result := &ValidationError{}
+	if err := binding.Validator.ValidateStruct(value); err != nil {
+		result.Fields = append(result.Fields, fieldErrorsOf(err)...)
+	}
+	if v, ok := value.(crossFieldValidator); ok {
+		result.Fields = append(result.Fields, v.Validate()...)
+	}
+	if len(result.Fields) == 0 {
+		return nil
+	}
+	return result
+}
+
+// fieldErrorsOf แปลง error จาก validator หรือ encoding/json เป็นรายการ field
+func fieldErrorsOf(err error) []FieldError {
+	var fieldErrors validator.ValidationErrors
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &fieldErrors):
+		result := make([]FieldError, 0, len(fieldErrors))
+		for _, fe := range fieldErrors {
+			result = append(result, FieldError{Field: fieldPath(fe), Message: fieldMessage(fe)})
+		}
+		return result
+	case errors.As(err, &typeErr):
+		return []FieldError{{Field: typeErr.Field, Message: fmt.Sprintf("%s must be a %s", typeErr.Field, jsonTypeName(typeErr.Type))}}
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		field, _ := strconv.Unquote(strings.TrimPrefix(err.Error(), "json: unknown field "))
+		return []FieldError{{Field: field, Message: fmt.Sprintf("%s is not a known field", field)}}
+	default:
+		return []FieldError{{Field: "", Message: err.Error()}}
+	}
+}
+
+// fieldPath ชื่อ field ตาม JSON ไม่รวมชื่อ struct ด้านนอก เช่น section[0]
+func fieldPath(fe validator.FieldError) string {
+	namespace := fe.Namespace()
+	if i := strings.Index(namespace, "."); i >= 0 {
+		namespace = namespace[i+1:]
+	}
+	// field ที่ฝังมาจาก struct อื่น (เช่น CourseDocument) ไม่มีชื่อ JSON ของตัวเอง
+	parts := strings.Split(namespace, ".")
+	kept := parts[:0]
+	for _, part := range parts {
+		if (part != "" && part[0] >= 'a' && part[0] <= 'z') || strings.Contains(part, "[") {
+			kept = append(kept, part)
+		}
+	}
+	if len(kept) == 0 {
+		return fe.Field()
+	}
+	return strings.Join(kept, ".")
+}
+
+// fieldMessage ข้อความของกฎที่ไม่ผ่าน
+func fieldMessage(fe validator.FieldError) string {
+	field := fieldPath(fe)
+	switch fe.Tag() {
+	case "required":
+		return field + " is required"
+	case "gt":
+		return fmt.Sprintf("%s must be greater than %s", field, fe.Param())
+	case "gte", "min", "lte", "max":
+		bound := "at least"
+		if fe.Tag() == "lte" || fe.Tag() == "max" {
+			bound = "at most"
+		}
+		switch fe.Kind() {
+		case reflect.String:
+			return fmt.Sprintf("%s must be %s %s characters", field, bound, fe.Param())
+		case reflect.Slice:
+			return fmt.Sprintf("%s must have %s %s items", field, bound, fe.Param())
+		default:
+			return fmt.Sprintf("%s must be %s %s", field, bound, fe.Param())
+		}
+	case "oneof":
+		return fmt.Sprintf("%s must be one of %s", field, strings.Join(strings.Fields(fe.Param()), ", "))
+	case "dayofweek":
+		return fmt.Sprintf("%s must be one of %s", field, strings.Join(daysOfWeek, ", "))
+	case "timeofday":
+		return fmt.Sprintf("%s must be a time in HH:MM:SS format, got %q", field, fe.Value())
+	case "coursestate":
+		return fmt.Sprintf("%s %q is not a course state", field, fe.Value())
+	case "unique":
+		return field + " must not contain duplicates"
+	default:
+		return fmt.Sprintf("%s failed %s validation", field, fe.Tag())
+	}
+}
+
+func jsonTypeName(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "whole number"
+	case reflect.Float32, reflect.Float64:
+		return "number"
+	case reflect.Slice, reflect.Array:
+		return "array"
+	case reflect.Map, reflect.Struct:
+		return "object"
+	default:
+		return t.Kind().String()
+	}
+}
+
+// respondValidation ตอบ 400 (หรือ status ที่ระบุ) พร้อมรายการ field ที่ผิดทั้งหมด
+func respondValidation(c *gin.Context, status int, err *ValidationError) {
+	c.JSON(status, gin.H{"error": "Invalid input: " + err.Error(), "fields": err.Fields})
+}
+
+// bindAndValidate อ่าน JSON body แล้วตรวจทุก field ถ้าไม่ผ่านจะตอบ 400 แล้วคืน false
+func bindAndValidate(c *gin.Context, body interface{}) bool {
+	err := c.ShouldBindJSON(body)
+	var fieldErrors validator.ValidationErrors
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case err == nil || errors.As(err, &fieldErrors):
+		// ตรวจอีกครั้งผ่าน validateStruct เพื่อรวมกฎหลาย field ไว้ในคำตอบเดียวกัน
+		if invalid := validateStruct(body); invalid != nil {
+			respondValidation(c, http.StatusBadRequest, invalid)
+			return false
+		}
+		return true
+	case errors.As(err, &typeErr):
+		respondValidation(c, http.StatusBadRequest, &ValidationError{Fields: fieldErrorsOf(err)})
+		return false
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON body: " + err.Error()})
+		return false
+	}
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sony/gobreaker"
+
+	"shared/rabbitmq"
+)
+
+const (
+	defaultBatchConcurrency = 5
+	maxBatchConcurrency     = 20
+	maxBatchItems           = 500
+	defaultBatchJobTTL      = 30 * time.Minute
+)
+
+// BatchEnrollmentRequest คำขอลงทะเบียนแบบกลุ่ม (เช่น นักศึกษาปี 1 ที่ลงวิชาชุดเดียวกัน)
+type BatchEnrollmentRequest struct {
+	Items       []EnrollmentRequest `json:"items" binding:"required,min=1,dive"`
+	Concurrency int                 `json:"concurrency"`
+	Async       bool                `json:"async"`
+}
+
+// BatchReport สรุปผลการลงทะเบียนแบบกลุ่มรายนักเรียน
+type BatchReport struct {
+	Total     int                `json:"total"`
+	Succeeded int                `json:"succeeded"`
+	Failed    int                `json:"failed"`
+	Results   []EnrollmentResult `json:"results"`
+}
+
+// BatchJob งานลงทะเบียนแบบกลุ่มที่ทำงานเบื้องหลัง
+type BatchJob struct {
+	JobID      string             `json:"job_id"`
+	Status     string             `json:"status"` // running, completed
+	Total      int                `json:"total"`
+	Processed  int                `json:"processed"`
+	Succeeded  int                `json:"succeeded"`
+	Failed     int                `json:"failed"`
+	CreatedAt  time.Time          `json:"created_at"`
+	FinishedAt *time.Time         `json:"finished_at,omitempty"`
+	Results    []EnrollmentResult `json:"results"`
+}
+
+// batchJobStore เก็บสถานะของ batch job ไว้ในหน่วยความจำ
+// job ที่เสร็จแล้วจะถูกลบทิ้งเมื่อครบ ttl นับจากเวลาที่เสร็จ (job ที่ยังทำงานอยู่ไม่ถูกลบ)
+type batchJobStore struct {
+	mu   sync.Mutex
+	jobs map[string]*BatchJob
+	ttl  time.Duration
+}
+
+func newBatchJobStore() *batchJobStore {
+	return &batchJobStore{jobs: make(map[string]*BatchJob), ttl: batchJobTTL()}
+}
+
+// batchJobTTL ระยะเวลาที่เก็บผลของ job ที่เสร็จแล้ว ตั้งได้ผ่าน BATCH_JOB_TTL (เช่น 10m, 2h)
+func batchJobTTL() time.Duration {
+	if v, err := time.ParseDuration(os.Getenv("BATCH_JOB_TTL")); err == nil && v > 0 {
+		return v
+	}
+	return defaultBatchJobTTL
+}
+
+// expireLocked ลบ job ที่เสร็จมานานเกิน ttl ผู้เรียกต้องถือ s.mu อยู่แล้ว
+func (s *batchJobStore) expireLocked(now time.Time) {
+	for id, job := range s.jobs {
+		if job.FinishedAt != nil && now.Sub(*job.FinishedAt) > s.ttl {
+			delete(s.jobs, id)
+		}
+	}
+}
+
+func (s *batchJobStore) create(total int) *BatchJob {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.expireLocked(time.Now())
+
+	job := &BatchJob{
+		JobID:     fmt.Sprintf("batch-%d", time.Now().UnixNano()),
+		Status:    "running",
+		Total:     total,
+		CreatedAt: time.Now(),
+		Results:   make([]EnrollmentResult, total),
+	}
+	s.jobs[job.JobID] = job
+	return job
+}
+
+// record บันทึกผลของนักเรียนลำดับที่ i และอัพเดทความคืบหน้า
+func (s *batchJobStore) record(job *BatchJob, i int, result EnrollmentResult) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	job.Results[i] = result
+	job.Processed++
+	if result.Success {
+		job.Succeeded++
+	} else {
+		job.Failed++
+	}
+}
+
+func (s *batchJobStore) finish(job *BatchJob) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	job.Status = "completed"
+	job.FinishedAt = &now
+}
+
+// get คืนสำเนาของ job เพื่อไม่ให้ชนกับ worker ที่กำลังเขียนอยู่
+func (s *batchJobStore) get(jobID string) (BatchJob, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.expireLocked(time.Now())
+	job, ok := s.jobs[jobID]
+	if !ok {
+		return BatchJob{}, false
+	}
+	snapshot := *job
+	snapshot.Results = make([]EnrollmentResult, 0, job.Processed)
+	for _, r := range job.Results {
+		if r.Status != 0 {
+			snapshot.Results = append(snapshot.Results, r)
+		}
+	}
+	return snapshot, true
+}
+
+// batchConcurrency คำนวณจำนวน worker ที่ใช้ประมวลผลพร้อมกัน
+func batchConcurrency(requested int) int {
+	concurrency := defaultBatchConcurrency
+	if v, err := strconv.Atoi(os.Getenv("BATCH_ENROLL_CONCURRENCY")); err == nil && v > 0 {
+		concurrency = v
+	}
+	if requested > 0 {
+		concurrency = requested
+	}
+	if concurrency > maxBatchConcurrency {
+		concurrency = maxBatchConcurrency
+	}
+	return concurrency
+}
+
+// runBatchEnrollment ลงทะเบียนทุกรายการโดยจำกัดจำนวนที่ทำพร้อมกัน
+// onResult ถูกเรียกทุกครั้งที่นักเรียนแต่ละคนประมวลผลเสร็จ
+func runBatchEnrollment(items []EnrollmentRequest, concurrency int, enroll func(EnrollmentRequest) EnrollmentResult, onResult func(int, EnrollmentResult)) {
+	// นักเรียนคนเดียวกันห้ามลงพร้อมกันหลายรายการ เพราะจะชนกันที่ enrollment table
+	seen := make(map[int]bool)
+
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+
+	for i, item := range items {
+		if seen[item.StudentID] {
+			onResult(i, EnrollmentResult{
+				StudentID: item.StudentID,
+				CourseIDs: item.CourseIDs,
+				Status:    http.StatusBadRequest,
+				Error:     fmt.Sprintf("นักเรียนรหัส %d ถูกระบุซ้ำในคำขอเดียวกัน", item.StudentID),
+			})
+			continue
+		}
+		seen[item.StudentID] = true
+
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, item EnrollmentRequest) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			onResult(i, enroll(item))
+		}(i, item)
+	}
+
+	wg.Wait()
+}
+
+// batchEnrollHandler POST /enroll/batch
+func batchEnrollHandler(dbConns *DBConnections, rabbit *rabbitmq.Connection, readCircuitBreaker *gobreaker.CircuitBreaker, jobs *batchJobStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req BatchEnrollmentRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if len(req.Items) > maxBatchItems {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("ลงทะเบียนแบบกลุ่มได้สูงสุด %d รายการต่อคำขอ", maxBatchItems)})
+			return
+		}
+
+		// registrar ลงทะเบียนแทนนักเรียน ประวัติจึงเป็น admin_edit (หรือ override/swap ตามรายการ)
+		actor := actorFromRequest(c, "batch")
+		for i := range req.Items {
+			req.Items[i].Actor = actor
+			req.Items[i].OnBehalf = onBehalf(c, req.Items[i].StudentID)
+		}
+
+		concurrency := batchConcurrency(req.Concurrency)
+		enroll := func(item EnrollmentRequest) EnrollmentResult {
+			return enrollStudent(dbConns, rabbit, readCircuitBreaker, item)
+		}
+
+		// แบบ background job: ตอบกลับทันทีพร้อม job_id ให้ไปเช็คความคืบหน้าเอง
+		if req.Async {
+			job := jobs.create(len(req.Items))
+			go func() {
+				runBatchEnrollment(req.Items, concurrency, enroll, func(i int, result EnrollmentResult) {
+					jobs.record(job, i, result)
+				})
+				jobs.finish(job)
+				done, _ := jobs.get(job.JobID)
+				log.Printf("Batch job %s completed: %d/%d succeeded", done.JobID, done.Succeeded, done.Total)
+			}()
+
+			c.JSON(http.StatusAccepted, gin.H{
+				"job_id": job.JobID,
+				"status": "running",
+				"total":  len(req.Items),
+			})
+			return
+		}
+
+		report := BatchReport{
+			Total:   len(req.Items),
+			Results: make([]EnrollmentResult, len(req.Items)),
+		}
+		var mu sync.Mutex
+		runBatchEnrollment(req.Items, concurrency, enroll, func(i int, result EnrollmentResult) {
+			mu.Lock()
+			defer mu.Unlock()
+			report.Results[i] = result
+			if result.Success {
+				report.Succeeded++
+			} else {
+				report.Failed++
+			}
+		})
+
+		log.Printf("Batch enrollment completed: %d/%d succeeded", report.Succeeded, report.Total)
+		c.JSON(http.StatusOK, report)
+	}
+}
+
+// batchJobStatusHandler GET /enroll/batch/:job_id
+func batchJobStatusHandler(jobs *batchJobStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		job, ok := jobs.get(c.Param("job_id"))
+		if !ok {
+			c.JSON(http.StatusNotFound, gin.H{"error": "ไม่พบ batch job ที่ระบุ"})
+			return
+		}
+		c.JSON(http.StatusOK, job)
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+
+	"github.com/lib/pq"
+)
+
+// actor ในประวัติเมื่อรายวิชาถูกถอนเพราะการเปลี่ยนแปลงฝั่ง course-service
+const (
+	courseCancelledActor = "system:course-cancelled"
+	capacityReducedActor = "system:capacity-reduced"
+)
+
+// unenrollFromCourse ถอนรายวิชาของ event ออกจากการลงทะเบียนของนักเรียนใน event.StudentIDs (ว่าง = ทุกคน)
+// บันทึกประวัติตาม action และการแจ้งเตือน notification ของแต่ละคนลง outbox ใน transaction เดียวกัน คืนรหัสนักเรียนที่ได้รับผลกระทบ
+// ถ้า event ถูกส่งซ้ำจะไม่พบนักเรียนแล้ว จึงไม่บันทึกหรือแจ้งเตือนซ้ำ
+func unenrollFromCourse(db *sql.DB, event CourseEvent, action, actor, reason, notification string) ([]int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var studentIDs []int
+	if len(event.StudentIDs) > 0 {
+		studentIDs = event.StudentIDs
+	}
+	rows, err := tx.Query(`SELECT student_id FROM enrollment
+		WHERE $1 = ANY(course_id) AND ($2::int[] IS NULL OR student_id = ANY($2))
+		ORDER BY student_id FOR UPDATE`, event.CourseID, pq.Array(studentIDs))
+	if err != nil {
+		return nil, err
+	}
+	students := []int{}
+	for rows.Next() {
+		var studentID int
+		if err := rows.Scan(&studentID); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		students = append(students, studentID)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(students) == 0 {
+		return students, nil
+	}
+
+	if _, err := tx.Exec(`UPDATE enrollment SET course_id = array_remove(course_id, $1) WHERE student_id = ANY($2)`, event.CourseID, pq.Array(students)); err != nil {
+		return nil, err
+	}
+
+	var entries []HistoryEntry
+	for _, studentID := range students {
+		entries = append(entries, historyEntriesFor(studentID, []int{event.CourseID}, action, actor, reason)...)
+	}
+	if err := recordHistory(tx, entries...); err != nil {
+		return nil, err
+	}
+	for _, studentID := range students {
+		if err := enqueueEnrollmentEvent(tx, newEnrollmentEvent(notification, studentID, event.CourseID, event.Reason)); err != nil {
+			return nil, err
+		}
+	}
+
+	return students, tx.Commit()
+}
+
+// handleCourseCancelled ถอนนักเรียนทุกคนออกจากรายวิชาที่ถูกยกเลิก และแจ้งเตือนทีละคนผ่าน outbox
+func handleCourseCancelled(db *sql.DB, events *EventPublisher, event CourseEvent) error {
+	reason := "course cancelled"
+	if event.Reason != "" {
+		reason = "course cancelled: " + event.Reason
+	}
+	event.StudentIDs = nil
+	students, err := unenrollFromCourse(db, event, HistoryActionDrop, courseCancelledActor, reason, EventEnrollmentCourseCancelled)
+	if err != nil {
+		return fmt.Errorf("failed to unenroll students from cancelled course %d: %v", event.CourseID, err)
+	}
+
+	events.Notify()
+	log.Printf("Course %d cancelled: unenrolled %d students", event.CourseID, len(students))
+	return nil
+}
+
+// handleStudentsRemoved ถอนนักเรียนที่ถูกย้ายออกเพราะลดที่นั่ง (force) และแจ้งเตือนทีละคนผ่าน outbox
+// นักเรียนไม่ได้ถอนเอง ประวัติจึงเป็น admin_edit
+func handleStudentsRemoved(db *sql.DB, events *EventPublisher, event CourseEvent) error {
+	if len(event.StudentIDs) == 0 {
+		return nil
+	}
+	students, err := unenrollFromCourse(db, event, HistoryActionAdminEdit, capacityReducedActor, event.Reason, EventEnrollmentRemovedOverCapacity)
+	if err != nil {
+		return fmt.Errorf("failed to unenroll students removed from course %d: %v", event.CourseID, err)
+	}
+
+	events.Notify()
+	log.Printf("Course %d capacity reduced: unenrolled %d students", event.CourseID, len(students))
+	return nil
+}
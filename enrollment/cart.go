@@ -0,0 +1,374 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+	"github.com/sony/gobreaker"
+
+	"shared/rabbitmq"
+)
+
+// สถานะ seat hold ของวิชาในตะกร้าหลังต่ออายุ (ทุกครั้งที่ดูตะกร้าและตอน checkout)
+const (
+	CartHoldHeld       = "held"       // ต่ออายุ hold เดิมได้
+	CartHoldReacquired = "reacquired" // hold เดิมหมดอายุหรือไม่มี แต่ถือที่นั่งใหม่ได้
+	CartHoldExpired    = "expired"    // hold หมดอายุและถือใหม่ไม่ได้ (เหตุผลอยู่ใน hold_error)
+)
+
+// CartItem รายวิชาในตะกร้าลงทะเบียน พร้อมผลตรวจ canEnroll ของวิชานั้นเพียงวิชาเดียว
+// HoldID/HoldExpiresAt คือ seat hold ใน course-service ที่ถือที่นั่งไว้ให้ระหว่างยังไม่ checkout
+// ReplacesCourseID คือวิชาที่ลงไว้แล้วซึ่งวิชานี้จะมาแทนตอน checkout (swap)
+type CartItem struct {
+	CourseID         int        `json:"course_id"`
+	ReplacesCourseID *int       `json:"replaces_course_id,omitempty"`
+	AddedAt          time.Time  `json:"added_at"`
+	HoldID           *int       `json:"hold_id,omitempty"`
+	HoldExpiresAt    *time.Time `json:"hold_expires_at,omitempty"`
+	HoldStatus       string     `json:"hold_status,omitempty"`
+	HoldError        string     `json:"hold_error,omitempty"`
+	HoldCode         string     `json:"hold_code,omitempty"` // รหัสจาก course-service เมื่อถือที่นั่งใหม่ไม่ได้ เช่น COURSE_FULL
+	CanEnroll        bool       `json:"can_enroll"`
+	Error            string     `json:"error,omitempty"`
+}
+
+// Cart ตะกร้าลงทะเบียนของนักเรียน 1 คน
+// can_enroll/error ระดับตะกร้าคือผลตรวจทุกวิชาพร้อมกัน (เช่นเวลาชนกันเองหรือหน่วยกิตรวมเกิน)
+type Cart struct {
+	StudentID int        `json:"student_id"`
+	Items     []CartItem `json:"items"`
+	CanEnroll bool       `json:"can_enroll"`
+	Error     string     `json:"error,omitempty"`
+}
+
+type addCartItemRequest struct {
+	CourseID         int `json:"course_id" binding:"required"`
+	ReplacesCourseID int `json:"replaces_course_id,omitempty"`
+}
+
+// loadCartItems ดึงรายวิชาในตะกร้าเรียงตามลำดับที่เพิ่ม
+func loadCartItems(db *sql.DB, studentID int) ([]CartItem, error) {
+	rows, err := db.Query(`SELECT course_id, replaces_course_id, added_at, hold_id, hold_expires_at FROM enrollment_cart
+		WHERE student_id = $1 ORDER BY added_at, course_id`, studentID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	items := []CartItem{}
+	for rows.Next() {
+		var item CartItem
+		var replaces, holdID sql.NullInt64
+		var holdExpiresAt sql.NullTime
+		if err := rows.Scan(&item.CourseID, &replaces, &item.AddedAt, &holdID, &holdExpiresAt); err != nil {
+			return nil, err
+		}
+		if replaces.Valid {
+			id := int(replaces.Int64)
+			item.ReplacesCourseID = &id
+		}
+		if holdID.Valid {
+			id := int(holdID.Int64)
+			item.HoldID = &id
+		}
+		if holdExpiresAt.Valid {
+			item.HoldExpiresAt = &holdExpiresAt.Time
+		}
+		items = append(items, item)
+	}
+	return items, rows.Err()
+}
+
+// renewCartHolds ต่ออายุ seat hold ของทุกวิชาในตะกร้าด้วย token ของผู้เรียก (course-service ต่ออายุ hold เดิมที่ยังไม่หมดอายุ
+// หรือสร้างใหม่ถ้าหมดแล้ว) แล้วบันทึก hold ล่าสุดลงตะกร้า ผลของแต่ละวิชาอยู่ใน HoldStatus/HoldError
+// คืนจำนวนวิชาที่ hold หมดอายุและถือใหม่ไม่ได้ ถ้า course-service ไม่ตอบ hold ที่ยังไม่หมดอายุถือว่ายังใช้ได้
+func renewCartHolds(db *sql.DB, baseURL, authorization string, studentID int, items []CartItem) int {
+	expired := 0
+	for i := range items {
+		item := &items[i]
+		hold, rejection, err := holdCourseSeat(baseURL, authorization, studentID, item.CourseID)
+		switch {
+		case err != nil:
+			item.HoldError = err.Error()
+			if item.HoldExpiresAt != nil && item.HoldExpiresAt.After(time.Now()) {
+				item.HoldStatus = CartHoldHeld
+				continue
+			}
+			item.HoldStatus = CartHoldExpired
+			expired++
+			continue
+		case rejection != nil:
+			item.HoldStatus = CartHoldExpired
+			item.HoldError = rejection.Error
+			item.HoldCode = rejection.Code
+			expired++
+			continue
+		}
+
+		item.HoldStatus = CartHoldHeld
+		if item.HoldID == nil || *item.HoldID != hold.HoldID {
+			item.HoldStatus = CartHoldReacquired
+		}
+		item.HoldID, item.HoldExpiresAt = &hold.HoldID, &hold.ExpiresAt
+		if _, err := db.Exec(`UPDATE enrollment_cart SET hold_id = $3, hold_expires_at = $4 WHERE student_id = $1 AND course_id = $2`,
+			studentID, item.CourseID, hold.HoldID, hold.ExpiresAt); err != nil {
+			// hold ใหม่ยังใช้ได้ใน course-service แม้บันทึกไม่สำเร็จ ครั้งหน้าจะได้ hold เดิมกลับมาอีก
+			log.Printf("Failed to save seat hold %d of student %d: %v", hold.HoldID, studentID, err)
+		}
+	}
+	return expired
+}
+
+// cartEnrollmentRequest คำขอลงทะเบียนของรายวิชาในตะกร้า วิชาที่มี replaces_course_id เป็น swap
+func cartEnrollmentRequest(studentID int, items []CartItem) EnrollmentRequest {
+	req := EnrollmentRequest{StudentID: studentID}
+	for _, item := range items {
+		if item.ReplacesCourseID != nil {
+			req.Swaps = append(req.Swaps, CourseSwap{FromCourseID: *item.ReplacesCourseID, ToCourseID: item.CourseID})
+			continue
+		}
+		req.CourseIDs = append(req.CourseIDs, item.CourseID)
+	}
+	return req
+}
+
+// validateCart ตรวจตะกร้าด้วย checkEnrollment จาก read model ทั้งรายวิชาเดี่ยวและทั้งตะกร้า
+func validateCart(db *sql.DB, studentID int) (*Cart, error) {
+	items, err := loadCartItems(db, studentID)
+	if err != nil {
+		return nil, err
+	}
+
+	cart := &Cart{StudentID: studentID, Items: items}
+	for i := range cart.Items {
+		if _, err := checkEnrollment(db, cartEnrollmentRequest(studentID, cart.Items[i:i+1])); err != nil {
+			cart.Items[i].Error = err.Error()
+			continue
+		}
+		cart.Items[i].CanEnroll = true
+	}
+
+	if _, err := checkEnrollment(db, cartEnrollmentRequest(studentID, items)); err != nil {
+		cart.Error = err.Error()
+	} else {
+		cart.CanEnroll = true
+	}
+	return cart, nil
+}
+
+func registerCartRoutes(r *gin.Engine, dbConns *DBConnections, rabbit *rabbitmq.Connection, readCircuitBreaker *gobreaker.CircuitBreaker, requireOwner gin.HandlerFunc) {
+	parseStudentID := func(c *gin.Context) (int, bool) {
+		id, err := strconv.Atoi(c.Param("student_id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "รหัสนักเรียนไม่ถูกต้อง"})
+			return 0, false
+		}
+		return id, true
+	}
+
+	// ดูตะกร้าพร้อมผลตรวจล่าสุด และต่ออายุ seat hold ของทุกวิชา
+	r.GET("/cart/:student_id", requireOwner, func(c *gin.Context) {
+		studentID, ok := parseStudentID(c)
+		if !ok {
+			return
+		}
+
+		result, err := readCircuitBreaker.Execute(func() (interface{}, error) {
+			return validateCart(dbConns.ReadConn, studentID)
+		})
+		if err == gobreaker.ErrOpenState {
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "ระบบขัดข้องชั่วคราว (Circuit Breaker Open)"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load cart: " + err.Error()})
+			return
+		}
+
+		cart := result.(*Cart)
+		renewCartHolds(dbConns.WriteConn, courseServiceURL(), c.GetHeader("Authorization"), studentID, cart.Items)
+		c.JSON(http.StatusOK, cart)
+	})
+
+	// เพิ่มรายวิชาลงตะกร้า รับเฉพาะวิชาที่มีอยู่จริงและถือที่นั่งใน course-service ได้
+	// ส่วนเงื่อนไขอื่น (เวลาชน หน่วยกิต) แสดงตอนดูตะกร้า
+	r.POST("/cart/:student_id/items", requireOwner, func(c *gin.Context) {
+		studentID, ok := parseStudentID(c)
+		if !ok {
+			return
+		}
+
+		var req addCartItemRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		var exists bool
+		err := dbConns.ReadConn.QueryRow("SELECT EXISTS(SELECT 1 FROM course_projection WHERE course_id = $1 AND NOT deleted)", req.CourseID).Scan(&exists)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check course: " + err.Error()})
+			return
+		}
+		if !exists {
+			c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("ไม่พบรายวิชารหัส %d", req.CourseID)})
+			return
+		}
+		inCart := false
+		err = dbConns.ReadConn.QueryRow("SELECT EXISTS(SELECT 1 FROM enrollment_cart WHERE student_id = $1 AND course_id = $2)", studentID, req.CourseID).Scan(&inCart)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check cart: " + err.Error()})
+			return
+		}
+		if inCart {
+			c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("วิชารหัส %d อยู่ในตะกร้าแล้ว", req.CourseID)})
+			return
+		}
+		if req.ReplacesCourseID != 0 {
+			// swap: วิชาที่จะถูกแทนต้องลงไว้แล้ว และแทนได้ด้วยวิชาเดียวในตะกร้า
+			var enrolled, replaced bool
+			err = dbConns.ReadConn.QueryRow(`SELECT
+				EXISTS(SELECT 1 FROM enrollment WHERE student_id = $1 AND $2 = ANY(course_id)),
+				EXISTS(SELECT 1 FROM enrollment_cart WHERE student_id = $1 AND replaces_course_id = $2)`,
+				studentID, req.ReplacesCourseID).Scan(&enrolled, &replaced)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check enrollment: " + err.Error()})
+				return
+			}
+			if !enrolled {
+				c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("นักเรียนไม่ได้ลงทะเบียนวิชารหัส %d ที่ต้องการเปลี่ยน", req.ReplacesCourseID), "code": ErrCodeNotEnrolled, "course_id": req.ReplacesCourseID})
+				return
+			}
+			if replaced {
+				c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("วิชารหัส %d ถูกเลือกเปลี่ยนด้วยวิชาอื่นในตะกร้าแล้ว", req.ReplacesCourseID)})
+				return
+			}
+		}
+
+		// ถือที่นั่งก่อน เพื่อไม่ให้เสียที่นั่งระหว่างที่ยังไม่ checkout
+		authorization := c.GetHeader("Authorization")
+		hold, rejection, err := holdCourseSeat(courseServiceURL(), authorization, studentID, req.CourseID)
+		if err != nil {
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "ไม่สามารถถือที่นั่งได้ในขณะนี้: " + err.Error()})
+			return
+		}
+		if rejection != nil {
+			c.JSON(rejection.Status, enrollmentErrorBody(*rejection))
+			return
+		}
+
+		res, err := dbConns.WriteConn.Exec(`INSERT INTO enrollment_cart (student_id, course_id, replaces_course_id, hold_id, hold_expires_at) VALUES ($1, $2, NULLIF($3, 0), $4, $5)
+			ON CONFLICT (student_id, course_id) DO NOTHING`, studentID, req.CourseID, req.ReplacesCourseID, hold.HoldID, hold.ExpiresAt)
+		if err != nil {
+			if releaseErr := releaseCourseSeat(courseServiceURL(), authorization, hold.HoldID); releaseErr != nil {
+				log.Printf("Failed to release seat hold %d of student %d: %v", hold.HoldID, studentID, releaseErr)
+			}
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to add cart item: " + err.Error()})
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			// ถูกเพิ่มพร้อมกันจากอีก request ซึ่งได้ hold เดียวกัน (course-service ต่ออายุ hold เดิม) จึงไม่ต้องคืน
+			c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("วิชารหัส %d อยู่ในตะกร้าแล้ว", req.CourseID)})
+			return
+		}
+
+		created := gin.H{"student_id": studentID, "course_id": req.CourseID, "hold": hold}
+		if req.ReplacesCourseID != 0 {
+			created["replaces_course_id"] = req.ReplacesCourseID
+		}
+		c.JSON(http.StatusCreated, created)
+	})
+
+	// ลบรายวิชาออกจากตะกร้าและคืนที่นั่งที่ถือไว้
+	r.DELETE("/cart/:student_id/items/:course_id", requireOwner, func(c *gin.Context) {
+		studentID, ok := parseStudentID(c)
+		if !ok {
+			return
+		}
+		courseID, err := strconv.Atoi(c.Param("course_id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "รหัสวิชาไม่ถูกต้อง"})
+			return
+		}
+
+		var holdID sql.NullInt64
+		err = dbConns.WriteConn.QueryRow("DELETE FROM enrollment_cart WHERE student_id = $1 AND course_id = $2 RETURNING hold_id", studentID, courseID).Scan(&holdID)
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("ไม่พบวิชารหัส %d ในตะกร้า", courseID)})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to remove cart item: " + err.Error()})
+			return
+		}
+		if holdID.Valid {
+			// คืนไม่สำเร็จไม่เป็นไร hold จะหมดอายุเองตาม SEAT_HOLD_TTL ของ course-service
+			if err := releaseCourseSeat(courseServiceURL(), c.GetHeader("Authorization"), int(holdID.Int64)); err != nil {
+				log.Printf("Failed to release seat hold %d of student %d: %v", holdID.Int64, studentID, err)
+			}
+		}
+
+		c.Status(http.StatusNoContent)
+	})
+
+	// ยืนยันตะกร้า: ลงทะเบียนทุกวิชาในคำขอเดียวผ่าน enrollStudent (สำเร็จทั้งหมดหรือไม่สำเร็จเลย)
+	// วิชาที่มี replaces_course_id ถูกส่งเป็น swap จึงถอนวิชาเดิมใน transaction เดียวกัน
+	// course-service ใช้และ confirm seat hold ของนักเรียนใน transaction เดียวกับการลงทะเบียน
+	// ก่อนลงทะเบียนจะต่ออายุหรือถือที่นั่งใหม่ให้ทุกวิชา ถ้าวิชาใดถือใหม่ไม่ได้จะไม่ลงทะเบียนและแจ้งรายวิชา
+	// ถ้าไม่สำเร็จ hold ยังอยู่จนหมดอายุ ลองใหม่ได้โดยไม่เสียที่นั่ง
+	// ตะกร้าจะถูกล้างเฉพาะวิชาที่ลงทะเบียนสำเร็จ วิชาที่เพิ่มเข้ามาระหว่าง checkout ยังอยู่
+	r.POST("/cart/:student_id/checkout", requireOwner, func(c *gin.Context) {
+		studentID, ok := parseStudentID(c)
+		if !ok {
+			return
+		}
+
+		items, err := loadCartItems(dbConns.ReadConn, studentID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load cart: " + err.Error()})
+			return
+		}
+		if len(items) == 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "ตะกร้าว่าง ไม่มีรายวิชาที่ต้องลงทะเบียน"})
+			return
+		}
+		if expired := renewCartHolds(dbConns.WriteConn, courseServiceURL(), c.GetHeader("Authorization"), studentID, items); expired > 0 {
+			c.JSON(http.StatusConflict, gin.H{
+				"error": fmt.Sprintf("ที่นั่งที่ถือไว้หมดอายุและถือใหม่ไม่ได้ %d วิชา", expired),
+				"items": items,
+			})
+			return
+		}
+
+		req := cartEnrollmentRequest(studentID, items)
+		req.Reason = "cart checkout"
+		req.Actor = actorFromRequest(c, "")
+		req.OnBehalf = onBehalf(c, studentID)
+		result := enrollStudent(dbConns, rabbit, readCircuitBreaker, req)
+		if !result.Success {
+			c.JSON(result.Status, enrollmentErrorBody(result))
+			return
+		}
+
+		if _, err := dbConns.WriteConn.Exec("DELETE FROM enrollment_cart WHERE student_id = $1 AND course_id = ANY($2)", studentID, pq.Array(result.CourseIDs)); err != nil {
+			// ลงทะเบียนสำเร็จแล้ว วิชาที่ค้างในตะกร้าจะถูกแจ้งว่าลงซ้ำตอนดูตะกร้า
+			log.Printf("Failed to clear cart of student %d after checkout: %v", studentID, err)
+		}
+
+		checkedOut := gin.H{
+			"message":    result.Message,
+			"details":    result.Details,
+			"course_ids": result.CourseIDs,
+		}
+		if len(req.Swaps) > 0 {
+			checkedOut["swaps"] = req.Swaps
+		}
+		c.JSON(http.StatusOK, checkedOut)
+	})
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+
+	"shared/contract"
+)
+
+// สัญญาของ RPC ระหว่าง enrollment-service กับ course-service อยู่ใน shared/contract
+// (schema ชุดเดียวที่ทั้งสอง service ใช้) ไฟล์นี้แปลงระหว่างข้อความกับ struct ของ enrollment-service
+
+// รหัสข้อผิดพลาดใน enrollment.response (v2 ขึ้นไป)
+const (
+	ErrCodeCourseNotFound  = "COURSE_NOT_FOUND"
+	ErrCodeCourseClosed    = "COURSE_CLOSED"
+	ErrCodeCourseFull      = "COURSE_FULL"
+	ErrCodeAlreadyEnrolled = "ALREADY_ENROLLED"
+	ErrCodeNotEnrolled     = "NOT_ENROLLED" // v3: วิชาเดิมของ swap ที่นักเรียนไม่ได้ลงไว้
+	ErrCodeInternal        = "INTERNAL_ERROR"
+)
+
+// businessErrorStatus HTTP status ของรหัสที่เป็นการปฏิเสธตามเงื่อนไข (ลองใหม่ก็ได้ผลเดิม)
+var businessErrorStatus = map[string]int{
+	ErrCodeCourseNotFound:  http.StatusNotFound,
+	ErrCodeCourseClosed:    http.StatusConflict,
+	ErrCodeCourseFull:      http.StatusConflict,
+	ErrCodeAlreadyEnrolled: http.StatusConflict,
+	ErrCodeNotEnrolled:     http.StatusConflict,
+}
+
+// isBusinessRejection เช็คว่าเป็นการปฏิเสธตามเงื่อนไขหรือไม่
+// ไม่มีรหัส (v1) หรือ INTERNAL_ERROR ถือว่าอาจสำเร็จได้ถ้าลองใหม่
+func isBusinessRejection(code string) bool {
+	_, ok := businessErrorStatus[code]
+	return ok
+}
+
+// statusForErrorCode แปลงรหัสข้อผิดพลาดเป็น HTTP status
+func statusForErrorCode(code string) int {
+	if status, ok := businessErrorStatus[code]; ok {
+		return status
+	}
+	return http.StatusInternalServerError
+}
+
+// enrollmentErrorBody body ของ response เมื่อลงทะเบียนไม่สำเร็จ (POST /enroll และ checkout ตะกร้า)
+func enrollmentErrorBody(result EnrollmentResult) gin.H {
+	body := gin.H{"error": result.Error}
+	if result.Code != "" {
+		body["code"] = result.Code
+	}
+	if result.CourseID != 0 {
+		body["course_id"] = result.CourseID
+	}
+	return body
+}
+
+// enrollmentRequestPayload payload ของ enrollment.request (Actor และ Reason มีตั้งแต่ v2 ส่วน DropCourseIDs มีตั้งแต่ v3)
+type enrollmentRequestPayload struct {
+	StudentID     int    `json:"student_id"`
+	CourseIDs     []int  `json:"course_ids"`
+	DropCourseIDs []int  `json:"drop_course_ids,omitempty"`
+	Actor         string `json:"actor,omitempty"`
+	Reason        string `json:"reason,omitempty"`
+}
+
+// contractVersion เวอร์ชันที่ใช้ส่ง request อ่านจาก ENROLLMENT_CONTRACT_VERSION
+// ตั้งเป็นเวอร์ชันเก่าไว้ได้ระหว่างที่ course-service ยัง upgrade ไม่ครบทุกตัว (0 คือแบบเก่าที่ไม่มี envelope)
+func contractVersion() int {
+	latest := contract.LatestVersion()
+	v, err := strconv.Atoi(os.Getenv("ENROLLMENT_CONTRACT_VERSION"))
+	if err != nil {
+		return latest
+	}
+	if !contract.Supports(contract.RequestType, v) {
+		log.Printf("Unsupported ENROLLMENT_CONTRACT_VERSION %d, using %d", v, latest)
+		return latest
+	}
+	return v
+}
+
+// encodeEnrollmentRequest แปลง request เป็นข้อความของเวอร์ชันที่ระบุและตรวจกับ schema ก่อนส่ง
+// course_ids คือรายวิชาที่เพิ่มทั้งหมดรวมวิชาใหม่ของ swap ส่วน swap ต้องใช้ v3 ขึ้นไป
+func encodeEnrollmentRequest(version int, req EnrollmentRequest) ([]byte, error) {
+	payload := enrollmentRequestPayload{StudentID: req.StudentID, CourseIDs: req.addCourseIDs()}
+	if version >= 2 {
+		payload.Actor = req.Actor
+		payload.Reason = req.Reason
+	}
+	if len(req.Swaps) > 0 {
+		if version < 3 {
+			return nil, fmt.Errorf("swapping courses requires %s v3 (ENROLLMENT_CONTRACT_VERSION is %d)", contract.RequestType, version)
+		}
+		payload.DropCourseIDs = req.dropCourseIDs()
+	}
+	return contract.Encode(contract.RequestType, version, payload)
+}
+
+// decodeEnrollmentResponse อ่านคำตอบและตรวจว่าตรงกับเวอร์ชันที่ส่งไป
+// course-service รุ่นเก่าตอบแบบไม่มี envelope ซึ่งรับได้เฉพาะเมื่อส่งไปเป็นแบบเก่า
+func decodeEnrollmentResponse(version int, body []byte) (*EnrollmentResponse, error) {
+	got, payload, err := contract.Decode(contract.ResponseType, body)
+	if err != nil {
+		return nil, err
+	}
+	if got != version {
+		return nil, fmt.Errorf("unexpected %s v%d (expected v%d)", contract.ResponseType, got, version)
+	}
+
+	var response EnrollmentResponse
+	if err := json.Unmarshal(payload, &response); err != nil {
+		return nil, err
+	}
+	return &response, nil
+}
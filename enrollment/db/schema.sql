@@ -1,35 +1,89 @@
-CREATE TABLE IF NOT EXISTS student (
+CREATE TABLE IF NOT EXISTS enrollment (
+	"enrollment_id" INTEGER NOT NULL UNIQUE GENERATED BY DEFAULT AS IDENTITY,
 	"student_id" INTEGER NOT NULL UNIQUE,
-	"first_name" VARCHAR(255) NOT NULL,
-	"last_name" VARCHAR(255) NOT NULL,
-	"email" VARCHAR(255) NOT NULL,
-	"password" VARCHAR(255) NOT NULL,
-	"birthdate" VARCHAR(255) NOT NULL,
-	"gender" VARCHAR(255) NOT NULL,
-	"year_level" INTEGER NOT NULL,
-	"graded_subject" VARCHAR(255) ARRAY,
-	PRIMARY KEY("student_id")
+	"course_id" INTEGER ARRAY,
+	PRIMARY KEY("enrollment_id")
+);
+
+CREATE TABLE IF NOT EXISTS enrollment_history (
+	"history_id" INTEGER NOT NULL UNIQUE GENERATED BY DEFAULT AS IDENTITY,
+	"student_id" INTEGER NOT NULL,
+	"course_id" INTEGER NOT NULL,
+	"action" VARCHAR(50) NOT NULL,
+	"actor" VARCHAR(255) NOT NULL,
+	"reason" TEXT,
+	"created_at" TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+	PRIMARY KEY("history_id")
+);
+
+-- swap: รายวิชาเดิมที่ถูกแทนด้วย course_id
+ALTER TABLE enrollment_history ADD COLUMN IF NOT EXISTS "related_course_id" INTEGER;
+
+CREATE INDEX IF NOT EXISTS enrollment_history_student_idx ON enrollment_history ("student_id", "created_at");
+CREATE INDEX IF NOT EXISTS enrollment_history_course_idx ON enrollment_history ("course_id", "created_at");
+
+-- ประวัติเป็น append-only: ห้ามแก้ไขหรือลบแถวที่บันทึกไปแล้ว
+CREATE OR REPLACE FUNCTION enrollment_history_append_only() RETURNS trigger AS $$
+BEGIN
+	RAISE EXCEPTION 'enrollment_history is append-only (% is not allowed)', TG_OP;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS enrollment_history_append_only ON enrollment_history;
+CREATE TRIGGER enrollment_history_append_only
+	BEFORE UPDATE OR DELETE ON enrollment_history
+	FOR EACH ROW EXECUTE FUNCTION enrollment_history_append_only();
+
+-- ตะกร้าลงทะเบียน (ยังไม่ใช่การลงทะเบียนจริง จนกว่าจะ checkout)
+CREATE TABLE IF NOT EXISTS enrollment_cart (
+	"student_id" INTEGER NOT NULL,
+	"course_id" INTEGER NOT NULL,
+	"added_at" TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+	PRIMARY KEY("student_id", "course_id")
 );
+-- seat hold ใน course-service ที่ถือที่นั่งของวิชาในตะกร้าไว้ (hold_id อ้างถึง seat_hold ของ course-service)
+ALTER TABLE enrollment_cart ADD COLUMN IF NOT EXISTS "hold_id" INTEGER;
+ALTER TABLE enrollment_cart ADD COLUMN IF NOT EXISTS "hold_expires_at" TIMESTAMPTZ;
+-- รายวิชาที่ลงไว้แล้วซึ่งวิชาในตะกร้าจะมาแทนตอน checkout (swap)
+ALTER TABLE enrollment_cart ADD COLUMN IF NOT EXISTS "replaces_course_id" INTEGER;
 
-CREATE TABLE IF NOT EXISTS course (
+-- read model ของรายวิชา สร้างจาก event ของ course-service (course_events exchange)
+CREATE TABLE IF NOT EXISTS course_projection (
 	"course_id" INTEGER NOT NULL UNIQUE,
 	"subject" VARCHAR(255) NOT NULL,
 	"credit" INTEGER NOT NULL,
-	"section" VARCHAR(255) ARRAY NOT NULL,
+	"capacity" INTEGER NOT NULL,
+	"seats_taken" INTEGER NOT NULL DEFAULT 0,
+	"prerequisite" VARCHAR(255) ARRAY,
 	"day_of_week" VARCHAR(255) NOT NULL,
 	"start_time" TIME NOT NULL,
 	"end_time" TIME NOT NULL,
-	"capacity" INTEGER NOT NULL,
 	"state" VARCHAR(255) NOT NULL,
-	"current_student" VARCHAR(255) ARRAY,
-	"prerequisite" VARCHAR(255) ARRAY,
+	"deleted" BOOLEAN NOT NULL DEFAULT FALSE,
+	"last_event_at" TIMESTAMPTZ NOT NULL,
 	PRIMARY KEY("course_id")
 );
 
-
-CREATE TABLE IF NOT EXISTS enrollment (
-	"enrollment_id" INTEGER NOT NULL UNIQUE GENERATED BY DEFAULT AS IDENTITY,
+-- read model ของนักเรียน สร้างจาก event ของ student-service (student_events exchange)
+CREATE TABLE IF NOT EXISTS student_projection (
 	"student_id" INTEGER NOT NULL UNIQUE,
-	"course_id" INTEGER ARRAY,
-	PRIMARY KEY("enrollment_id")
+	"year_level" INTEGER NOT NULL,
+	"graded_subject" VARCHAR(255) ARRAY,
+	"last_event_at" TIMESTAMPTZ NOT NULL,
+	PRIMARY KEY("student_id")
+);
+
+-- transactional outbox ของการแจ้งเตือนนักเรียน (บันทึกใน transaction เดียวกับการถอนรายวิชาและประวัติ แล้ว relay ส่งออกพร้อมรอ publisher confirm)
+CREATE TABLE IF NOT EXISTS enrollment_event_outbox (
+	"outbox_id" BIGSERIAL PRIMARY KEY,
+	"event_id" VARCHAR(255) NOT NULL UNIQUE,
+	"event_type" VARCHAR(255) NOT NULL,
+	"student_id" INTEGER NOT NULL,
+	"course_id" INTEGER NOT NULL,
+	"payload" JSONB NOT NULL,
+	"occurred_at" TIMESTAMPTZ NOT NULL,
+	"published_at" TIMESTAMPTZ,
+	"attempts" INTEGER NOT NULL DEFAULT 0,
+	"last_error" TEXT
 );
+CREATE INDEX IF NOT EXISTS enrollment_event_outbox_pending_idx ON enrollment_event_outbox ("outbox_id") WHERE "published_at" IS NULL;
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+
+	"shared/rabbitmq"
+)
+
+// enrollmentEventsExchange topic exchange สำหรับ event ของการลงทะเบียน (routing key = ชื่อ event)
+// ใช้แจ้งเตือนนักเรียน เช่น notification service bind ด้วย enrollment.#
+const enrollmentEventsExchange = "enrollment_events"
+
+// enrollmentEventVersion เวอร์ชันของ schema (ดู schemas/notification_event.v1.json)
+const enrollmentEventVersion = 1
+
+const (
+	EventEnrollmentCourseCancelled     = "enrollment.course_cancelled"
+	EventEnrollmentRemovedOverCapacity = "enrollment.removed_over_capacity"
+)
+
+// EnrollmentEvent event ที่เกี่ยวกับการลงทะเบียนของนักเรียน 1 คนใน 1 รายวิชา
+type EnrollmentEvent struct {
+	EventID    string    `json:"event_id"`
+	Type       string    `json:"type"`
+	Version    int       `json:"version"`
+	OccurredAt time.Time `json:"occurred_at"`
+	StudentID  int       `json:"student_id"`
+	CourseID   int       `json:"course_id"`
+	Reason     string    `json:"reason,omitempty"`
+}
+
+func newEnrollmentEvent(eventType string, studentID, courseID int, reason string) EnrollmentEvent {
+	now := time.Now().UTC()
+	return EnrollmentEvent{
+		EventID:    fmt.Sprintf("%s-%d-%d-%d", eventType, studentID, courseID, now.UnixNano()),
+		Type:       eventType,
+		Version:    enrollmentEventVersion,
+		OccurredAt: now,
+		StudentID:  studentID,
+		CourseID:   courseID,
+		Reason:     reason,
+	}
+}
+
+// enqueueEnrollmentEvent บันทึก event ลง enrollment_event_outbox แล้ว EventPublisher จะส่งออกไปหลัง commit
+// ให้ส่ง transaction เดียวกับที่เปลี่ยนการลงทะเบียน เพื่อไม่ให้การแจ้งเตือนหายถ้า service ล่มหลัง commit
+func enqueueEnrollmentEvent(db historyExecer, event EnrollmentEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to marshal %s event for student %d: %v", event.Type, event.StudentID, err)
+	}
+	_, err = db.Exec(
+		`INSERT INTO enrollment_event_outbox (event_id, event_type, student_id, course_id, payload, occurred_at) VALUES ($1, $2, $3, $4, $5, $6)`,
+		event.EventID, event.Type, event.StudentID, event.CourseID, body, event.OccurredAt,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to store %s event for student %d: %v", event.Type, event.StudentID, err)
+	}
+	return nil
+}
+
+// outboxEvent event ใน enrollment_event_outbox ที่ยังไม่ได้ส่ง
+type outboxEvent struct {
+	EventID    string
+	EventType  string
+	StudentID  int
+	CourseID   int
+	Payload    []byte
+	OccurredAt time.Time
+}
+
+// ขนาดของแต่ละรอบที่ relay ส่ง และระยะเวลาที่เก็บ event ที่ส่งแล้วไว้ตรวจสอบย้อนหลัง
+const (
+	outboxRelayBatch     = 100
+	outboxRetention      = 7 * 24 * time.Hour
+	outboxConfirmTimeout = 5 * time.Second
+)
+
+// relayOutbox ส่ง event ที่ค้างอยู่ตามลำดับที่บันทึก และทำเครื่องหมายว่าส่งแล้วเมื่อ send สำเร็จเท่านั้น
+// ถ้าส่งไม่สำเร็จจะหยุดรอบนี้ไว้ (event ยังค้างอยู่ รอบถัดไปจะลองใหม่)
+// lock แถวด้วย SKIP LOCKED เพื่อให้รันหลาย instance พร้อมกันได้โดยไม่ส่งซ้ำกัน
+func relayOutbox(db *sql.DB, send func(outboxEvent) error) (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(
+		`SELECT outbox_id, event_id, event_type, student_id, course_id, payload, occurred_at FROM enrollment_event_outbox
+		WHERE published_at IS NULL ORDER BY outbox_id LIMIT $1 FOR UPDATE SKIP LOCKED`,
+		outboxRelayBatch,
+	)
+	if err != nil {
+		return 0, err
+	}
+	var ids []int64
+	var pending []outboxEvent
+	for rows.Next() {
+		var id int64
+		var e outboxEvent
+		if err := rows.Scan(&id, &e.EventID, &e.EventType, &e.StudentID, &e.CourseID, &e.Payload, &e.OccurredAt); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		ids = append(ids, id)
+		pending = append(pending, e)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	sent := 0
+	var sendErr error
+	for i, e := range pending {
+		if sendErr = send(e); sendErr != nil {
+			_, err := tx.Exec(`UPDATE enrollment_event_outbox SET attempts = attempts + 1, last_error = $2 WHERE outbox_id = $1`, ids[i], sendErr.Error())
+			if err != nil {
+				return 0, err
+			}
+			break
+		}
+		if _, err := tx.Exec(`UPDATE enrollment_event_outbox SET published_at = NOW() WHERE outbox_id = $1`, ids[i]); err != nil {
+			return 0, err
+		}
+		sent++
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	if sendErr != nil {
+		return sent, fmt.Errorf("failed to publish %s event for student %d: %v", pending[sent].EventType, pending[sent].StudentID, sendErr)
+	}
+	return sent, nil
+}
+
+// EventPublisher ส่ง event จาก enrollment_event_outbox ไปยัง RabbitMQ (transactional outbox)
+// channel อยู่ใน confirm mode และ event จะถูกนับว่าส่งแล้วก็ต่อเมื่อ broker ยืนยัน (ack) เท่านั้น
+// ระหว่าง RabbitMQ หลุด event จะค้างอยู่ในตารางแล้วถูกส่งเมื่อเชื่อมต่อใหม่ได้
+// ถ้าเป็น nil (เช่นตอนเทส) event จะค้างอยู่ในตารางโดยไม่มีใครส่ง
+type EventPublisher struct {
+	db      *sql.DB
+	wake    chan struct{}
+	mu      sync.Mutex
+	channel *amqp.Channel
+}
+
+// newEventPublisher เปิด channel แบบ confirm mode สำหรับ publish event ประกาศ exchange แล้วเริ่ม relay เบื้องหลัง
+func newEventPublisher(rabbit *rabbitmq.Connection, db *sql.DB) *EventPublisher {
+	p := &EventPublisher{db: db, wake: make(chan struct{}, 1)}
+	err := rabbit.OnChannel("event publisher", func(ch *amqp.Channel) error {
+		if err := ch.ExchangeDeclare(enrollmentEventsExchange, "topic", true, false, false, false, nil); err != nil {
+			return err
+		}
+		if err := ch.Confirm(false); err != nil {
+			return err
+		}
+
+		p.mu.Lock()
+		p.channel = ch
+		p.mu.Unlock()
+		p.Notify()
+		return nil
+	})
+	if err != nil {
+		log.Fatal("RabbitMQ Event Channel Error:", err)
+	}
+	go p.run()
+	return p
+}
+
+// Notify ปลุก relay ให้ส่ง event ทันทีหลัง commit (ไม่เช่นนั้นจะถูกส่งในรอบถัดไปของ OUTBOX_RELAY_INTERVAL)
+func (p *EventPublisher) Notify() {
+	if p == nil {
+		return
+	}
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
+
+// run วนส่ง event ที่ค้างอยู่ทุกครั้งที่ถูกปลุกหรือครบรอบ และลบ event ที่ส่งแล้วเกิน outboxRetention
+func (p *EventPublisher) run() {
+	interval := 5 * time.Second
+	if v, err := time.ParseDuration(os.Getenv("OUTBOX_RELAY_INTERVAL")); err == nil && v > 0 {
+		interval = v
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	cleanup := time.NewTicker(time.Hour)
+	defer cleanup.Stop()
+
+	for {
+		select {
+		case <-p.wake:
+		case <-ticker.C:
+		case <-cleanup.C:
+			if _, err := p.db.Exec(`DELETE FROM enrollment_event_outbox WHERE published_at < $1`, time.Now().Add(-outboxRetention)); err != nil {
+				log.Printf("Failed to clean up published enrollment events: %v", err)
+			}
+			continue
+		}
+
+		for {
+			n, err := relayOutbox(p.db, p.send)
+			if err != nil {
+				log.Printf("Enrollment event relay: %v", err)
+				break
+			}
+			if n < outboxRelayBatch {
+				break
+			}
+		}
+	}
+}
+
+// send publish event 1 รายการแล้วรอให้ broker ยืนยัน
+func (p *EventPublisher) send(e outboxEvent) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.channel == nil || p.channel.IsClosed() {
+		return rabbitmq.ErrUnavailable
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), outboxConfirmTimeout)
+	defer cancel()
+
+	confirm, err := p.channel.PublishWithDeferredConfirmWithContext(ctx,
+		enrollmentEventsExchange, // exchange
+		e.EventType,              // routing key
+		false,                    // mandatory
+		false,                    // immediate
+		amqp.Publishing{
+			ContentType:  "application/json",
+			DeliveryMode: amqp.Persistent,
+			MessageId:    e.EventID,
+			Type:         e.EventType,
+			Timestamp:    e.OccurredAt,
+			Body:         e.Payload,
+		})
+	if err != nil {
+		return err
+	}
+	acked, err := confirm.WaitContext(ctx)
+	if err != nil {
+		return fmt.Errorf("no publisher confirm: %v", err)
+	}
+	if !acked {
+		return fmt.Errorf("event nacked by broker")
+	}
+	log.Printf("Published %s event for student %d (course %d)", e.EventType, e.StudentID, e.CourseID)
+	return nil
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sony/gobreaker"
+
+	"shared/auth"
+)
+
+// ประเภทของการเปลี่ยนแปลงรายวิชาที่ลงทะเบียน
+const (
+	HistoryActionAdd       = "add"        // นักเรียนลงทะเบียนเอง
+	HistoryActionDrop      = "drop"       // ถอนรายวิชา (เช่นรายวิชาถูกยกเลิก)
+	HistoryActionSwap      = "swap"       // เปลี่ยนจาก related_course_id เป็น course_id ในคำขอเดียวกัน
+	HistoryActionOverride  = "override"   // registrar ลงทะเบียนให้โดยข้ามเงื่อนไข (วิชาบังคับก่อน หน่วยกิต เวลาชน)
+	HistoryActionAdminEdit = "admin_edit" // registrar หรือระบบแก้การลงทะเบียนแทนนักเรียน (ลงให้ หรือถอนออกเมื่อลดที่นั่ง)
+)
+
+var historyActions = map[string]bool{
+	HistoryActionAdd:       true,
+	HistoryActionDrop:      true,
+	HistoryActionSwap:      true,
+	HistoryActionOverride:  true,
+	HistoryActionAdminEdit: true,
+}
+
+const (
+	defaultHistoryLimit = 100
+	maxHistoryLimit     = 1000
+)
+
+// HistoryEntry ประวัติการเปลี่ยนแปลงการลงทะเบียน 1 รายการ (append-only)
+type HistoryEntry struct {
+	HistoryID       int       `json:"history_id"`
+	StudentID       int       `json:"student_id"`
+	CourseID        int       `json:"course_id"`
+	RelatedCourseID *int      `json:"related_course_id,omitempty"` // swap: รายวิชาเดิมที่ถูกแทนด้วย course_id
+	Action          string    `json:"action"`
+	Actor           string    `json:"actor"`
+	Reason          string    `json:"reason,omitempty"`
+	CreatedAt       time.Time `json:"created_at"`
+}
+
+// historyExecer ใช้ได้ทั้ง *sql.DB และ *sql.Tx เพื่อให้บันทึกประวัติใน transaction เดียวกับการเปลี่ยนแปลงได้
+type historyExecer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// recordHistory บันทึกประวัติการลงทะเบียน
+func recordHistory(db historyExecer, entries ...HistoryEntry) error {
+	for _, e := range entries {
+		if !historyActions[e.Action] {
+			return fmt.Errorf("unknown history action: %s", e.Action)
+		}
+		_, err := db.Exec(
+			`INSERT INTO enrollment_history (student_id, course_id, related_course_id, action, actor, reason)
+			 VALUES ($1, $2, $3, $4, $5, NULLIF($6, ''))`,
+			e.StudentID, e.CourseID, e.RelatedCourseID, e.Action, e.Actor, e.Reason,
+		)
+		if err != nil {
+			return fmt.Errorf("failed to record enrollment history: %v", err)
+		}
+	}
+	return nil
+}
+
+// historyEntriesFor สร้างรายการประวัติของนักเรียน 1 คนสำหรับหลายรายวิชาที่มี action เดียวกัน
+func historyEntriesFor(studentID int, courseIDs []int, action, actor, reason string) []HistoryEntry {
+	entries := make([]HistoryEntry, 0, len(courseIDs))
+	for _, courseID := range courseIDs {
+		entries = append(entries, HistoryEntry{
+			StudentID: studentID,
+			CourseID:  courseID,
+			Action:    action,
+			Actor:     actor,
+			Reason:    reason,
+		})
+	}
+	return entries
+}
+
+// enrollmentHistoryEntries ประวัติของคำขอลงทะเบียน 1 คำขอ
+// วิชาใหม่ของ swap บันทึกเป็น swap คู่กับวิชาเดิม ส่วนวิชาที่เพิ่มเป็น override เมื่อ registrar ข้ามเงื่อนไข
+// admin_edit เมื่อผู้อื่นลงให้ และ add เมื่อนักเรียนลงเอง
+func enrollmentHistoryEntries(req EnrollmentRequest, actor string) []HistoryEntry {
+	action := HistoryActionAdd
+	switch {
+	case req.Override:
+		action = HistoryActionOverride
+	case req.OnBehalf:
+		action = HistoryActionAdminEdit
+	}
+
+	entries := historyEntriesFor(req.StudentID, req.CourseIDs, action, actor, req.Reason)
+	for _, swap := range req.Swaps {
+		from := swap.FromCourseID
+		entries = append(entries, HistoryEntry{
+			StudentID:       req.StudentID,
+			CourseID:        swap.ToCourseID,
+			RelatedCourseID: &from,
+			Action:          HistoryActionSwap,
+			Actor:           actor,
+			Reason:          req.Reason,
+		})
+	}
+	return entries
+}
+
+// onBehalf ผู้เรียกไม่ใช่นักเรียน studentID เอง (เช่น registrar ทำแทน) การเพิ่มรายวิชาจึงบันทึกเป็น admin_edit
+func onBehalf(c *gin.Context, studentID int) bool {
+	id, ok := auth.IdentityFrom(c)
+	return !ok || !id.IsSelfOr(studentID)
+}
+
+// actorFromRequest ระบุผู้กระทำจาก access token ถ้า route ไม่ได้บังคับ login ให้ใช้ค่า fallback
+func actorFromRequest(c *gin.Context, fallback string) string {
+	if id, ok := auth.IdentityFrom(c); ok {
+		return id.Actor()
+	}
+	return fallback
+}
+
+// queryHistory ดึงประวัติตาม column ที่ระบุ (student_id หรือ course_id) เรียงจากใหม่ไปเก่า
+func queryHistory(db *sql.DB, column string, id int, action string, limit int) ([]HistoryEntry, error) {
+	query := fmt.Sprintf(`SELECT history_id, student_id, course_id, related_course_id, action, actor, COALESCE(reason, ''), created_at
+		FROM enrollment_history
+		WHERE %s = $1 AND ($2 = '' OR action = $2)
+		ORDER BY created_at DESC, history_id DESC
+		LIMIT $3`, column)
+
+	rows, err := db.Query(query, id, action, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []HistoryEntry{}
+	for rows.Next() {
+		var e HistoryEntry
+		var related sql.NullInt64
+		if err := rows.Scan(&e.HistoryID, &e.StudentID, &e.CourseID, &related, &e.Action, &e.Actor, &e.Reason, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+		if related.Valid {
+			id := int(related.Int64)
+			e.RelatedCourseID = &id
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+// historyHandler GET /history/students/:id และ GET /history/courses/:id
+func historyHandler(db *sql.DB, readCircuitBreaker *gobreaker.CircuitBreaker, column string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "รหัสไม่ถูกต้อง"})
+			return
+		}
+
+		action := c.Query("action")
+		if action != "" && !historyActions[action] {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "action ไม่ถูกต้อง: " + action})
+			return
+		}
+
+		limit := defaultHistoryLimit
+		if v := c.Query("limit"); v != "" {
+			limit, err = strconv.Atoi(v)
+			if err != nil || limit <= 0 {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "limit ไม่ถูกต้อง"})
+				return
+			}
+			if limit > maxHistoryLimit {
+				limit = maxHistoryLimit
+			}
+		}
+
+		result, err := readCircuitBreaker.Execute(func() (interface{}, error) {
+			return queryHistory(db, column, id, action, limit)
+		})
+
+		if err == gobreaker.ErrOpenState {
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "ระบบขัดข้องชั่วคราว (Circuit Breaker Open)"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to query enrollment history: " + err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, result)
+	}
+}
@@ -2,18 +2,32 @@ package main
 
 import (
 	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
 	"database/sql"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"log"
+	"math/big"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/gin-gonic/gin"
-	_ "github.com/lib/pq"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/lib/pq"
 	"github.com/stretchr/testify/assert"
+
+	"shared/auth"
+	"shared/contract"
+	"shared/rabbitmq"
 )
 
 // ---- Global Test Variables ----
@@ -22,15 +36,25 @@ var (
 	testReadConn  *sql.DB
 	testWriteConn *sql.DB
 	testDBConns   *DBConnections
+
+	// token ของ registrar ที่ทุก request ในเทสแนบไปด้วย (เหมือนได้มาจาก student-service)
+	testSigningKey  *rsa.PrivateKey
+	testJWKS        *httptest.Server
+	testAuth        *auth.TokenVerifier
+	testAccessToken string
 )
 
+const testKeyID = "test-key"
+
 // ---- Test Setup & Teardown ----
 
 func TestMain(m *testing.M) {
 	setupTestDB()
+	setupTestAuth()
 	gin.SetMode(gin.TestMode)
 	fmt.Println("Connected to test database")
 	code := m.Run()
+	testJWKS.Close()
 	teardownTestDB()
 	os.Exit(code)
 }
@@ -59,6 +83,68 @@ func setupTestDB() {
 	}
 }
 
+// setupTestAuth จำลอง JWKS ของ student-service แล้วออก access token สำหรับเทส
+func setupTestAuth() {
+	var err error
+	testSigningKey, err = rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		log.Fatal("Failed to generate signing key:", err)
+	}
+	testJWKS = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{{
+			"kty": "RSA",
+			"use": "sig",
+			"alg": "RS256",
+			"kid": testKeyID,
+			"n":   base64.RawURLEncoding.EncodeToString(testSigningKey.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(testSigningKey.E)).Bytes()),
+		}}})
+	}))
+	testAuth = auth.NewTokenVerifier(testJWKS.URL, "enrollment-service")
+	testAccessToken = signTestToken(testSigningKey, auth.Identity{StudentID: 9, Email: "registrar@example.com", Roles: []string{auth.RoleRegistrar}}, "access", time.Hour)
+}
+
+func signTestToken(key *rsa.PrivateKey, id auth.Identity, use string, ttl time.Duration) string {
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, auth.TokenClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    auth.Issuer,
+			Subject:   strconv.Itoa(id.StudentID),
+			IssuedAt:  jwt.NewNumericDate(time.Now()),
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(ttl)),
+		},
+		Email:    id.Email,
+		Roles:    id.Roles,
+		TokenUse: use,
+	})
+	token.Header["kid"] = testKeyID
+	signed, err := token.SignedString(key)
+	if err != nil {
+		log.Fatal("Failed to sign test token:", err)
+	}
+	return signed
+}
+
+// signServiceTestToken service token แบบที่ student-service ออกให้ clientID เรียก audience
+func signServiceTestToken(key *rsa.PrivateKey, clientID, audience string, ttl time.Duration) string {
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, auth.TokenClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    auth.Issuer,
+			Subject:   clientID,
+			Audience:  jwt.ClaimStrings{audience},
+			IssuedAt:  jwt.NewNumericDate(time.Now()),
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(ttl)),
+		},
+		Roles:    []string{auth.RoleService},
+		TokenUse: auth.TokenUseService,
+	})
+	token.Header["kid"] = testKeyID
+	signed, err := token.SignedString(key)
+	if err != nil {
+		log.Fatal("Failed to sign test token:", err)
+	}
+	return signed
+}
+
 func teardownTestDB() {
 	if testReadConn != nil {
 		testReadConn.Close()
@@ -73,20 +159,20 @@ func teardownTestDB() {
 func resetDB() {
 	ensureSchemas()
 
-	if _, err := testWriteConn.Exec(`TRUNCATE TABLE student, course, enrollment RESTART IDENTITY CASCADE`); err != nil {
+	if _, err := testWriteConn.Exec(`TRUNCATE TABLE student_projection, course_projection, enrollment, enrollment_history, enrollment_cart, enrollment_event_outbox RESTART IDENTITY CASCADE`); err != nil {
 		log.Fatal("Failed to truncate tables:", err)
 	}
 
 	seedData := `
-		INSERT INTO student (student_id, graded_subject) VALUES
-		(1, ARRAY['Mathematics']),
-		(2, ARRAY[]::VARCHAR[]);
-
-		INSERT INTO course (course_id, subject, credit, capacity, section, current_student, prerequisite, day_of_week, start_time, end_time, state) VALUES
-		(1, 'Math 1', 3, 30, ARRAY['1'], ARRAY[]::VARCHAR[], NULL, 'Monday', '09:00:00', '12:00:00', 'open'),
-		(2, 'Physics', 3, 30, ARRAY['1'], ARRAY[]::VARCHAR[], ARRAY['Mathematics'], 'Tuesday', '13:00:00', '16:00:00', 'open'),
-		(3, 'Com Sci', 3, 1, ARRAY['1'], ARRAY['3'], NULL, 'Wednesday', '09:00:00', '12:00:00', 'closed'),
-		(4, 'Biology', 3, 30, ARRAY['1'], ARRAY[]::VARCHAR[], NULL, 'Monday', '10:00:00', '13:00:00', 'open');
+		INSERT INTO student_projection (student_id, year_level, graded_subject, last_event_at) VALUES
+		(1, 1, ARRAY['Mathematics'], NOW()),
+		(2, 1, ARRAY[]::VARCHAR[], NOW());
+
+		INSERT INTO course_projection (course_id, subject, credit, capacity, seats_taken, prerequisite, day_of_week, start_time, end_time, state, last_event_at) VALUES
+		(1, 'Math 1', 3, 30, 0, NULL, 'Monday', '09:00:00', '12:00:00', 'open', NOW()),
+		(2, 'Physics', 3, 30, 0, ARRAY['Mathematics'], 'Tuesday', '13:00:00', '16:00:00', 'open', NOW()),
+		(3, 'Com Sci', 3, 1, 1, NULL, 'Wednesday', '09:00:00', '12:00:00', 'closed', NOW()),
+		(4, 'Biology', 3, 30, 0, NULL, 'Monday', '10:00:00', '13:00:00', 'open', NOW());
 	`
 	if _, err := testWriteConn.Exec(seedData); err != nil {
 		log.Fatal("Failed to seed data:", err)
@@ -95,28 +181,71 @@ func resetDB() {
 
 func ensureSchemas() {
 	schema := `
-		CREATE TABLE IF NOT EXISTS student (
+		CREATE TABLE IF NOT EXISTS student_projection (
 			student_id INTEGER PRIMARY KEY,
-			graded_subject VARCHAR(255) ARRAY
+			year_level INTEGER NOT NULL,
+			graded_subject VARCHAR(255) ARRAY,
+			last_event_at TIMESTAMPTZ NOT NULL
 		);
-		CREATE TABLE IF NOT EXISTS course (
+		CREATE TABLE IF NOT EXISTS course_projection (
 			course_id INTEGER PRIMARY KEY,
-			subject VARCHAR(255),
-			credit INTEGER,
-			capacity INTEGER,
-			section VARCHAR(255) ARRAY,
-			current_student VARCHAR(255) ARRAY,
+			subject VARCHAR(255) NOT NULL,
+			credit INTEGER NOT NULL,
+			capacity INTEGER NOT NULL,
+			seats_taken INTEGER NOT NULL DEFAULT 0,
 			prerequisite VARCHAR(255) ARRAY,
-			day_of_week VARCHAR(20),
-			start_time TIME,
-			end_time TIME,
-			state VARCHAR(20)
+			day_of_week VARCHAR(20) NOT NULL,
+			start_time TIME NOT NULL,
+			end_time TIME NOT NULL,
+			state VARCHAR(20) NOT NULL,
+			deleted BOOLEAN NOT NULL DEFAULT FALSE,
+			last_event_at TIMESTAMPTZ NOT NULL
 		);
 		CREATE TABLE IF NOT EXISTS enrollment (
 			id SERIAL PRIMARY KEY,
 			student_id INTEGER,
 			course_id INTEGER[]
 		);
+		CREATE TABLE IF NOT EXISTS enrollment_history (
+			history_id SERIAL PRIMARY KEY,
+			student_id INTEGER NOT NULL,
+			course_id INTEGER NOT NULL,
+			action VARCHAR(50) NOT NULL,
+			actor VARCHAR(255) NOT NULL,
+			reason TEXT,
+			created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+		);
+		ALTER TABLE enrollment_history ADD COLUMN IF NOT EXISTS related_course_id INTEGER;
+		CREATE OR REPLACE FUNCTION enrollment_history_append_only() RETURNS trigger AS $$
+		BEGIN
+			RAISE EXCEPTION 'enrollment_history is append-only (% is not allowed)', TG_OP;
+		END;
+		$$ LANGUAGE plpgsql;
+		DROP TRIGGER IF EXISTS enrollment_history_append_only ON enrollment_history;
+		CREATE TRIGGER enrollment_history_append_only
+			BEFORE UPDATE OR DELETE ON enrollment_history
+			FOR EACH ROW EXECUTE FUNCTION enrollment_history_append_only();
+		CREATE TABLE IF NOT EXISTS enrollment_cart (
+			student_id INTEGER NOT NULL,
+			course_id INTEGER NOT NULL,
+			added_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+			PRIMARY KEY (student_id, course_id)
+		);
+		ALTER TABLE enrollment_cart ADD COLUMN IF NOT EXISTS hold_id INTEGER;
+		ALTER TABLE enrollment_cart ADD COLUMN IF NOT EXISTS hold_expires_at TIMESTAMPTZ;
+		ALTER TABLE enrollment_cart ADD COLUMN IF NOT EXISTS replaces_course_id INTEGER;
+		CREATE TABLE IF NOT EXISTS enrollment_event_outbox (
+			outbox_id BIGSERIAL PRIMARY KEY,
+			event_id VARCHAR(255) NOT NULL UNIQUE,
+			event_type VARCHAR(255) NOT NULL,
+			student_id INTEGER NOT NULL,
+			course_id INTEGER NOT NULL,
+			payload JSONB NOT NULL,
+			occurred_at TIMESTAMPTZ NOT NULL,
+			published_at TIMESTAMPTZ,
+			attempts INTEGER NOT NULL DEFAULT 0,
+			last_error TEXT
+		);
 	`
 	if _, err := testWriteConn.Exec(schema); err != nil {
 		log.Fatal("Failed to setup schema:", err)
@@ -126,6 +255,16 @@ func ensureSchemas() {
 // ---- HTTP Helpers ----
 
 func performRequest(router *gin.Engine, method, path string, body interface{}) *httptest.ResponseRecorder {
+	return performRequestWithHeaders(router, method, path, body, nil)
+}
+
+// asRole header Authorization ของผู้ใช้ studentID ที่มี role ที่ระบุ
+func asRole(studentID int, roles ...string) map[string]string {
+	token := signTestToken(testSigningKey, auth.Identity{StudentID: studentID, Roles: roles}, "access", time.Hour)
+	return map[string]string{"Authorization": "Bearer " + token}
+}
+
+func performRequestWithHeaders(router *gin.Engine, method, path string, body interface{}, headers map[string]string) *httptest.ResponseRecorder {
 	var reqBody *bytes.Buffer
 	if body != nil {
 		jsonBody, _ := json.Marshal(body)
@@ -135,9 +274,13 @@ func performRequest(router *gin.Engine, method, path string, body interface{}) *
 	}
 
 	req, _ := http.NewRequest(method, path, reqBody)
+	req.Header.Set("Authorization", "Bearer "+testAccessToken)
 	if body != nil {
 		req.Header.Set("Content-Type", "application/json")
 	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
 
 	w := httptest.NewRecorder()
 	router.ServeHTTP(w, req)
@@ -149,7 +292,7 @@ func performRequest(router *gin.Engine, method, path string, body interface{}) *
 // 1. ทดสอบ Request Body ไม่ถูกต้อง
 func TestEnroll_InvalidRequest(t *testing.T) {
 	resetDB()
-	router := SetupRouter(testDBConns, nil)
+	router := SetupRouter(testDBConns, nil, testAuth)
 
 	body := map[string]interface{}{"student_id": 1} // ขาด course_ids
 	w := performRequest(router, "POST", "/enroll", body)
@@ -160,7 +303,7 @@ func TestEnroll_InvalidRequest(t *testing.T) {
 // 2. ทดสอบลงทะเบียนวิชาที่ไม่มีในระบบ
 func TestEnroll_CourseNotFound(t *testing.T) {
 	resetDB()
-	router := SetupRouter(testDBConns, nil)
+	router := SetupRouter(testDBConns, nil, testAuth)
 
 	body := map[string]interface{}{"student_id": 1, "course_ids": []int{999}}
 	w := performRequest(router, "POST", "/enroll", body)
@@ -171,7 +314,7 @@ func TestEnroll_CourseNotFound(t *testing.T) {
 // 3. ทดสอบลงทะเบียนวิชาที่ยังไม่ผ่านวิชาบังคับ (Prerequisite)
 func TestEnroll_MissingPrerequisite(t *testing.T) {
 	resetDB()
-	router := SetupRouter(testDBConns, nil)
+	router := SetupRouter(testDBConns, nil, testAuth)
 
 	// นักเรียน 2 ยังไม่ผ่านวิชา Mathematics จึงไม่สามารถลงวิชา 2 (Physics) ได้
 	body := map[string]interface{}{"student_id": 2, "course_ids": []int{2}}
@@ -183,7 +326,7 @@ func TestEnroll_MissingPrerequisite(t *testing.T) {
 // 4. ทดสอบลงทะเบียนวิชาที่ปิดหรือเต็มแล้ว (Closed)
 func TestEnroll_CourseClosed(t *testing.T) {
 	resetDB()
-	router := SetupRouter(testDBConns, nil)
+	router := SetupRouter(testDBConns, nil, testAuth)
 
 	// วิชา 3 ถูกตั้ง state เป็น closed และเต็ม
 	body := map[string]interface{}{"student_id": 1, "course_ids": []int{3}}
@@ -195,7 +338,7 @@ func TestEnroll_CourseClosed(t *testing.T) {
 // 5. ทดสอบลงทะเบียนวิชาที่เวลาเรียนชนกันเองใน Request ใหม่
 func TestEnroll_TimeOverlapInNewCourses(t *testing.T) {
 	resetDB()
-	router := SetupRouter(testDBConns, nil)
+	router := SetupRouter(testDBConns, nil, testAuth)
 
 	// วิชา 1 (09:00 - 12:00) ชนกับ วิชา 4 (10:00 - 13:00) ในวันจันทร์เหมือนกัน
 	body := map[string]interface{}{"student_id": 1, "course_ids": []int{1, 4}}
@@ -203,3 +346,930 @@ func TestEnroll_TimeOverlapInNewCourses(t *testing.T) {
 
 	assert.Equal(t, http.StatusBadRequest, w.Code)
 }
+
+// ทดสอบว่าการลงทะเบียนและตะกร้าต้องมี access token จาก student-service
+func TestEnroll_RequiresAccessToken(t *testing.T) {
+	resetDB()
+	router := SetupRouter(testDBConns, nil, testAuth)
+	noToken := map[string]string{"Authorization": ""}
+
+	body := map[string]interface{}{"student_id": 1, "course_ids": []int{1}}
+	w := performRequestWithHeaders(router, "POST", "/enroll", body, noToken)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	w = performRequestWithHeaders(router, "POST", "/enroll/batch", map[string]interface{}{"items": []interface{}{body}}, noToken)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	w = performRequestWithHeaders(router, "GET", "/cart/1", nil, noToken)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	expired := signTestToken(testSigningKey, auth.Identity{StudentID: 1}, "access", -time.Minute)
+	w = performRequestWithHeaders(router, "POST", "/enroll", body, map[string]string{"Authorization": "Bearer " + expired})
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	// token ที่ถูกต้องผ่านไปถึงการตรวจ body ตามปกติ
+	w = performRequest(router, "POST", "/enroll", map[string]interface{}{"student_id": 1})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+// ทดสอบสิทธิ์ตาม role: นักเรียนทำได้เฉพาะของตัวเอง
+func TestEnroll_StudentsOnlyActForThemselves(t *testing.T) {
+	resetDB()
+	router := SetupRouter(testDBConns, nil, testAuth)
+	student := asRole(1, auth.RoleStudent)
+
+	// ลงทะเบียนให้คนอื่นไม่ได้ ส่วนของตัวเองผ่านไปถึงการตรวจรายวิชาตามปกติ
+	w := performRequestWithHeaders(router, "POST", "/enroll", map[string]interface{}{"student_id": 2, "course_ids": []int{1}}, student)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	w = performRequestWithHeaders(router, "POST", "/enroll", map[string]interface{}{"student_id": 1, "course_ids": []int{999}}, student)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = performRequestWithHeaders(router, "POST", "/enroll/batch", map[string]interface{}{"items": []map[string]interface{}{{"student_id": 1, "course_ids": []int{1}}}}, student)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	w = performRequestWithHeaders(router, "GET", "/cart/2", nil, student)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	w = performRequestWithHeaders(router, "POST", "/cart/2/items", map[string]int{"course_id": 1}, student)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	w = performRequestWithHeaders(router, "GET", "/cart/1", nil, student)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	// ประวัติ: ของตัวเองหรืออาจารย์ที่ปรึกษา ส่วนประวัติรายวิชาเป็นของ registrar
+	w = performRequestWithHeaders(router, "GET", "/history/students/2", nil, student)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	w = performRequestWithHeaders(router, "GET", "/history/students/1", nil, student)
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = performRequestWithHeaders(router, "GET", "/history/students/2", nil, asRole(30, auth.RoleAdvisor))
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = performRequestWithHeaders(router, "GET", "/history/courses/1", nil, student)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	w = performRequestWithHeaders(router, "GET", "/history/courses/1", nil, asRole(7, auth.RoleAdmin))
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+// 6. ทดสอบลงทะเบียนแบบกลุ่ม โดยได้ผลลัพธ์แยกรายนักเรียน
+func TestBatchEnroll_PerStudentReport(t *testing.T) {
+	resetDB()
+	router := SetupRouter(testDBConns, nil, testAuth)
+
+	body := map[string]interface{}{
+		"items": []map[string]interface{}{
+			{"student_id": 2, "course_ids": []int{2}},   // ยังไม่ผ่านวิชาบังคับ
+			{"student_id": 1, "course_ids": []int{999}}, // ไม่มีวิชานี้
+			{"student_id": 2, "course_ids": []int{1}},   // ระบุนักเรียนซ้ำ
+		},
+	}
+	w := performRequest(router, "POST", "/enroll/batch", body)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var report BatchReport
+	err := json.Unmarshal(w.Body.Bytes(), &report)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, report.Total)
+	assert.Equal(t, 0, report.Succeeded)
+	assert.Equal(t, 3, report.Failed)
+	assert.Equal(t, 2, report.Results[0].StudentID)
+	assert.Equal(t, http.StatusBadRequest, report.Results[0].Status)
+	assert.Equal(t, http.StatusBadRequest, report.Results[2].Status)
+}
+
+// 7. ทดสอบ batch ที่ไม่มีรายการ
+func TestBatchEnroll_EmptyItems(t *testing.T) {
+	resetDB()
+	router := SetupRouter(testDBConns, nil, testAuth)
+
+	body := map[string]interface{}{"items": []map[string]interface{}{}}
+	w := performRequest(router, "POST", "/enroll/batch", body)
+
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+// 8. ทดสอบ batch แบบ background job และติดตามความคืบหน้า
+func TestBatchEnroll_AsyncJob(t *testing.T) {
+	resetDB()
+	router := SetupRouter(testDBConns, nil, testAuth)
+
+	body := map[string]interface{}{
+		"async": true,
+		"items": []map[string]interface{}{
+			{"student_id": 2, "course_ids": []int{2}},
+		},
+	}
+	w := performRequest(router, "POST", "/enroll/batch", body)
+	assert.Equal(t, http.StatusAccepted, w.Code)
+
+	var accepted map[string]interface{}
+	json.Unmarshal(w.Body.Bytes(), &accepted)
+	jobID, _ := accepted["job_id"].(string)
+	assert.NotEmpty(t, jobID)
+
+	var job BatchJob
+	for i := 0; i < 50; i++ {
+		w = performRequest(router, "GET", "/enroll/batch/"+jobID, nil)
+		assert.Equal(t, http.StatusOK, w.Code)
+		json.Unmarshal(w.Body.Bytes(), &job)
+		if job.Status == "completed" {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	assert.Equal(t, "completed", job.Status)
+	assert.Equal(t, 1, job.Processed)
+	assert.Equal(t, 1, job.Failed)
+}
+
+func TestBatchEnroll_JobNotFound(t *testing.T) {
+	resetDB()
+	router := SetupRouter(testDBConns, nil, testAuth)
+
+	w := performRequest(router, "GET", "/enroll/batch/unknown", nil)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestBatchJobStore_ExpiresFinishedJobs(t *testing.T) {
+	jobs := &batchJobStore{jobs: make(map[string]*BatchJob), ttl: time.Minute}
+	finished := jobs.create(1)
+	jobs.finish(finished)
+	running := jobs.create(1)
+	running.CreatedAt = time.Now().Add(-time.Hour)
+
+	_, ok := jobs.get(finished.JobID)
+	assert.True(t, ok)
+
+	longAgo := time.Now().Add(-2 * time.Minute)
+	finished.FinishedAt = &longAgo
+	_, ok = jobs.get(finished.JobID)
+	assert.False(t, ok)
+	_, ok = jobs.get(running.JobID)
+	assert.True(t, ok, "running jobs are never expired")
+}
+
+// 9. ทดสอบดึงประวัติการลงทะเบียนรายนักเรียนและรายวิชา
+func TestEnrollmentHistory_ByStudentAndCourse(t *testing.T) {
+	resetDB()
+	router := SetupRouter(testDBConns, nil, testAuth)
+
+	err := recordHistory(testWriteConn,
+		HistoryEntry{StudentID: 1, CourseID: 1, Action: HistoryActionAdd, Actor: "student:1"},
+		HistoryEntry{StudentID: 1, CourseID: 1, Action: HistoryActionDrop, Actor: "registrar:9", Reason: "ขอถอนรายวิชา"},
+		HistoryEntry{StudentID: 2, CourseID: 1, Action: HistoryActionAdd, Actor: "student:2"},
+	)
+	assert.Nil(t, err)
+
+	w := performRequest(router, "GET", "/history/students/1", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var entries []HistoryEntry
+	json.Unmarshal(w.Body.Bytes(), &entries)
+	assert.Equal(t, 2, len(entries))
+	assert.Equal(t, HistoryActionDrop, entries[0].Action)
+	assert.Equal(t, "ขอถอนรายวิชา", entries[0].Reason)
+
+	w = performRequest(router, "GET", "/history/courses/1?action=add", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	json.Unmarshal(w.Body.Bytes(), &entries)
+	assert.Equal(t, 2, len(entries))
+}
+
+func TestEnrollmentHistory_AppendOnly(t *testing.T) {
+	resetDB()
+	assert.Nil(t, recordHistory(testWriteConn, HistoryEntry{StudentID: 1, CourseID: 1, Action: HistoryActionAdd, Actor: "student:1"}))
+
+	_, err := testWriteConn.Exec(`UPDATE enrollment_history SET action = 'drop' WHERE student_id = 1`)
+	assert.Error(t, err)
+	_, err = testWriteConn.Exec(`DELETE FROM enrollment_history WHERE student_id = 1`)
+	assert.Error(t, err)
+
+	entries, err := queryHistory(testReadConn, "student_id", 1, "", maxHistoryLimit)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(entries))
+	assert.Equal(t, HistoryActionAdd, entries[0].Action)
+}
+
+func TestEnrollmentHistory_InvalidAction(t *testing.T) {
+	resetDB()
+	router := SetupRouter(testDBConns, nil, testAuth)
+
+	w := performRequest(router, "GET", "/history/students/1?action=unknown", nil)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+// ทดสอบ action ในประวัติตามเส้นทางที่เพิ่มรายวิชา: ลงเอง, registrar ลงให้, override และ swap
+func TestEnrollmentHistory_ActionsByPath(t *testing.T) {
+	resetDB()
+	router := SetupRouter(testDBConns, nil, testAuth)
+
+	self := EnrollmentRequest{StudentID: 1, CourseIDs: []int{1}}
+	entries := enrollmentHistoryEntries(self, "student:1")
+	assert.Equal(t, HistoryActionAdd, entries[0].Action)
+
+	onBehalf := EnrollmentRequest{StudentID: 1, CourseIDs: []int{1}, OnBehalf: true}
+	assert.Equal(t, HistoryActionAdminEdit, enrollmentHistoryEntries(onBehalf, "registrar:9")[0].Action)
+
+	override := EnrollmentRequest{StudentID: 2, CourseIDs: []int{2}, Override: true, OnBehalf: true, Reason: "อนุมัติพิเศษ"}
+	assert.Equal(t, HistoryActionOverride, enrollmentHistoryEntries(override, "registrar:9")[0].Action)
+
+	swap := EnrollmentRequest{StudentID: 1, CourseIDs: []int{2}, Swaps: []CourseSwap{{FromCourseID: 1, ToCourseID: 4}}, Reason: "cart checkout"}
+	entries = enrollmentHistoryEntries(swap, "student:1")
+	assert.Len(t, entries, 2)
+	assert.Equal(t, HistoryActionAdd, entries[0].Action)
+	assert.Equal(t, HistoryActionSwap, entries[1].Action)
+	assert.Equal(t, 4, entries[1].CourseID)
+	assert.Equal(t, 1, *entries[1].RelatedCourseID)
+
+	// related_course_id ถูกบันทึกและอ่านกลับได้ และกรองตาม action ใหม่ได้
+	assert.Nil(t, recordHistory(testWriteConn, entries...))
+	w := performRequest(router, "GET", "/history/students/1?action=swap", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var got []HistoryEntry
+	json.Unmarshal(w.Body.Bytes(), &got)
+	assert.Len(t, got, 1)
+	assert.Equal(t, 4, got[0].CourseID)
+	assert.Equal(t, 1, *got[0].RelatedCourseID)
+	w = performRequest(router, "GET", "/history/courses/2?action=admin_edit", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+// ทดสอบ override: registrar ข้ามวิชาบังคับก่อนได้ ส่วนนักเรียนขอ override ไม่ได้
+func TestEnroll_RegistrarOverride(t *testing.T) {
+	resetDB()
+	router := SetupRouter(testDBConns, nil, testAuth)
+
+	// นักเรียน 2 ยังไม่ผ่าน Mathematics ลงวิชา 2 เองไม่ได้
+	w := performRequestWithHeaders(router, "POST", "/enroll", map[string]interface{}{"student_id": 2, "course_ids": []int{2}, "override": true}, asRole(2, auth.RoleStudent))
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	_, err := checkEnrollment(testReadConn, EnrollmentRequest{StudentID: 2, CourseIDs: []int{2}, Override: true})
+	assert.Nil(t, err)
+	_, err = checkEnrollment(testReadConn, EnrollmentRequest{StudentID: 2, CourseIDs: []int{3}, Override: true})
+	assert.NotNil(t, err, "override does not open closed courses")
+
+	// ผ่านการตรวจแล้วไปถึง course-service (broker ไม่พร้อมในเทส)
+	w = performRequest(router, "POST", "/enroll", map[string]interface{}{"student_id": 2, "course_ids": []int{2}, "override": true})
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+}
+
+// ทดสอบ swap: วิชาเดิมต้องลงไว้ และไม่นับเวลาเรียนหรือหน่วยกิตของวิชาเดิม
+func TestEnroll_SwapChecks(t *testing.T) {
+	resetDB()
+	router := SetupRouter(testDBConns, nil, testAuth)
+	testWriteConn.Exec(`INSERT INTO enrollment (student_id, course_id) VALUES (1, ARRAY[1])`)
+
+	// วิชา 4 เวลาชนกับวิชา 1 จึงเพิ่มตรงๆ ไม่ได้ แต่เปลี่ยนจากวิชา 1 ได้
+	_, err := canEnroll(testReadConn, 1, []int{4})
+	assert.NotNil(t, err)
+	_, err = checkEnrollment(testReadConn, EnrollmentRequest{StudentID: 1, Swaps: []CourseSwap{{FromCourseID: 1, ToCourseID: 4}}})
+	assert.Nil(t, err)
+
+	_, err = checkEnrollment(testReadConn, EnrollmentRequest{StudentID: 1, Swaps: []CourseSwap{{FromCourseID: 2, ToCourseID: 4}}})
+	assert.NotNil(t, err, "the replaced course must be enrolled")
+
+	w := performRequest(router, "POST", "/enroll", map[string]interface{}{"student_id": 1, "swaps": []map[string]int{{"from_course_id": 1}}})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = performRequest(router, "POST", "/enroll", map[string]interface{}{"student_id": 1, "swaps": []map[string]int{{"from_course_id": 1, "to_course_id": 4}}})
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+
+	// course-service รุ่นก่อน v3 ถอนรายวิชาไม่ได้
+	t.Setenv("ENROLLMENT_CONTRACT_VERSION", "2")
+	w = performRequest(router, "POST", "/enroll", map[string]interface{}{"student_id": 1, "swaps": []map[string]int{{"from_course_id": 1, "to_course_id": 4}}})
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Contains(t, w.Body.String(), "ENROLLMENT_CONTRACT_VERSION")
+
+	var courses []int64
+	testReadConn.QueryRow(`SELECT course_id FROM enrollment WHERE student_id = 1`).Scan(pq.Array(&courses))
+	assert.Equal(t, []int64{1}, courses)
+}
+
+// 10. ทดสอบ read model ของรายวิชาที่สร้างจาก event ของ course-service
+func TestCourseProjection_ApplyEvents(t *testing.T) {
+	resetDB()
+
+	at := time.Now().UTC()
+	course := CourseSnapshot{
+		CourseID:       5,
+		Subject:        "Chemistry",
+		Credit:         3,
+		DayOfWeek:      "Friday",
+		StartTime:      time.Date(0, 1, 1, 9, 0, 0, 0, time.UTC),
+		EndTime:        time.Date(0, 1, 1, 12, 0, 0, 0, time.UTC),
+		Capacity:       2,
+		State:          "open",
+		CurrentStudent: []string{"7"},
+	}
+
+	err := applyCourseEvent(testWriteConn, CourseEvent{EventID: "e1", Type: "course.created", Version: 1, OccurredAt: at, CourseID: 5, Course: &course})
+	assert.Nil(t, err)
+
+	var seatsTaken, capacity int
+	testWriteConn.QueryRow(`SELECT seats_taken, capacity FROM course_projection WHERE course_id = 5`).Scan(&seatsTaken, &capacity)
+	assert.Equal(t, 1, seatsTaken)
+	assert.Equal(t, 2, capacity)
+
+	// event ที่เก่ากว่าต้องไม่เขียนทับข้อมูลใหม่
+	older := course
+	older.Capacity = 99
+	err = applyCourseEvent(testWriteConn, CourseEvent{EventID: "e0", Type: "course.updated", Version: 1, OccurredAt: at.Add(-time.Minute), CourseID: 5, Course: &older})
+	assert.Nil(t, err)
+	testWriteConn.QueryRow(`SELECT capacity FROM course_projection WHERE course_id = 5`).Scan(&capacity)
+	assert.Equal(t, 2, capacity)
+
+	// ลบวิชาแล้วต้องลงทะเบียนไม่ได้
+	err = applyCourseEvent(testWriteConn, CourseEvent{EventID: "e2", Type: "course.deleted", Version: 1, OccurredAt: at.Add(time.Minute), CourseID: 5})
+	assert.Nil(t, err)
+
+	_, err = canEnroll(testReadConn, 1, []int{5})
+	assert.NotNil(t, err)
+}
+
+func TestCourseProjection_ReconcileWithSnapshot(t *testing.T) {
+	resetDB()
+
+	snapshotAt := time.Now().UTC().Add(time.Second)
+	course := func(id, capacity int, subject string) CourseSnapshot {
+		return CourseSnapshot{
+			CourseID:  id,
+			Subject:   subject,
+			Credit:    3,
+			DayOfWeek: "Monday",
+			StartTime: time.Date(0, 1, 1, 9, 0, 0, 0, time.UTC),
+			EndTime:   time.Date(0, 1, 1, 12, 0, 0, 0, time.UTC),
+			Capacity:  capacity,
+			State:     "open",
+		}
+	}
+	courseService := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(courseSnapshotResponse{
+			SnapshotAt: snapshotAt,
+			Courses:    []CourseSnapshot{course(1, 45, "Math 1"), course(2, 30, "Physics"), course(3, 1, "Com Sci")},
+		})
+	}))
+	defer courseService.Close()
+
+	// event ที่เกิดหลัง snapshot ต้องไม่ถูกย้อนกลับหรือถูกลบ
+	newer := course(5, 10, "Chemistry")
+	assert.Nil(t, applyCourseEvent(testWriteConn, CourseEvent{EventID: "e5", Type: "course.created", Version: 1, OccurredAt: snapshotAt.Add(time.Minute), CourseID: 5, Course: &newer}))
+
+	n, err := reconcileCourseProjection(testWriteConn, courseService.URL)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, n)
+
+	var capacity int
+	testWriteConn.QueryRow(`SELECT capacity FROM course_projection WHERE course_id = 1`).Scan(&capacity)
+	assert.Equal(t, 45, capacity, "missed course.updated is repaired")
+
+	var deleted bool
+	testWriteConn.QueryRow(`SELECT deleted FROM course_projection WHERE course_id = 4`).Scan(&deleted)
+	assert.True(t, deleted, "course missing from the snapshot is tombstoned")
+	testWriteConn.QueryRow(`SELECT deleted FROM course_projection WHERE course_id = 5`).Scan(&deleted)
+	assert.False(t, deleted, "course created after the snapshot is kept")
+}
+
+// rebuild ขอ service token อายุสั้นจาก student-service แล้วดึง snapshot ผ่าน middleware เดียวกับ course-service
+// token ออกให้ audience เดียว และถูกใช้ซ้ำจนใกล้หมดอายุ
+func TestCourseProjection_RebuildWithServiceToken(t *testing.T) {
+	resetDB()
+
+	secretFile := filepath.Join(t.TempDir(), "secret")
+	os.WriteFile(secretFile, []byte("wrong\n"), 0o600)
+
+	tokenRequests := 0
+	studentService := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tokenRequests++
+		var body struct {
+			ClientID     string `json:"client_id"`
+			ClientSecret string `json:"client_secret"`
+			Audience     string `json:"audience"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		if body.ClientID != "enrollment-service" || body.ClientSecret != "s3cret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]any{
+			"access_token": signServiceTestToken(testSigningKey, body.ClientID, body.Audience, 5*time.Minute),
+			"token_type":   "Bearer",
+			"expires_in":   300,
+		})
+	}))
+	defer studentService.Close()
+
+	previous := snapshotTokens
+	snapshotTokens = auth.NewServiceClient(studentService.URL+"/token/service", "enrollment-service", secretFile)
+	t.Cleanup(func() { snapshotTokens = previous })
+
+	snapshotAt := time.Now().UTC()
+	router := gin.New()
+	courseAuth := auth.NewTokenVerifier(testJWKS.URL, "course-service")
+	router.GET("/courses/snapshot", auth.RoleRequired(courseAuth, auth.RoleRegistrar, auth.RoleService), func(c *gin.Context) {
+		c.JSON(http.StatusOK, courseSnapshotResponse{
+			SnapshotAt: snapshotAt,
+			Courses: []CourseSnapshot{{
+				CourseID:  1,
+				Subject:   "Math 1",
+				Credit:    3,
+				DayOfWeek: "Monday",
+				StartTime: time.Date(0, 1, 1, 9, 0, 0, 0, time.UTC),
+				EndTime:   time.Date(0, 1, 1, 12, 0, 0, 0, time.UTC),
+				Capacity:  60,
+				State:     "open",
+			}},
+		})
+	})
+	courseService := httptest.NewServer(router)
+	defer courseService.Close()
+
+	_, err := rebuildCourseProjection(testWriteConn, courseService.URL)
+	assert.ErrorContains(t, err, "status 401", "wrong client secret")
+
+	// เปลี่ยน secret ในไฟล์แล้วใช้ได้ทันที
+	os.WriteFile(secretFile, []byte("s3cret\n"), 0o600)
+
+	var snapshot courseSnapshotResponse
+	err = fetchSnapshot(courseService.URL+"/courses/snapshot", "student-service", &snapshot)
+	assert.ErrorContains(t, err, "status 401", "token issued for another service is rejected")
+
+	n, err := rebuildCourseProjection(testWriteConn, courseService.URL)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, n)
+	requests := tokenRequests
+	_, err = rebuildCourseProjection(testWriteConn, courseService.URL)
+	assert.Nil(t, err)
+	assert.Equal(t, requests, tokenRequests, "service token is reused until it nearly expires")
+
+	var count, capacity int
+	testWriteConn.QueryRow(`SELECT COUNT(*), MAX(capacity) FROM course_projection`).Scan(&count, &capacity)
+	assert.Equal(t, 1, count)
+	assert.Equal(t, 60, capacity)
+}
+
+// 11. ทดสอบ read model ของนักเรียนที่สร้างจาก event ของ student-service
+func TestStudentProjection_GradesChanged(t *testing.T) {
+	resetDB()
+
+	// นักเรียน 2 ยังไม่ผ่าน Mathematics จึงลงวิชา 2 (Physics) ไม่ได้
+	_, err := canEnroll(testReadConn, 2, []int{2})
+	assert.NotNil(t, err)
+
+	err = applyStudentEvent(testWriteConn, StudentEvent{
+		EventID:    "s1",
+		Type:       "student.grades_changed",
+		Version:    1,
+		OccurredAt: time.Now().UTC(),
+		StudentID:  2,
+		Student:    &StudentSnapshot{StudentID: 2, YearLevel: 1, GradedSubject: []string{"Mathematics"}},
+	})
+	assert.Nil(t, err)
+
+	_, err = canEnroll(testReadConn, 2, []int{2})
+	assert.Nil(t, err)
+}
+
+// student.grades_changed ที่หายไประหว่างทางถูกแก้จาก snapshot ตอน reconcile ส่วน event ที่ใหม่กว่า snapshot ไม่ถูกย้อนกลับ
+func TestStudentProjection_ReconcileWithSnapshot(t *testing.T) {
+	resetDB()
+
+	snapshotAt := time.Now().UTC().Add(time.Second)
+	studentService := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(studentSnapshotResponse{
+			SnapshotAt: snapshotAt,
+			Students: []StudentSnapshot{
+				{StudentID: 1, YearLevel: 1, GradedSubject: []string{}},
+				{StudentID: 2, YearLevel: 1, GradedSubject: []string{"Mathematics"}},
+			},
+		})
+	}))
+	defer studentService.Close()
+
+	// นักเรียน 1 ได้ event ที่ใหม่กว่า snapshot แล้ว
+	assert.Nil(t, applyStudentEvent(testWriteConn, StudentEvent{
+		EventID: "s3", Type: "student.grades_changed", Version: 1, OccurredAt: snapshotAt.Add(time.Minute), StudentID: 1,
+		Student: &StudentSnapshot{StudentID: 1, YearLevel: 1, GradedSubject: []string{"Mathematics"}},
+	}))
+
+	n, err := reconcileStudentProjection(testWriteConn, studentService.URL)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, n)
+
+	_, err = canEnroll(testReadConn, 2, []int{2})
+	assert.Nil(t, err, "missed student.grades_changed is repaired")
+	_, err = canEnroll(testReadConn, 1, []int{2})
+	assert.Nil(t, err, "event newer than the snapshot is kept")
+}
+
+func TestStudentProjection_Registered(t *testing.T) {
+	resetDB()
+
+	_, err := canEnroll(testReadConn, 3, []int{1})
+	assert.NotNil(t, err)
+
+	err = applyStudentEvent(testWriteConn, StudentEvent{
+		EventID:    "s2",
+		Type:       "student.registered",
+		Version:    1,
+		OccurredAt: time.Now().UTC(),
+		StudentID:  3,
+		Student:    &StudentSnapshot{StudentID: 3, YearLevel: 1},
+	})
+	assert.Nil(t, err)
+
+	_, err = canEnroll(testReadConn, 3, []int{1})
+	assert.Nil(t, err)
+}
+
+// 12. ทดสอบว่าเมื่อ RabbitMQ ไม่พร้อม จะตอบ 503 ทันทีโดยไม่ retry และไม่บันทึกการลงทะเบียน
+func TestEnroll_BrokerUnavailableFailsFast(t *testing.T) {
+	resetDB()
+	router := SetupRouter(testDBConns, nil, testAuth)
+
+	start := time.Now()
+	body := map[string]interface{}{"student_id": 1, "course_ids": []int{1}}
+	w := performRequest(router, "POST", "/enroll", body)
+
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Less(t, time.Since(start), 2*time.Second)
+
+	var count int
+	testReadConn.QueryRow(`SELECT COUNT(*) FROM enrollment_history WHERE student_id = 1`).Scan(&count)
+	assert.Equal(t, 0, count)
+}
+
+func TestIsBrokerError(t *testing.T) {
+	assert.True(t, isBrokerError(fmt.Errorf("failed to open channel: %w", rabbitmq.ErrUnavailable)))
+	assert.True(t, isBrokerError(fmt.Errorf("%w: NO_ROUTE", errRequestUnroutable)))
+	assert.True(t, isBrokerError(errRequestNacked))
+	assert.False(t, isBrokerError(fmt.Errorf("timeout waiting for response from course service")))
+}
+
+// 13. ทดสอบ contract ของ RPC กับ course-service
+func TestEnrollmentContract_RequestVersions(t *testing.T) {
+	req := EnrollmentRequest{StudentID: 1, CourseIDs: []int{1}, Actor: "admin:7", Reason: "override"}
+
+	body, err := encodeEnrollmentRequest(1, req)
+	assert.Nil(t, err)
+	assert.NotContains(t, string(body), "admin:7")
+
+	body, err = encodeEnrollmentRequest(2, req)
+	assert.Nil(t, err)
+	assert.Contains(t, string(body), `"actor":"admin:7"`)
+
+	// แบบเก่าส่ง payload เปล่าให้ course-service รุ่นเก่า
+	body, err = encodeEnrollmentRequest(contract.LegacyVersion, req)
+	assert.Nil(t, err)
+	assert.JSONEq(t, `{"student_id":1,"course_ids":[1]}`, string(body))
+
+	// course_ids ว่างผิด schema
+	_, err = encodeEnrollmentRequest(2, EnrollmentRequest{StudentID: 1, CourseIDs: []int{}})
+	assert.NotNil(t, err)
+
+	// swap ส่งวิชาใหม่ใน course_ids และวิชาเดิมใน drop_course_ids ได้ตั้งแต่ v3
+	swap := EnrollmentRequest{StudentID: 1, CourseIDs: []int{2}, Swaps: []CourseSwap{{FromCourseID: 1, ToCourseID: 4}}}
+	body, err = encodeEnrollmentRequest(3, swap)
+	assert.Nil(t, err)
+	assert.Contains(t, string(body), `"course_ids":[2,4]`)
+	assert.Contains(t, string(body), `"drop_course_ids":[1]`)
+	_, err = encodeEnrollmentRequest(2, swap)
+	assert.NotNil(t, err)
+}
+
+func TestEnrollmentContract_ResponseMustMatchVersion(t *testing.T) {
+	v2 := []byte(`{"type":"enrollment.response","version":2,"payload":{"success":true,"message":"ok","duplicate":true}}`)
+
+	response, err := decodeEnrollmentResponse(2, v2)
+	assert.Nil(t, err)
+	assert.True(t, response.Duplicate)
+
+	_, err = decodeEnrollmentResponse(1, v2)
+	assert.NotNil(t, err)
+
+	// คำตอบแบบเก่าที่ไม่มี envelope รับได้เมื่อส่งไปเป็นแบบเก่าเท่านั้น
+	legacy := []byte(`{"success":false,"message":"","error":"Course 9 not found"}`)
+	_, err = decodeEnrollmentResponse(2, legacy)
+	assert.NotNil(t, err)
+
+	response, err = decodeEnrollmentResponse(contract.LegacyVersion, legacy)
+	assert.Nil(t, err)
+	assert.False(t, response.Success)
+	assert.Equal(t, "Course 9 not found", response.Error)
+}
+
+// 14. ทดสอบการแปลงรหัสข้อผิดพลาดจาก course service เป็น HTTP status
+func TestErrorCodeMapping(t *testing.T) {
+	assert.Equal(t, http.StatusNotFound, statusForErrorCode(ErrCodeCourseNotFound))
+	assert.Equal(t, http.StatusConflict, statusForErrorCode(ErrCodeCourseFull))
+	assert.Equal(t, http.StatusConflict, statusForErrorCode(ErrCodeCourseClosed))
+	assert.Equal(t, http.StatusConflict, statusForErrorCode(ErrCodeAlreadyEnrolled))
+	assert.Equal(t, http.StatusConflict, statusForErrorCode(ErrCodeNotEnrolled))
+	assert.Equal(t, http.StatusInternalServerError, statusForErrorCode(ErrCodeInternal))
+
+	// รหัสทางธุรกิจไม่ต้อง retry ส่วน INTERNAL_ERROR และคำตอบ v1 ที่ไม่มีรหัสยัง retry ได้
+	assert.True(t, isBusinessRejection(ErrCodeCourseFull))
+	assert.False(t, isBusinessRejection(ErrCodeInternal))
+	assert.False(t, isBusinessRejection(""))
+}
+
+// seatHoldStub แทน endpoint /holds ของ course-service ถือที่นั่งได้ทุกวิชายกเว้นวิชาใน full
+// seatHoldStub จำลอง POST/DELETE /holds ของ course-service: hold ที่ยังอยู่ของนักเรียนในวิชาเดิมถูกต่ออายุด้วย hold_id เดิม
+// ลบออกจาก holds เพื่อจำลอง hold ที่หมดอายุ
+type seatHoldStub struct {
+	mu       sync.Mutex
+	full     map[int]bool
+	holds    map[[2]int]int
+	nextID   int
+	released []int
+	auth     string
+}
+
+func startSeatHoldStub(t *testing.T, full ...int) *seatHoldStub {
+	stub := &seatHoldStub{full: map[int]bool{}, holds: map[[2]int]int{}}
+	for _, id := range full {
+		stub.full[id] = true
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		stub.mu.Lock()
+		defer stub.mu.Unlock()
+		stub.auth = r.Header.Get("Authorization")
+
+		if r.Method == http.MethodDelete {
+			id, _ := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/holds/"))
+			stub.released = append(stub.released, id)
+			for key, holdID := range stub.holds {
+				if holdID == id {
+					delete(stub.holds, key)
+				}
+			}
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		var body struct {
+			StudentID int   `json:"student_id"`
+			CourseIDs []int `json:"course_ids"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		courseID := body.CourseIDs[0]
+		w.Header().Set("Content-Type", "application/json")
+		if stub.full[courseID] {
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(map[string]interface{}{"error": "Course is full", "code": ErrCodeCourseFull, "course_id": courseID})
+			return
+		}
+		key := [2]int{body.StudentID, courseID}
+		if _, ok := stub.holds[key]; !ok {
+			stub.nextID++
+			stub.holds[key] = stub.nextID
+		}
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]interface{}{"holds": []seatHold{{
+			HoldID: stub.holds[key], CourseID: courseID, Status: "held", ExpiresAt: time.Now().Add(10 * time.Minute),
+		}}})
+	}))
+	t.Cleanup(server.Close)
+	t.Setenv("COURSE_SERVICE_URL", server.URL)
+	return stub
+}
+
+// 15. ทดสอบตะกร้าลงทะเบียน: เพิ่ม/ลบ และผลตรวจ canEnroll ทั้งรายวิชาและทั้งตะกร้า
+func TestCart_AddRemoveAndValidate(t *testing.T) {
+	resetDB()
+	stub := startSeatHoldStub(t, 2)
+	router := SetupRouter(testDBConns, nil, testAuth)
+
+	w := performRequest(router, "POST", "/cart/1/items", map[string]int{"course_id": 1})
+	assert.Equal(t, http.StatusCreated, w.Code)
+	assert.Equal(t, "Bearer "+testAccessToken, stub.auth, "hold is taken with the caller's token")
+	w = performRequest(router, "POST", "/cart/1/items", map[string]int{"course_id": 1})
+	assert.Equal(t, http.StatusConflict, w.Code)
+	w = performRequest(router, "POST", "/cart/1/items", map[string]int{"course_id": 999})
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	// ถือที่นั่งไม่ได้ (วิชาเต็ม) จะไม่ถูกเพิ่มลงตะกร้า
+	w = performRequest(router, "POST", "/cart/1/items", map[string]int{"course_id": 2})
+	assert.Equal(t, http.StatusConflict, w.Code)
+	assert.Contains(t, w.Body.String(), ErrCodeCourseFull)
+
+	// วิชา 4 ลงได้ถ้าลงเดี่ยว แต่เวลาชนกับวิชา 1 ในตะกร้า
+	w = performRequest(router, "POST", "/cart/1/items", map[string]int{"course_id": 4})
+	assert.Equal(t, http.StatusCreated, w.Code)
+
+	w = performRequest(router, "GET", "/cart/1", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var cart Cart
+	json.Unmarshal(w.Body.Bytes(), &cart)
+	assert.Len(t, cart.Items, 2)
+	assert.NotNil(t, cart.Items[0].HoldID)
+	assert.NotNil(t, cart.Items[0].HoldExpiresAt)
+	assert.True(t, cart.Items[0].CanEnroll)
+	assert.True(t, cart.Items[1].CanEnroll)
+	assert.False(t, cart.CanEnroll)
+	assert.Contains(t, cart.Error, "ทับซ้อน")
+
+	w = performRequest(router, "DELETE", "/cart/1/items/4", nil)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.Equal(t, []int{2}, stub.released, "removing an item releases its seat hold")
+	w = performRequest(router, "DELETE", "/cart/1/items/4", nil)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	w = performRequest(router, "GET", "/cart/1", nil)
+	json.Unmarshal(w.Body.Bytes(), &cart)
+	assert.Len(t, cart.Items, 1)
+	assert.True(t, cart.CanEnroll)
+}
+
+func TestCart_Checkout(t *testing.T) {
+	resetDB()
+	startSeatHoldStub(t)
+	router := SetupRouter(testDBConns, nil, testAuth)
+
+	w := performRequest(router, "POST", "/cart/1/checkout", nil)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	// ตะกร้าไม่ผ่านเงื่อนไข (วิชาปิด) จะไม่ลงทะเบียนวิชาใดเลยและตะกร้ายังอยู่
+	performRequest(router, "POST", "/cart/1/items", map[string]int{"course_id": 1})
+	performRequest(router, "POST", "/cart/1/items", map[string]int{"course_id": 3})
+	w = performRequest(router, "POST", "/cart/1/checkout", nil)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	// broker ไม่พร้อม: ไม่บันทึกการลงทะเบียนและไม่ล้างตะกร้า
+	performRequest(router, "DELETE", "/cart/1/items/3", nil)
+	w = performRequest(router, "POST", "/cart/1/checkout", nil)
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+
+	var count int
+	testReadConn.QueryRow(`SELECT COUNT(*) FROM enrollment WHERE student_id = 1`).Scan(&count)
+	assert.Equal(t, 0, count)
+	testReadConn.QueryRow(`SELECT COUNT(*) FROM enrollment_cart WHERE student_id = 1`).Scan(&count)
+	assert.Equal(t, 1, count)
+}
+
+// ทดสอบการต่ออายุ seat hold ตอนดูตะกร้าและตอน checkout: hold เดิมต่ออายุ, hold ที่หมดอายุถือใหม่,
+// ถือใหม่ไม่ได้ (วิชาเต็มแล้ว) แจ้งรายวิชาและ checkout ไม่ได้
+func TestCart_RenewsAndReacquiresHolds(t *testing.T) {
+	resetDB()
+	stub := startSeatHoldStub(t)
+	router := SetupRouter(testDBConns, nil, testAuth)
+	performRequest(router, "POST", "/cart/1/items", map[string]int{"course_id": 1})
+	performRequest(router, "POST", "/cart/1/items", map[string]int{"course_id": 2})
+	testWriteConn.Exec(`UPDATE enrollment_cart SET hold_expires_at = NOW() - INTERVAL '1 minute' WHERE student_id = 1`)
+
+	w := performRequest(router, "GET", "/cart/1", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var cart Cart
+	json.Unmarshal(w.Body.Bytes(), &cart)
+	assert.Len(t, cart.Items, 2)
+	assert.Equal(t, CartHoldHeld, cart.Items[0].HoldStatus)
+	assert.Equal(t, 1, *cart.Items[0].HoldID)
+	assert.True(t, cart.Items[0].HoldExpiresAt.After(time.Now()), "renewed hold expiry is saved in the response")
+
+	var expiresAt time.Time
+	testReadConn.QueryRow(`SELECT hold_expires_at FROM enrollment_cart WHERE student_id = 1 AND course_id = 1`).Scan(&expiresAt)
+	assert.True(t, expiresAt.After(time.Now()), "renewed hold expiry is saved in the cart")
+
+	// hold ของวิชา 1 หมดอายุใน course-service: ถือที่นั่งใหม่ได้ hold_id ใหม่
+	// วิชา 2 หมดอายุและเต็มแล้ว: แจ้ง expired พร้อมเหตุผล
+	stub.mu.Lock()
+	delete(stub.holds, [2]int{1, 1})
+	delete(stub.holds, [2]int{1, 2})
+	stub.full[2] = true
+	stub.mu.Unlock()
+
+	w = performRequest(router, "GET", "/cart/1", nil)
+	json.Unmarshal(w.Body.Bytes(), &cart)
+	assert.Equal(t, CartHoldReacquired, cart.Items[0].HoldStatus)
+	assert.Equal(t, 3, *cart.Items[0].HoldID)
+	assert.Equal(t, CartHoldExpired, cart.Items[1].HoldStatus)
+	assert.Equal(t, ErrCodeCourseFull, cart.Items[1].HoldCode)
+	assert.NotEmpty(t, cart.Items[1].HoldError)
+	var holdID int
+	testReadConn.QueryRow(`SELECT hold_id FROM enrollment_cart WHERE student_id = 1 AND course_id = 1`).Scan(&holdID)
+	assert.Equal(t, 3, holdID)
+
+	// checkout ไม่ลงทะเบียนเมื่อมีวิชาที่ถือที่นั่งใหม่ไม่ได้ และแจ้งรายวิชา
+	w = performRequest(router, "POST", "/cart/1/checkout", nil)
+	assert.Equal(t, http.StatusConflict, w.Code)
+	var body struct {
+		Items []CartItem `json:"items"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &body)
+	assert.Len(t, body.Items, 2)
+	assert.Equal(t, CartHoldHeld, body.Items[0].HoldStatus)
+	assert.Equal(t, CartHoldExpired, body.Items[1].HoldStatus)
+	var count int
+	testReadConn.QueryRow(`SELECT COUNT(*) FROM enrollment WHERE student_id = 1`).Scan(&count)
+	assert.Equal(t, 0, count)
+}
+
+// ทดสอบวิชาในตะกร้าที่มาแทนวิชาที่ลงไว้แล้ว (swap ตอน checkout)
+func TestCart_ReplacementItem(t *testing.T) {
+	resetDB()
+	startSeatHoldStub(t)
+	router := SetupRouter(testDBConns, nil, testAuth)
+	testWriteConn.Exec(`INSERT INTO enrollment (student_id, course_id) VALUES (1, ARRAY[1])`)
+
+	w := performRequest(router, "POST", "/cart/1/items", map[string]int{"course_id": 4, "replaces_course_id": 2})
+	assert.Equal(t, http.StatusConflict, w.Code)
+	assert.Contains(t, w.Body.String(), ErrCodeNotEnrolled)
+
+	// วิชา 4 เวลาชนกับวิชา 1 แต่มาแทนวิชา 1 จึงผ่าน
+	w = performRequest(router, "POST", "/cart/1/items", map[string]int{"course_id": 4, "replaces_course_id": 1})
+	assert.Equal(t, http.StatusCreated, w.Code)
+	w = performRequest(router, "POST", "/cart/1/items", map[string]int{"course_id": 2, "replaces_course_id": 1})
+	assert.Equal(t, http.StatusConflict, w.Code, "a course is replaced by one cart item only")
+
+	w = performRequest(router, "GET", "/cart/1", nil)
+	var cart Cart
+	json.Unmarshal(w.Body.Bytes(), &cart)
+	assert.Len(t, cart.Items, 1)
+	assert.Equal(t, 1, *cart.Items[0].ReplacesCourseID)
+	assert.True(t, cart.Items[0].CanEnroll)
+	assert.True(t, cart.CanEnroll)
+
+	req := cartEnrollmentRequest(1, cart.Items)
+	assert.Empty(t, req.CourseIDs)
+	assert.Equal(t, []CourseSwap{{FromCourseID: 1, ToCourseID: 4}}, req.Swaps)
+
+	// checkout ไม่สำเร็จ (broker ไม่พร้อม) วิชาเดิมยังอยู่และไม่มีประวัติ
+	w = performRequest(router, "POST", "/cart/1/checkout", nil)
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	var courses []int64
+	testReadConn.QueryRow(`SELECT course_id FROM enrollment WHERE student_id = 1`).Scan(pq.Array(&courses))
+	assert.Equal(t, []int64{1}, courses)
+	var count int
+	testReadConn.QueryRow(`SELECT COUNT(*) FROM enrollment_history WHERE student_id = 1`).Scan(&count)
+	assert.Equal(t, 0, count)
+}
+
+// 16. ทดสอบการถอนนักเรียนเมื่อรายวิชาถูกยกเลิก
+func TestCourseCancelled_UnenrollsStudents(t *testing.T) {
+	resetDB()
+	testWriteConn.Exec(`INSERT INTO enrollment (student_id, course_id) VALUES (1, ARRAY[1, 2]), (2, ARRAY[1]), (3, ARRAY[2])`)
+
+	event := CourseEvent{EventID: "c1", Type: "course.cancelled", Version: 1, OccurredAt: time.Now().UTC(), CourseID: 1, Reason: "instructor unavailable"}
+	err := handleCourseCancelled(testWriteConn, nil, event)
+	assert.Nil(t, err)
+
+	var remaining int
+	testReadConn.QueryRow(`SELECT COUNT(*) FROM enrollment WHERE 1 = ANY(course_id)`).Scan(&remaining)
+	assert.Equal(t, 0, remaining)
+
+	entries, err := queryHistory(testReadConn, "course_id", 1, HistoryActionDrop, 10)
+	assert.Nil(t, err)
+	assert.Len(t, entries, 2)
+	assert.Equal(t, courseCancelledActor, entries[0].Actor)
+	assert.Equal(t, "course cancelled: instructor unavailable", entries[0].Reason)
+
+	// การแจ้งเตือนถูกบันทึกลง outbox พร้อมการถอน รอ relay ส่งออก
+	var notified []int64
+	testReadConn.QueryRow(`SELECT array_agg(student_id ORDER BY student_id) FROM enrollment_event_outbox
+		WHERE event_type = $1 AND course_id = 1 AND published_at IS NULL`, EventEnrollmentCourseCancelled).Scan(pq.Array(&notified))
+	assert.Equal(t, []int64{1, 2}, notified)
+
+	// event ซ้ำต้องไม่บันทึกประวัติหรือแจ้งเตือนซ้ำ
+	students, err := unenrollFromCourse(testWriteConn, event, HistoryActionDrop, courseCancelledActor, "course cancelled: instructor unavailable", EventEnrollmentCourseCancelled)
+	assert.Nil(t, err)
+	assert.Empty(t, students)
+	var count int
+	testReadConn.QueryRow(`SELECT COUNT(*) FROM enrollment_event_outbox`).Scan(&count)
+	assert.Equal(t, 2, count)
+
+	// broker ไม่พร้อม: การแจ้งเตือนยังค้างอยู่ ส่งได้เมื่อ broker ยืนยัน
+	n, err := relayOutbox(testWriteConn, func(outboxEvent) error { return rabbitmq.ErrUnavailable })
+	assert.NotNil(t, err)
+	assert.Equal(t, 0, n)
+	var sent []EnrollmentEvent
+	n, err = relayOutbox(testWriteConn, func(e outboxEvent) error {
+		var notification EnrollmentEvent
+		json.Unmarshal(e.Payload, &notification)
+		sent = append(sent, notification)
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, n)
+	assert.Equal(t, "instructor unavailable", sent[0].Reason)
+	testReadConn.QueryRow(`SELECT COUNT(*) FROM enrollment_event_outbox WHERE published_at IS NULL`).Scan(&count)
+	assert.Equal(t, 0, count)
+}
+
+func TestStudentsRemoved_UnenrollsOnlyListedStudents(t *testing.T) {
+	resetDB()
+	testWriteConn.Exec(`INSERT INTO enrollment (student_id, course_id) VALUES (1, ARRAY[1]), (2, ARRAY[1, 2])`)
+
+	event := CourseEvent{EventID: "r1", Type: "course.students_removed", Version: 1, OccurredAt: time.Now().UTC(), CourseID: 1, Reason: "capacity reduced from 30 to 1", StudentIDs: []int{2}}
+	assert.Nil(t, handleStudentsRemoved(testWriteConn, nil, event))
+
+	var courses []int64
+	testReadConn.QueryRow(`SELECT course_id FROM enrollment WHERE student_id = 2`).Scan(pq.Array(&courses))
+	assert.Equal(t, []int64{2}, courses)
+	testReadConn.QueryRow(`SELECT course_id FROM enrollment WHERE student_id = 1`).Scan(pq.Array(&courses))
+	assert.Equal(t, []int64{1}, courses)
+
+	// นักเรียนไม่ได้ถอนเอง จึงบันทึกเป็น admin_edit ไม่ใช่ drop
+	entries, _ := queryHistory(testReadConn, "student_id", 2, HistoryActionAdminEdit, 10)
+	assert.Len(t, entries, 1)
+	assert.Equal(t, capacityReducedActor, entries[0].Actor)
+	assert.Equal(t, "capacity reduced from 30 to 1", entries[0].Reason)
+	entries, _ = queryHistory(testReadConn, "student_id", 2, HistoryActionDrop, 10)
+	assert.Empty(t, entries)
+
+	var notified []int64
+	testReadConn.QueryRow(`SELECT array_agg(student_id) FROM enrollment_event_outbox WHERE event_type = $1`, EventEnrollmentRemovedOverCapacity).Scan(pq.Array(&notified))
+	assert.Equal(t, []int64{2}, notified)
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/lib/pq"
+	amqp "github.com/rabbitmq/amqp091-go"
+
+	"shared/auth"
+	"shared/rabbitmq"
+)
+
+// exchange และ queue สำหรับรับ event ของรายวิชาจาก course-service
+const (
+	courseEventsExchange           = "course_events"
+	courseProjectionQueue          = "enrollment.course_events"
+	courseEventBindingKey          = "course.#"
+	courseEventDeletedType         = "course.deleted"
+	courseEventCancelledType       = "course.cancelled"
+	courseEventStudentsRemovedType = "course.students_removed"
+)
+
+// CourseSnapshot ข้อมูลรายวิชาตามที่ course-service ส่งมา (ตรงกับ Course ของ course-service)
+type CourseSnapshot struct {
+	CourseID       int       `json:"course_id"`
+	Subject        string    `json:"subject"`
+	Credit         int       `json:"credit"`
+	Section        []string  `json:"section"`
+	DayOfWeek      string    `json:"day_of_week"`
+	StartTime      time.Time `json:"start_time"`
+	EndTime        time.Time `json:"end_time"`
+	Capacity       int       `json:"capacity"`
+	State          string    `json:"state"`
+	CurrentStudent []string  `json:"current_student"`
+	Prerequisite   []string  `json:"prerequisite"`
+}
+
+// CourseEvent event จาก course-service (schema v1)
+type CourseEvent struct {
+	EventID    string          `json:"event_id"`
+	Type       string          `json:"type"`
+	Version    int             `json:"version"`
+	OccurredAt time.Time       `json:"occurred_at"`
+	CourseID   int             `json:"course_id"`
+	Course     *CourseSnapshot `json:"course,omitempty"`
+	Reason     string          `json:"reason,omitempty"`      // course.cancelled, course.students_removed
+	StudentIDs []int           `json:"student_ids,omitempty"` // course.students_removed
+}
+
+// projectionExecer ใช้ได้ทั้ง *sql.DB และ *sql.Tx
+type projectionExecer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// upsertCourseProjection บันทึก snapshot ของรายวิชา
+// จะเขียนทับก็ต่อเมื่อข้อมูลใหม่กว่าข้อมูลเดิม เพื่อกัน event ที่มาไม่เรียงลำดับ
+func upsertCourseProjection(db projectionExecer, course CourseSnapshot, at time.Time) error {
+	_, err := db.Exec(`INSERT INTO course_projection
+			(course_id, subject, credit, capacity, seats_taken, prerequisite, day_of_week, start_time, end_time, state, deleted, last_event_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8::TIME, $9::TIME, $10, FALSE, $11)
+		ON CONFLICT (course_id) DO UPDATE SET
+			subject       = EXCLUDED.subject,
+			credit        = EXCLUDED.credit,
+			capacity      = EXCLUDED.capacity,
+			seats_taken   = EXCLUDED.seats_taken,
+			prerequisite  = EXCLUDED.prerequisite,
+			day_of_week   = EXCLUDED.day_of_week,
+			start_time    = EXCLUDED.start_time,
+			end_time      = EXCLUDED.end_time,
+			state         = EXCLUDED.state,
+			deleted       = FALSE,
+			last_event_at = EXCLUDED.last_event_at
+		WHERE course_projection.last_event_at <= EXCLUDED.last_event_at`,
+		course.CourseID,
+		course.Subject,
+		course.Credit,
+		course.Capacity,
+		len(course.CurrentStudent),
+		pq.Array(course.Prerequisite),
+		course.DayOfWeek,
+		course.StartTime.Format("15:04:05"),
+		course.EndTime.Format("15:04:05"),
+		course.State,
+		at,
+	)
+	return err
+}
+
+// markCourseProjectionDeleted ทำ tombstone แทนการลบจริง เพื่อไม่ให้ event เก่าที่มาช้าสร้างแถวกลับมาใหม่
+func markCourseProjectionDeleted(db projectionExecer, courseID int, at time.Time) error {
+	_, err := db.Exec(`UPDATE course_projection SET deleted = TRUE, last_event_at = $2
+		WHERE course_id = $1 AND last_event_at <= $2`, courseID, at)
+	return err
+}
+
+// applyCourseEvent อัพเดท read model ตาม event 1 รายการ
+func applyCourseEvent(db projectionExecer, event CourseEvent) error {
+	if event.Type == courseEventDeletedType {
+		return markCourseProjectionDeleted(db, event.CourseID, event.OccurredAt)
+	}
+	if event.Course == nil {
+		return fmt.Errorf("event %s (%s) has no course data", event.EventID, event.Type)
+	}
+	return upsertCourseProjection(db, *event.Course, event.OccurredAt)
+}
+
+// declareCourseProjectionQueue ประกาศ exchange/queue และ bind เพื่อรับ event ของรายวิชาทั้งหมด
+func declareCourseProjectionQueue(ch *amqp.Channel) error {
+	return declareProjectionQueue(ch, courseEventsExchange, courseProjectionQueue, courseEventBindingKey)
+}
+
+// declareProjectionQueue ประกาศ topic exchange ของ service ต้นทาง และ queue ของเราที่ bind ไว้
+func declareProjectionQueue(ch *amqp.Channel, exchange, queue, bindingKey string) error {
+	if err := ch.ExchangeDeclare(exchange, "topic", true, false, false, false, nil); err != nil {
+		return err
+	}
+	if _, err := ch.QueueDeclare(queue, true, false, false, false, nil); err != nil {
+		return err
+	}
+	return ch.QueueBind(queue, bindingKey, exchange, false, nil)
+}
+
+// startCourseProjectionConsumer รับ event ของรายวิชาแล้วอัพเดท course_projection
+// course.cancelled และ course.students_removed จะถอนนักเรียนออกจากรายวิชานั้นด้วย
+func startCourseProjectionConsumer(db *sql.DB, rabbit *rabbitmq.Connection, events *EventPublisher) error {
+	return startProjectionConsumer(rabbit, "Course Projection", courseProjectionQueue, declareCourseProjectionQueue, func(body []byte) (bool, error) {
+		var event CourseEvent
+		if err := json.Unmarshal(body, &event); err != nil {
+			return false, fmt.Errorf("invalid event: %v", err)
+		}
+		if err := applyCourseEvent(db, event); err != nil {
+			return true, fmt.Errorf("failed to apply %s for course %d: %v", event.Type, event.CourseID, err)
+		}
+		switch event.Type {
+		case courseEventCancelledType:
+			if err := handleCourseCancelled(db, events, event); err != nil {
+				return true, err
+			}
+		case courseEventStudentsRemovedType:
+			if err := handleStudentsRemoved(db, events, event); err != nil {
+				return true, err
+			}
+		}
+		return false, nil
+	})
+}
+
+// startProjectionConsumer วนรับข้อความจาก queue แล้วส่งให้ apply (เริ่มใหม่ทุกครั้งที่เชื่อมต่อใหม่หรือ channel ถูกปิด)
+// apply คืน error และบอกว่าควร requeue หรือไม่ (ข้อความเสียไม่ต้อง requeue)
+func startProjectionConsumer(rabbit *rabbitmq.Connection, name, queue string, declare func(*amqp.Channel) error, apply func([]byte) (bool, error)) error {
+	return rabbit.OnChannel(name, func(ch *amqp.Channel) error {
+		if err := declare(ch); err != nil {
+			return fmt.Errorf("%s queue declaration: %v", name, err)
+		}
+
+		msgs, err := ch.Consume(
+			queue, // queue
+			"",    // consumer tag
+			false, // auto-ack
+			false, // exclusive
+			false, // no-local
+			false, // no-wait
+			nil,   // args
+		)
+		if err != nil {
+			return fmt.Errorf("failed to register %s consumer: %v", name, err)
+		}
+
+		log.Printf("%s: Waiting for events...", name)
+
+		go func() {
+			// msgs ถูกปิดเมื่อ channel หรือ connection หลุด (OnChannel จะเปิด channel และเริ่ม consumer ใหม่)
+			defer log.Printf("%s: consumer stopped", name)
+			for d := range msgs {
+				if requeue, err := apply(d.Body); err != nil {
+					log.Printf("%s: %v", name, err)
+					d.Nack(false, requeue)
+					continue
+				}
+				d.Ack(false)
+			}
+		}()
+		return nil
+	})
+}
+
+// courseServiceURL ที่อยู่ของ course-service สำหรับดึง snapshot
+func courseServiceURL() string {
+	url := os.Getenv("COURSE_SERVICE_URL")
+	if url == "" {
+		url = "http://localhost:8000"
+	}
+	return url
+}
+
+// snapshotTokens ขอ service token จาก student-service สำหรับดึง snapshot (nil ถ้าไม่ได้ตั้ง SERVICE_CLIENT_ID / SERVICE_CLIENT_SECRET_FILE)
+var snapshotTokens = auth.ServiceClientFromEnv()
+
+// fetchSnapshot ดึง snapshot (JSON) จาก service ต้นทาง
+// snapshot เปิดให้เฉพาะ registrar/admin หรือ service ภายใน จึงแนบ service token อายุสั้นที่ออกให้ audience (service ต้นทาง) ไปด้วย
+func fetchSnapshot(url, audience string, out interface{}) error {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return fmt.Errorf("failed to fetch snapshot: %v", err)
+	}
+	if snapshotTokens != nil {
+		token, err := snapshotTokens.Token(audience)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to fetch snapshot: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("snapshot %s returned status %d", url, resp.StatusCode)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("failed to decode snapshot: %v", err)
+	}
+	return nil
+}
+
+// courseSnapshotResponse ผลของ GET /courses/snapshot
+type courseSnapshotResponse struct {
+	SnapshotAt time.Time        `json:"snapshot_at"`
+	Courses    []CourseSnapshot `json:"courses"`
+}
+
+// rebuildCourseProjection ดึง snapshot จาก course-service แล้วสร้าง course_projection ใหม่ทั้งหมดใน transaction เดียว
+func rebuildCourseProjection(db *sql.DB, baseURL string) (int, error) {
+	var snapshot courseSnapshotResponse
+	if err := fetchSnapshot(baseURL+"/courses/snapshot", "course-service", &snapshot); err != nil {
+		return 0, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM course_projection`); err != nil {
+		return 0, err
+	}
+	for _, course := range snapshot.Courses {
+		if err := upsertCourseProjection(tx, course, snapshot.SnapshotAt); err != nil {
+			return 0, fmt.Errorf("failed to store course %d: %v", course.CourseID, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	return len(snapshot.Courses), nil
+}
+
+// reconcileCourseProjection เทียบ course_projection กับ snapshot ล่าสุดโดยไม่ลบทั้งตาราง
+// แถวจะถูกเขียนทับก็ต่อเมื่อเก่ากว่า snapshot และรายวิชาที่ไม่มีใน snapshot แล้วจะถูกทำ tombstone
+// event ที่เกิดหลัง snapshot จึงไม่ถูกย้อนกลับ ส่วน event ที่หายไปจะถูกแก้ให้ตรงกับ course-service
+func reconcileCourseProjection(db *sql.DB, baseURL string) (int, error) {
+	var snapshot courseSnapshotResponse
+	if err := fetchSnapshot(baseURL+"/courses/snapshot", "course-service", &snapshot); err != nil {
+		return 0, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	courseIDs := make([]int64, 0, len(snapshot.Courses))
+	for _, course := range snapshot.Courses {
+		if err := upsertCourseProjection(tx, course, snapshot.SnapshotAt); err != nil {
+			return 0, fmt.Errorf("failed to store course %d: %v", course.CourseID, err)
+		}
+		courseIDs = append(courseIDs, int64(course.CourseID))
+	}
+	_, err = tx.Exec(`UPDATE course_projection SET deleted = TRUE, last_event_at = $2
+		WHERE NOT deleted AND course_id <> ALL($1) AND last_event_at <= $2`,
+		pq.Array(courseIDs), snapshot.SnapshotAt)
+	if err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	return len(snapshot.Courses), nil
+}
+
+// startProjectionReconciler เรียก reconcile เป็นระยะ (PROJECTION_RECONCILE_INTERVAL ค่าเริ่มต้น 10 นาที)
+// เพื่อไม่ให้ read model ค้างผิดไปตลอดถ้า event บางรายการหายไประหว่างทาง
+func startProjectionReconciler(name string, reconcile func() (int, error)) {
+	interval := 10 * time.Minute
+	if v, err := time.ParseDuration(os.Getenv("PROJECTION_RECONCILE_INTERVAL")); err == nil && v > 0 {
+		interval = v
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			n, err := reconcile()
+			if err != nil {
+				log.Printf("%s: reconcile failed: %v", name, err)
+				continue
+			}
+			log.Printf("%s: reconciled with snapshot (%d rows)", name, n)
+		}
+	}()
+}
+
+// ensureProjection ถ้า read model ยังว่าง (เช่นเพิ่งเริ่มระบบครั้งแรก) ให้ rebuild จาก snapshot
+// ทำงานเบื้องหลังและลองใหม่จนกว่า service ต้นทางจะพร้อม
+func ensureProjection(db *sql.DB, name, table string, rebuild func() (int, error)) {
+	go func() {
+		var count int
+		if err := db.QueryRow(fmt.Sprintf(`SELECT COUNT(*) FROM %s`, table)).Scan(&count); err != nil {
+			log.Printf("%s: failed to check projection: %v", name, err)
+			return
+		}
+		if count > 0 {
+			return
+		}
+
+		for i := 0; i < 10; i++ {
+			n, err := rebuild()
+			if err == nil {
+				log.Printf("%s: rebuilt from snapshot (%d rows)", name, n)
+				return
+			}
+			log.Printf("%s: rebuild failed, retrying in 5s... (%d/10): %v", name, i+1, err)
+			time.Sleep(5 * time.Second)
+		}
+	}()
+}
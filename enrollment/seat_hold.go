@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// seatHold hold ที่นั่งใน course-service (POST /holds) ของรายวิชาในตะกร้า
+// hold ถูก confirm ตอน checkout โดย course-service ใน transaction เดียวกับการลงทะเบียน
+type seatHold struct {
+	HoldID    int       `json:"hold_id"`
+	CourseID  int       `json:"course_id"`
+	Status    string    `json:"status"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+var seatHoldClient = &http.Client{Timeout: 5 * time.Second}
+
+// callSeatHolds เรียก endpoint ของ seat hold ใน course-service ด้วย token ของผู้เรียก
+// (course-service ให้นักเรียนจัดการได้เฉพาะ hold ของตัวเอง หรือ registrar จัดการแทน)
+func callSeatHolds(method, url, authorization string, body interface{}) (*http.Response, error) {
+	var payload []byte
+	if body != nil {
+		var err error
+		if payload, err = json.Marshal(body); err != nil {
+			return nil, err
+		}
+	}
+	req, err := http.NewRequest(method, url, bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
+	return seatHoldClient.Do(req)
+}
+
+// holdCourseSeat ถือที่นั่งของรายวิชาให้นักเรียน ถ้าถืออยู่แล้ว course-service จะต่ออายุให้
+// คืน rejection (สถานะและรหัสจาก course-service) เมื่อถือไม่ได้ตามเงื่อนไข เช่นวิชาเต็มหรือปิด
+func holdCourseSeat(baseURL, authorization string, studentID, courseID int) (*seatHold, *EnrollmentResult, error) {
+	resp, err := callSeatHolds(http.MethodPost, baseURL+"/holds", authorization, map[string]interface{}{
+		"student_id": studentID,
+		"course_ids": []int{courseID},
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to hold seat: %v", err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusCreated:
+		var created struct {
+			Holds []seatHold `json:"holds"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&created); err != nil || len(created.Holds) != 1 {
+			return nil, nil, fmt.Errorf("unexpected seat hold response from course service")
+		}
+		return &created.Holds[0], nil, nil
+	case http.StatusNotFound, http.StatusConflict:
+		rejection := &EnrollmentResult{StudentID: studentID, CourseIDs: []int{courseID}, Status: resp.StatusCode}
+		if err := json.NewDecoder(resp.Body).Decode(rejection); err != nil {
+			return nil, nil, fmt.Errorf("unexpected seat hold response from course service")
+		}
+		rejection.Status = resp.StatusCode
+		return nil, rejection, nil
+	default:
+		return nil, nil, fmt.Errorf("course service returned status %d for seat hold", resp.StatusCode)
+	}
+}
+
+// releaseCourseSeat คืนที่นั่งที่ถือไว้ hold ที่หมดอายุหรือถูกใช้ไปแล้ว (404/409) ถือว่าคืนแล้ว
+func releaseCourseSeat(baseURL, authorization string, holdID int) error {
+	resp, err := callSeatHolds(http.MethodDelete, fmt.Sprintf("%s/holds/%d", baseURL, holdID), authorization, nil)
+	if err != nil {
+		return fmt.Errorf("failed to release seat hold %d: %v", holdID, err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusNotFound, http.StatusConflict:
+		return nil
+	default:
+		return fmt.Errorf("course service returned status %d for releasing seat hold %d", resp.StatusCode, holdID)
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/lib/pq"
+	amqp "github.com/rabbitmq/amqp091-go"
+
+	"shared/rabbitmq"
+)
+
+// exchange และ queue สำหรับรับ event ของนักเรียนจาก student-service
+const (
+	studentEventsExchange  = "student_events"
+	studentProjectionQueue = "enrollment.student_events"
+	studentEventBindingKey = "student.#"
+)
+
+// StudentSnapshot ข้อมูลนักเรียนตามที่ student-service ส่งมา (เฉพาะส่วนที่ใช้ตรวจสอบการลงทะเบียน)
+type StudentSnapshot struct {
+	StudentID     int      `json:"student_id"`
+	YearLevel     int      `json:"year_level"`
+	GradedSubject []string `json:"graded_subject"`
+}
+
+// StudentEvent event จาก student-service (schema v1)
+type StudentEvent struct {
+	EventID    string           `json:"event_id"`
+	Type       string           `json:"type"`
+	Version    int              `json:"version"`
+	OccurredAt time.Time        `json:"occurred_at"`
+	StudentID  int              `json:"student_id"`
+	Student    *StudentSnapshot `json:"student"`
+}
+
+// upsertStudentProjection บันทึก snapshot ของนักเรียน เขียนทับเฉพาะเมื่อข้อมูลใหม่กว่า
+func upsertStudentProjection(db projectionExecer, student StudentSnapshot, at time.Time) error {
+	_, err := db.Exec(`INSERT INTO student_projection (student_id, year_level, graded_subject, last_event_at)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (student_id) DO UPDATE SET
+			year_level     = EXCLUDED.year_level,
+			graded_subject = EXCLUDED.graded_subject,
+			last_event_at  = EXCLUDED.last_event_at
+		WHERE student_projection.last_event_at <= EXCLUDED.last_event_at`,
+		student.StudentID,
+		student.YearLevel,
+		pq.Array(student.GradedSubject),
+		at,
+	)
+	return err
+}
+
+// applyStudentEvent อัพเดท read model ตาม event 1 รายการ
+// ทุก event (registered, updated, grades_changed) มี snapshot ล่าสุดมาด้วย จึงใช้ upsert เหมือนกันหมด
+func applyStudentEvent(db projectionExecer, event StudentEvent) error {
+	if event.Student == nil {
+		return fmt.Errorf("event %s (%s) has no student data", event.EventID, event.Type)
+	}
+	return upsertStudentProjection(db, *event.Student, event.OccurredAt)
+}
+
+func declareStudentProjectionQueue(ch *amqp.Channel) error {
+	return declareProjectionQueue(ch, studentEventsExchange, studentProjectionQueue, studentEventBindingKey)
+}
+
+// startStudentProjectionConsumer รับ event ของนักเรียนแล้วอัพเดท student_projection
+func startStudentProjectionConsumer(db *sql.DB, rabbit *rabbitmq.Connection) error {
+	return startProjectionConsumer(rabbit, "Student Projection", studentProjectionQueue, declareStudentProjectionQueue, func(body []byte) (bool, error) {
+		var event StudentEvent
+		if err := json.Unmarshal(body, &event); err != nil {
+			return false, fmt.Errorf("invalid event: %v", err)
+		}
+		if err := applyStudentEvent(db, event); err != nil {
+			return true, fmt.Errorf("failed to apply %s for student %d: %v", event.Type, event.StudentID, err)
+		}
+		return false, nil
+	})
+}
+
+// studentServiceURL ที่อยู่ของ student-service สำหรับดึง snapshot
+func studentServiceURL() string {
+	url := os.Getenv("STUDENT_SERVICE_URL")
+	if url == "" {
+		url = "http://localhost:8001"
+	}
+	return url
+}
+
+// studentSnapshotResponse ผลของ GET /students/snapshot
+type studentSnapshotResponse struct {
+	SnapshotAt time.Time         `json:"snapshot_at"`
+	Students   []StudentSnapshot `json:"students"`
+}
+
+// rebuildStudentProjection ดึง snapshot จาก student-service แล้วสร้าง student_projection ใหม่ทั้งหมด
+func rebuildStudentProjection(db *sql.DB, baseURL string) (int, error) {
+	var snapshot studentSnapshotResponse
+	if err := fetchSnapshot(baseURL+"/students/snapshot", "student-service", &snapshot); err != nil {
+		return 0, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM student_projection`); err != nil {
+		return 0, err
+	}
+	for _, student := range snapshot.Students {
+		if err := upsertStudentProjection(tx, student, snapshot.SnapshotAt); err != nil {
+			return 0, fmt.Errorf("failed to store student %d: %v", student.StudentID, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	return len(snapshot.Students), nil
+}
+
+// reconcileStudentProjection เทียบ student_projection กับ snapshot ล่าสุดโดยไม่ลบทั้งตาราง
+// แถวจะถูกเขียนทับก็ต่อเมื่อเก่ากว่า snapshot event ที่เกิดหลัง snapshot จึงไม่ถูกย้อนกลับ
+// ส่วน event ที่หายไป (เช่น student.grades_changed) จะถูกแก้ให้ตรงกับ student-service ทำให้ canEnroll ไม่ค้างข้อมูลเก่า
+func reconcileStudentProjection(db *sql.DB, baseURL string) (int, error) {
+	var snapshot studentSnapshotResponse
+	if err := fetchSnapshot(baseURL+"/students/snapshot", "student-service", &snapshot); err != nil {
+		return 0, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	for _, student := range snapshot.Students {
+		if err := upsertStudentProjection(tx, student, snapshot.SnapshotAt); err != nil {
+			return 0, fmt.Errorf("failed to store student %d: %v", student.StudentID, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	return len(snapshot.Students), nil
+}
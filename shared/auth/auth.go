@@ -0,0 +1,327 @@
+// Package auth ตรวจ access token ที่ student-service ออก (JWT RS256 กับ public key จาก JWKS) และ middleware ของ gin
+// ใช้ร่วมกันระหว่าง course-service และ enrollment-service ส่วน ServiceClient (service.go) ใช้ขอ service token อายุสั้นจาก student-service
+package auth
+
+import (
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Issuer ค่า iss ของ token ที่ student-service ออกให้
+const Issuer = "student-service"
+
+// jwksRefetchInterval ดึง JWKS ใหม่ได้ไม่บ่อยกว่านี้ เมื่อเจอ kid ที่ไม่รู้จัก (กัน token ปลอมยิงใส่ student-service)
+const jwksRefetchInterval = 30 * time.Second
+
+// role ของบัญชีใน student-service (admin ทำได้ทุกอย่าง)
+const (
+	RoleStudent    = "student"
+	RoleInstructor = "instructor"
+	RoleAdvisor    = "advisor"
+	RoleRegistrar  = "registrar"
+	RoleAdmin      = "admin"
+	// RoleService service ภายในที่ยืนยันด้วย service token (ไม่ใช่บัญชีผู้ใช้ จึงกำหนดให้บัญชีไม่ได้)
+	RoleService = "service"
+)
+
+// ค่า token_use ของ token ที่ student-service ออก
+const (
+	TokenUseAccess  = "access"
+	TokenUseService = "service"
+)
+
+// rolePriority ลำดับ role จากสิทธิ์มากไปน้อย ใช้เลือก role หลักของ actor
+var rolePriority = []string{RoleAdmin, RoleRegistrar, RoleAdvisor, RoleInstructor, RoleStudent}
+
+// TokenClaims claim ของ access token (sub คือ student_id) และ service token (sub คือ client id, aud คือ service ปลายทาง)
+type TokenClaims struct {
+	jwt.RegisteredClaims
+	Email    string   `json:"email,omitempty"`
+	Roles    []string `json:"roles,omitempty"`
+	TokenUse string   `json:"token_use"`
+}
+
+// Identity ผู้เรียก API ที่ยืนยันจาก access token แล้ว (Service ไม่ว่างเมื่อเป็น service ภายในที่ใช้ service token)
+type Identity struct {
+	StudentID int      `json:"student_id"`
+	Email     string   `json:"email"`
+	Roles     []string `json:"roles"`
+	Service   string   `json:"service,omitempty"`
+}
+
+// HasRole มี role ใด role หนึ่งที่ระบุ (admin ผ่านเสมอ)
+func (id Identity) HasRole(roles ...string) bool {
+	for _, have := range id.Roles {
+		if have == RoleAdmin {
+			return true
+		}
+		for _, want := range roles {
+			if have == want {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// IsSelfOr เป็นเจ้าของข้อมูลของ studentID เอง หรือมี role ที่ระบุ (service ไม่เป็นเจ้าของข้อมูลของใคร)
+func (id Identity) IsSelfOr(studentID int, roles ...string) bool {
+	return (id.Service == "" && id.StudentID == studentID) || id.HasRole(roles...)
+}
+
+// Actor ชื่อผู้กระทำสำหรับบันทึกประวัติ ในรูปแบบ <role หลัก>:<id> เช่น student:1, registrar:9, service:enrollment-service
+func (id Identity) Actor() string {
+	if id.Service != "" {
+		return RoleService + ":" + id.Service
+	}
+	for _, role := range rolePriority {
+		for _, have := range id.Roles {
+			if have == role {
+				return role + ":" + strconv.Itoa(id.StudentID)
+			}
+		}
+	}
+	return RoleStudent + ":" + strconv.Itoa(id.StudentID)
+}
+
+// TokenVerifier ตรวจ JWT ที่ student-service ออกด้วย public key จาก JWKS โดยไม่ต้องเรียก student-service ทุก request
+type TokenVerifier struct {
+	jwksURL string
+	realm   string
+	client  *http.Client
+
+	mu        sync.Mutex
+	keys      map[string]*rsa.PublicKey
+	fetchedAt time.Time
+}
+
+// NewTokenVerifier realm คือชื่อ service ที่ตอบใน header WWW-Authenticate
+func NewTokenVerifier(jwksURL, realm string) *TokenVerifier {
+	return &TokenVerifier{
+		jwksURL: jwksURL,
+		realm:   realm,
+		client:  &http.Client{Timeout: 5 * time.Second},
+		keys:    map[string]*rsa.PublicKey{},
+	}
+}
+
+// StudentJWKSURL ที่อยู่ JWKS ของ student-service
+func StudentJWKSURL() string {
+	url := os.Getenv("STUDENT_SERVICE_URL")
+	if url == "" {
+		url = "http://localhost:8001"
+	}
+	return url + "/.well-known/jwks.json"
+}
+
+// publicKey หา key ตาม kid ถ้าไม่เจอจะดึง JWKS ใหม่ (รองรับการเปลี่ยน key ของ student-service)
+func (v *TokenVerifier) publicKey(kid string) (*rsa.PublicKey, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if key, ok := v.keys[kid]; ok {
+		return key, nil
+	}
+	if time.Since(v.fetchedAt) < jwksRefetchInterval {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	v.fetchedAt = time.Now()
+	keys, err := v.fetchKeys()
+	if err != nil {
+		return nil, err
+	}
+	v.keys = keys
+	if key, ok := v.keys[kid]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+// fetchKeys ดึง JWKS และแปลงเฉพาะ RSA key สำหรับลายเซ็น
+func (v *TokenVerifier) fetchKeys() (map[string]*rsa.PublicKey, error) {
+	resp, err := v.client.Get(v.jwksURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch JWKS: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("JWKS %s returned status %d", v.jwksURL, resp.StatusCode)
+	}
+
+	var jwks struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Use string `json:"use"`
+			Kid string `json:"kid"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&jwks); err != nil {
+		return nil, fmt.Errorf("failed to decode JWKS: %v", err)
+	}
+
+	keys := map[string]*rsa.PublicKey{}
+	for _, k := range jwks.Keys {
+		if k.Kty != "RSA" || (k.Use != "" && k.Use != "sig") {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			continue
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			continue
+		}
+		keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	}
+	return keys, nil
+}
+
+// Verify ตรวจลายเซ็น อายุ ผู้ออก และต้องเป็น access token
+// หรือ service token ที่ aud ตรงกับ realm ของ service นี้ (token ที่ออกให้ service อื่นใช้ที่นี่ไม่ได้)
+func (v *TokenVerifier) Verify(tokenString string) (Identity, error) {
+	claims := &TokenClaims{}
+	_, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		return v.publicKey(kid)
+	}, jwt.WithValidMethods([]string{"RS256"}), jwt.WithIssuer(Issuer), jwt.WithExpirationRequired())
+	if err != nil {
+		return Identity{}, err
+	}
+	if claims.TokenUse == TokenUseService {
+		return verifyServiceClaims(claims, v.realm)
+	}
+	if claims.TokenUse != TokenUseAccess {
+		return Identity{}, fmt.Errorf("expected an access token")
+	}
+	studentID, err := strconv.Atoi(claims.Subject)
+	if err != nil {
+		return Identity{}, fmt.Errorf("invalid token subject")
+	}
+	// token รุ่นก่อนมี role ถือว่าเป็นนักเรียน
+	roles := claims.Roles
+	if len(roles) == 0 {
+		roles = []string{RoleStudent}
+	}
+	return Identity{StudentID: studentID, Email: claims.Email, Roles: roles}, nil
+}
+
+// verifyServiceClaims ตรวจ claim ของ service token ว่าออกให้ audience นี้ และคืน Identity ที่มีแต่ RoleService
+func verifyServiceClaims(claims *TokenClaims, audience string) (Identity, error) {
+	if claims.Subject == "" {
+		return Identity{}, fmt.Errorf("invalid token subject")
+	}
+	for _, aud := range claims.Audience {
+		if aud == audience {
+			return Identity{Service: claims.Subject, Roles: []string{RoleService}}, nil
+		}
+	}
+	return Identity{}, fmt.Errorf("service token is not issued for %s", audience)
+}
+
+// Authenticate ตรวจ access token จาก header Authorization: Bearer <token>
+// แล้วเก็บ Identity ไว้ใน context ถ้าไม่ผ่านจะตอบ 401 และคืน false
+func Authenticate(c *gin.Context, v *TokenVerifier) (Identity, bool) {
+	scheme, token, ok := strings.Cut(c.GetHeader("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") || strings.TrimSpace(token) == "" {
+		c.Header("WWW-Authenticate", fmt.Sprintf(`Bearer realm=%q`, v.realm))
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Authentication required"})
+		return Identity{}, false
+	}
+	id, err := v.Verify(strings.TrimSpace(token))
+	if err != nil {
+		c.Header("WWW-Authenticate", `Bearer error="invalid_token"`)
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired token: " + err.Error()})
+		return Identity{}, false
+	}
+	c.Set("identity", id)
+	return id, true
+}
+
+// RespondForbidden ตอบ 403 เมื่อ login แล้วแต่ไม่มีสิทธิ์
+func RespondForbidden(c *gin.Context) {
+	c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "You do not have permission to perform this action"})
+}
+
+// AuthRequired ต้อง login (role ใดก็ได้) handler อ่านผู้เรียกได้จาก IdentityFrom
+// service token ไม่ใช่บัญชีผู้ใช้ จึงใช้ได้เฉพาะ route ที่ระบุ RoleService ใน RoleRequired
+func AuthRequired(v *TokenVerifier) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, ok := Authenticate(c, v)
+		if !ok {
+			return
+		}
+		if id.Service != "" {
+			RespondForbidden(c)
+			return
+		}
+		c.Next()
+	}
+}
+
+// AuthOptional ไม่บังคับ login แต่ถ้าส่ง token มาต้องถูกต้อง ใช้กับ route ที่แสดงข้อมูลต่างกันตามสิทธิ์
+func AuthOptional(v *TokenVerifier) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.GetHeader("Authorization") == "" {
+			c.Next()
+			return
+		}
+		if _, ok := Authenticate(c, v); ok {
+			c.Next()
+		}
+	}
+}
+
+// RoleRequired ต้อง login และมี role ใด role หนึ่งที่ระบุ
+func RoleRequired(v *TokenVerifier, roles ...string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, ok := Authenticate(c, v)
+		if !ok {
+			return
+		}
+		if !id.HasRole(roles...) {
+			RespondForbidden(c)
+			return
+		}
+		c.Next()
+	}
+}
+
+// SelfOrRoleRequired ต้อง login และเป็นเจ้าของข้อมูล (student_id ใน path param ที่ระบุ) หรือมี role ที่ระบุ
+func SelfOrRoleRequired(v *TokenVerifier, param string, roles ...string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, ok := Authenticate(c, v)
+		if !ok {
+			return
+		}
+		if studentID, err := strconv.Atoi(c.Param(param)); (err != nil || !id.IsSelfOr(studentID)) && !id.HasRole(roles...) {
+			RespondForbidden(c)
+			return
+		}
+		c.Next()
+	}
+}
+
+// IdentityFrom ผู้เรียกที่ตรวจ token แล้ว (ok เป็น false ถ้าไม่ได้ login)
+func IdentityFrom(c *gin.Context) (Identity, bool) {
+	value, ok := c.Get("identity")
+	if !ok {
+		return Identity{}, false
+	}
+	id, ok := value.(Identity)
+	return id, ok
+}
@@ -0,0 +1,110 @@
+package auth
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// serviceTokenRenewBefore ขอ service token ใหม่ก่อนหมดอายุช่วงนี้ กัน token หมดระหว่างทาง
+const serviceTokenRenewBefore = 30 * time.Second
+
+// ServiceClient ขอ service token อายุสั้นจาก student-service (POST /token/service) ด้วย client id และ secret ของ service นี้
+// แล้วเก็บไว้ใช้ซ้ำแยกตาม audience จนใกล้หมดอายุ secret อ่านจากไฟล์ทุกครั้งที่ขอ token จึงเปลี่ยน secret ได้โดยไม่ต้อง restart
+type ServiceClient struct {
+	tokenURL   string
+	clientID   string
+	secretFile string
+	client     *http.Client
+
+	mu     sync.Mutex
+	tokens map[string]serviceToken
+}
+
+type serviceToken struct {
+	value     string
+	expiresAt time.Time
+}
+
+// NewServiceClient tokenURL คือ endpoint POST /token/service ของ student-service
+func NewServiceClient(tokenURL, clientID, secretFile string) *ServiceClient {
+	return &ServiceClient{
+		tokenURL:   tokenURL,
+		clientID:   clientID,
+		secretFile: secretFile,
+		client:     &http.Client{Timeout: 5 * time.Second},
+		tokens:     map[string]serviceToken{},
+	}
+}
+
+// ServiceClientFromEnv สร้างจาก SERVICE_CLIENT_ID และ SERVICE_CLIENT_SECRET_FILE (docker compose สร้างไฟล์ให้ใน volume service_clients)
+// คืน nil ถ้าไม่ได้ตั้งไว้
+func ServiceClientFromEnv() *ServiceClient {
+	clientID := os.Getenv("SERVICE_CLIENT_ID")
+	secretFile := os.Getenv("SERVICE_CLIENT_SECRET_FILE")
+	if clientID == "" || secretFile == "" {
+		return nil
+	}
+	url := os.Getenv("STUDENT_SERVICE_URL")
+	if url == "" {
+		url = "http://localhost:8001"
+	}
+	return NewServiceClient(url+"/token/service", clientID, secretFile)
+}
+
+// Token service token สำหรับเรียก service ปลายทาง audience (เช่น course-service)
+func (s *ServiceClient) Token(audience string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if token, ok := s.tokens[audience]; ok && time.Until(token.expiresAt) > serviceTokenRenewBefore {
+		return token.value, nil
+	}
+	token, err := s.fetch(audience)
+	if err != nil {
+		return "", err
+	}
+	s.tokens[audience] = token
+	return token.value, nil
+}
+
+func (s *ServiceClient) fetch(audience string) (serviceToken, error) {
+	data, err := os.ReadFile(s.secretFile)
+	if err != nil {
+		return serviceToken{}, fmt.Errorf("failed to read service client secret: %v", err)
+	}
+	secret := strings.TrimSpace(string(data))
+	if secret == "" {
+		return serviceToken{}, fmt.Errorf("service client secret file %s is empty", s.secretFile)
+	}
+
+	body, err := json.Marshal(map[string]string{"client_id": s.clientID, "client_secret": secret, "audience": audience})
+	if err != nil {
+		return serviceToken{}, err
+	}
+	resp, err := s.client.Post(s.tokenURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return serviceToken{}, fmt.Errorf("failed to request service token: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return serviceToken{}, fmt.Errorf("service token endpoint %s returned status %d", s.tokenURL, resp.StatusCode)
+	}
+
+	var result struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return serviceToken{}, fmt.Errorf("failed to decode service token: %v", err)
+	}
+	if result.AccessToken == "" {
+		return serviceToken{}, fmt.Errorf("service token endpoint returned no token")
+	}
+	return serviceToken{value: result.AccessToken, expiresAt: time.Now().Add(time.Duration(result.ExpiresIn) * time.Second)}, nil
+}
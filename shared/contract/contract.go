@@ -0,0 +1,150 @@
+// Package contract สัญญาของ RPC ระหว่าง enrollment-service กับ course-service
+// schema ของทุกเวอร์ชันอยู่ใน schemas/ ของ package นี้ที่เดียว ทั้งสอง service import ชุดเดียวกัน
+//
+// เวอร์ชัน 1 ขึ้นไปห่อด้วย envelope {type, version, payload}
+// ส่วนข้อความที่ไม่มี type (payload เปล่าแบบก่อนมี envelope) ถือเป็น LegacyVersion และตอบกลับแบบเปล่าเหมือนเดิม
+package contract
+
+import (
+	"bytes"
+	"embed"
+	"encoding/json"
+	"fmt"
+	"log"
+
+	"github.com/santhosh-tekuri/jsonschema/v5"
+)
+
+const (
+	RequestType  = "enrollment.request"
+	ResponseType = "enrollment.response"
+)
+
+// LegacyVersion เวอร์ชันของข้อความที่ไม่มี envelope
+const LegacyVersion = 0
+
+// SupportedVersions เวอร์ชันที่รับได้พร้อมกัน เรียงจากเก่าไปใหม่
+// ระหว่าง rolling upgrade ให้ deploy course-service ก่อน แล้วค่อยให้ enrollment-service เปลี่ยนไปส่งเวอร์ชันใหม่
+var SupportedVersions = []int{LegacyVersion, 1, 2, 3}
+
+// LatestVersion เวอร์ชันล่าสุด
+func LatestVersion() int {
+	return SupportedVersions[len(SupportedVersions)-1]
+}
+
+// Envelope ตัวห่อข้อความของ RPC
+type Envelope struct {
+	Type    string          `json:"type"`
+	Version int             `json:"version"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+//go:embed schemas/enrollment_*.json
+var schemaFS embed.FS
+
+// schemas schema ที่ compile แล้ว key คือ "<type>.v<version>"
+var schemas = mustCompileSchemas()
+
+func schemaKey(messageType string, version int) string {
+	return fmt.Sprintf("%s.v%d", messageType, version)
+}
+
+func mustCompileSchemas() map[string]*jsonschema.Schema {
+	files := map[string]string{}
+	for _, version := range SupportedVersions {
+		files[schemaKey(RequestType, version)] = fmt.Sprintf("schemas/enrollment_request.v%d.json", version)
+		files[schemaKey(ResponseType, version)] = fmt.Sprintf("schemas/enrollment_response.v%d.json", version)
+	}
+
+	compiler := jsonschema.NewCompiler()
+	for _, file := range files {
+		data, err := schemaFS.ReadFile(file)
+		if err != nil {
+			log.Fatalf("Contract schema %s: %v", file, err)
+		}
+		if err := compiler.AddResource(file, bytes.NewReader(data)); err != nil {
+			log.Fatalf("Contract schema %s: %v", file, err)
+		}
+	}
+
+	compiled := map[string]*jsonschema.Schema{}
+	for key, file := range files {
+		schema, err := compiler.Compile(file)
+		if err != nil {
+			log.Fatalf("Contract schema %s: %v", file, err)
+		}
+		compiled[key] = schema
+	}
+	return compiled
+}
+
+// Supports เช็คว่ามี schema ของ type/version นี้หรือไม่
+func Supports(messageType string, version int) bool {
+	_, ok := schemas[schemaKey(messageType, version)]
+	return ok
+}
+
+// Validate ตรวจข้อความทั้งก้อน (รวม envelope ถ้ามี) กับ schema ของ type/version ที่ระบุ
+func Validate(messageType string, version int, body []byte) error {
+	schema, ok := schemas[schemaKey(messageType, version)]
+	if !ok {
+		return fmt.Errorf("unsupported %s version %d", messageType, version)
+	}
+
+	var doc interface{}
+	if err := json.Unmarshal(body, &doc); err != nil {
+		return err
+	}
+	return schema.Validate(doc)
+}
+
+// Decode อ่านและตรวจข้อความ แล้วคืนเวอร์ชันที่ผู้ส่งใช้พร้อม payload
+// ข้อความที่ไม่มี type คือ LegacyVersion และทั้งก้อนคือ payload
+func Decode(messageType string, body []byte) (int, json.RawMessage, error) {
+	var probe map[string]json.RawMessage
+	if err := json.Unmarshal(body, &probe); err != nil {
+		return 0, nil, err
+	}
+	if _, enveloped := probe["type"]; !enveloped {
+		if err := Validate(messageType, LegacyVersion, body); err != nil {
+			return LegacyVersion, nil, err
+		}
+		return LegacyVersion, json.RawMessage(body), nil
+	}
+
+	var envelope Envelope
+	if err := json.Unmarshal(body, &envelope); err != nil {
+		return 0, nil, err
+	}
+	if envelope.Type != messageType {
+		return envelope.Version, nil, fmt.Errorf("unexpected message type %q (expected %q)", envelope.Type, messageType)
+	}
+	if envelope.Version == LegacyVersion {
+		// v0 ไม่มี envelope ข้อความที่ห่อมาพร้อม version 0 จึงผิดสัญญา
+		return envelope.Version, nil, fmt.Errorf("unsupported %s version %d", messageType, envelope.Version)
+	}
+	if err := Validate(messageType, envelope.Version, body); err != nil {
+		return envelope.Version, nil, err
+	}
+	return envelope.Version, envelope.Payload, nil
+}
+
+// Encode แปลง payload เป็นข้อความของเวอร์ชันที่ระบุ (LegacyVersion ส่ง payload เปล่า) และตรวจกับ schema ก่อนส่ง
+// payload ต้องตัดฟิลด์ที่เวอร์ชันนั้นไม่มีออกก่อน
+func Encode(messageType string, version int, payload interface{}) ([]byte, error) {
+	raw, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	body := raw
+	if version != LegacyVersion {
+		body, err = json.Marshal(Envelope{Type: messageType, Version: version, Payload: raw})
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := Validate(messageType, version, body); err != nil {
+		return nil, err
+	}
+	return body, nil
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+	"github.com/sony/gobreaker"
+)
+
+// studentImportColumns คอลัมน์ของไฟล์ CSV graded_subject คั่นด้วย ; และไม่ต้องมีก็ได้
+var studentImportColumns = []string{"student_id", "first_name", "last_name", "email", "birthdate", "gender", "year_level", "graded_subject"}
+
+const studentImportListSeparator = ";"
+
+// ตัวอักษรของรหัสผ่านชั่วคราว (ตัด 0/O, 1/l/I ออกเพื่อไม่ให้อ่านสับสน)
+const (
+	temporaryPasswordAlphabet = "ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz23456789"
+	temporaryPasswordLength   = 12
+)
+
+// StudentImportRowError ข้อผิดพลาดทั้งหมดของแถวหนึ่ง row นับจาก 1 ไม่รวมหัวตาราง
+type StudentImportRowError struct {
+	Row       int      `json:"row"`
+	StudentID int      `json:"student_id,omitempty"`
+	Errors    []string `json:"errors"`
+}
+
+// StudentCredential รหัสผ่านชั่วคราวของนักเรียนที่นำเข้า มีให้ดูครั้งเดียวในรายงานนี้เท่านั้น
+type StudentCredential struct {
+	StudentID         int    `json:"student_id"`
+	Email             string `json:"email"`
+	TemporaryPassword string `json:"temporary_password"`
+}
+
+// StudentImportReport ผลการนำเข้า ถ้ามีแถวผิดแม้แถวเดียวจะไม่บันทึกแถวใดเลย
+type StudentImportReport struct {
+	DryRun      bool                    `json:"dry_run"`
+	Total       int                     `json:"total"`
+	Valid       int                     `json:"valid"`
+	Imported    int                     `json:"imported"`
+	Errors      []StudentImportRowError `json:"errors"`
+	Credentials []StudentCredential     `json:"credentials"`
+}
+
+// studentImportRow แถวที่อ่านจากไฟล์พร้อมข้อผิดพลาดที่พบ
+type studentImportRow struct {
+	Row     int
+	Student Student
+	Errors  []string
+}
+
+// parseStudentCSV อ่านไฟล์ CSV error ที่คืนเป็นปัญหาของทั้งไฟล์ ส่วนปัญหาของแต่ละแถวอยู่ใน studentImportRow
+func parseStudentCSV(body []byte) ([]*studentImportRow, error) {
+	reader := csv.NewReader(bytes.NewReader(body))
+	reader.TrimLeadingSpace = true
+	reader.FieldsPerRecord = -1
+
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil, fmt.Errorf("CSV file is empty")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid CSV header: %v", err)
+	}
+
+	index := map[string]int{}
+	for i, name := range header {
+		name = strings.TrimSpace(strings.TrimPrefix(name, "\ufeff"))
+		known := false
+		for _, column := range studentImportColumns {
+			known = known || column == name
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown column %q", name)
+		}
+		index[name] = i
+	}
+	for _, name := range studentImportColumns {
+		if _, ok := index[name]; !ok && name != "graded_subject" {
+			return nil, fmt.Errorf("missing column %q", name)
+		}
+	}
+
+	var rows []*studentImportRow
+	for n := 1; ; n++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		row := &studentImportRow{Row: n}
+		rows = append(rows, row)
+		if err != nil {
+			row.Errors = append(row.Errors, "invalid CSV row: "+err.Error())
+			continue
+		}
+		if len(record) != len(header) {
+			row.Errors = append(row.Errors, fmt.Sprintf("expected %d columns, got %d", len(header), len(record)))
+			continue
+		}
+
+		cell := func(name string) string {
+			if i, ok := index[name]; ok {
+				return strings.TrimSpace(record[i])
+			}
+			return ""
+		}
+		number := func(name string) int {
+			value := cell(name)
+			if value == "" {
+				return 0
+			}
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				row.Errors = append(row.Errors, fmt.Sprintf("%s must be a number, got %q", name, value))
+			}
+			return n
+		}
+
+		s := &row.Student
+		s.StudentID = number("student_id")
+		s.FirstName = cell("first_name")
+		s.LastName = cell("last_name")
+		s.Email = cell("email")
+		s.Birthdate = cell("birthdate")
+		s.Gender = cell("gender")
+		s.YearLevel = number("year_level")
+		s.GradedSubject = []string{}
+		for _, subject := range strings.Split(cell("graded_subject"), studentImportListSeparator) {
+			if subject = strings.TrimSpace(subject); subject != "" {
+				s.GradedSubject = append(s.GradedSubject, subject)
+			}
+		}
+	}
+	return rows, nil
+}
+
+// validateStudentImport ตรวจแต่ละแถวด้วยกฎเดียวกับการสมัคร และรหัส/อีเมลซ้ำทั้งในไฟล์และในฐานข้อมูล
+// (เทียบอีเมลแบบไม่สนตัวพิมพ์เล็กใหญ่)
+func validateStudentImport(ctx context.Context, tx pgx.Tx, rows []*studentImportRow) error {
+	existingIDs := map[int]bool{}
+	existingEmails := map[string]bool{}
+	dbRows, err := tx.Query(ctx, `SELECT student_id, LOWER(email) FROM student`)
+	if err != nil {
+		return err
+	}
+	for dbRows.Next() {
+		var id int
+		var email string
+		if err := dbRows.Scan(&id, &email); err != nil {
+			dbRows.Close()
+			return err
+		}
+		existingIDs[id] = true
+		existingEmails[email] = true
+	}
+	dbRows.Close()
+	if err := dbRows.Err(); err != nil {
+		return err
+	}
+
+	seenIDs := map[int]int{}
+	seenEmails := map[string]int{}
+	for _, row := range rows {
+		if len(row.Errors) > 0 {
+			continue
+		}
+		s := &row.Student
+		// กฎเดียวกับ POST /register (ยกเว้น password ที่ระบบสร้างให้)
+		record := NewStudent{
+			StudentID: s.StudentID,
+			StudentProfile: StudentProfile{
+				FirstName: s.FirstName,
+				LastName:  s.LastName,
+				Birthdate: s.Birthdate,
+				Gender:    s.Gender,
+				YearLevel: s.YearLevel,
+			},
+			Email:         s.Email,
+			GradedSubject: s.GradedSubject,
+		}
+		invalidEmail := false
+		if invalid := validateStruct(record); invalid != nil {
+			row.Errors = append(row.Errors, invalid.Messages()...)
+			for _, field := range invalid.Fields {
+				invalidEmail = invalidEmail || field.Field == "email"
+			}
+		}
+
+		if s.StudentID > 0 {
+			if existingIDs[s.StudentID] {
+				row.Errors = append(row.Errors, fmt.Sprintf("student_id %d already exists", s.StudentID))
+			}
+			if first, ok := seenIDs[s.StudentID]; ok {
+				row.Errors = append(row.Errors, fmt.Sprintf("student_id %d is duplicated in row %d", s.StudentID, first))
+			} else {
+				seenIDs[s.StudentID] = row.Row
+			}
+		}
+
+		if invalidEmail {
+			continue
+		}
+		email := strings.ToLower(s.Email)
+		if existingEmails[email] {
+			row.Errors = append(row.Errors, fmt.Sprintf("email %s is already registered", s.Email))
+		}
+		if first, ok := seenEmails[email]; ok {
+			row.Errors = append(row.Errors, fmt.Sprintf("email %s is duplicated in row %d", s.Email, first))
+		} else {
+			seenEmails[email] = row.Row
+		}
+	}
+	return nil
+}
+
+// generateTemporaryPassword สุ่มรหัสผ่านชั่วคราวด้วย crypto/rand
+func generateTemporaryPassword() (string, error) {
+	password := make([]byte, temporaryPasswordLength)
+	max := big.NewInt(int64(len(temporaryPasswordAlphabet)))
+	for i := range password {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		password[i] = temporaryPasswordAlphabet[n.Int64()]
+	}
+	return string(password), nil
+}
+
+// importStudents ตรวจและเพิ่มนักเรียนทั้งหมดใน transaction เดียว สร้างรหัสผ่านชั่วคราวให้ทุกคน
+// dry run จะตรวจอย่างเดียว ไม่สร้างรหัสผ่านและไม่บันทึก
+func importStudents(ctx context.Context, conn *pgx.Conn, rows []*studentImportRow, dryRun bool) (*StudentImportReport, error) {
+	report := &StudentImportReport{
+		DryRun:      dryRun,
+		Total:       len(rows),
+		Errors:      []StudentImportRowError{},
+		Credentials: []StudentCredential{},
+	}
+
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	if err := validateStudentImport(ctx, tx, rows); err != nil {
+		return nil, err
+	}
+	for _, row := range rows {
+		if len(row.Errors) > 0 {
+			report.Errors = append(report.Errors, StudentImportRowError{Row: row.Row, StudentID: row.Student.StudentID, Errors: row.Errors})
+		}
+	}
+	report.Valid = report.Total - len(report.Errors)
+	if len(report.Errors) > 0 || dryRun {
+		return report, nil
+	}
+
+	for _, row := range rows {
+		s := row.Student
+		password, err := generateTemporaryPassword()
+		if err != nil {
+			return nil, err
+		}
+		hashedPassword, err := hashPassword(password)
+		if err != nil {
+			return nil, err
+		}
+		_, err = tx.Exec(ctx,
+			`INSERT INTO student (student_id, first_name, last_name, email, password, birthdate, gender, year_level, graded_subject)
+			 VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`,
+			s.StudentID, s.FirstName, s.LastName, s.Email, hashedPassword, s.Birthdate, s.Gender, s.YearLevel, s.GradedSubject,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("row %d: %w", row.Row, err)
+		}
+		if err := enqueueStudentEvent(ctx, tx, EventStudentRegistered, s); err != nil {
+			return nil, fmt.Errorf("row %d: %w", row.Row, err)
+		}
+		report.Credentials = append(report.Credentials, StudentCredential{StudentID: s.StudentID, Email: s.Email, TemporaryPassword: password})
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, err
+	}
+	report.Imported = len(report.Credentials)
+	return report, nil
+}
+
+// registerStudentImportRoutes POST /students/import?dry_run=true รับไฟล์ CSV ของนักเรียนรุ่นใหม่
+func registerStudentImportRoutes(r *gin.Engine, dbConns *DBConnections, events *EventPublisher, writeCircuitBreaker *gobreaker.CircuitBreaker, requireRegistrar gin.HandlerFunc) {
+	r.POST("/students/import", requireRegistrar, func(c *gin.Context) {
+		body, err := c.GetRawData()
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read body: " + err.Error()})
+			return
+		}
+		rows, err := parseStudentCSV(body)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if len(rows) == 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "CSV file has no students"})
+			return
+		}
+		dryRun := c.Query("dry_run") == "true"
+
+		var report *StudentImportReport
+		_, err = writeCircuitBreaker.Execute(func() (interface{}, error) {
+			result, err := importStudents(context.Background(), dbConns.WriteConn, rows, dryRun)
+			report = result
+			return result, err
+		})
+		if err == gobreaker.ErrOpenState {
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Service temporarily unavailable (circuit breaker is open)"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Import failed: " + err.Error()})
+			return
+		}
+
+		switch {
+		case len(report.Errors) > 0:
+			c.JSON(http.StatusUnprocessableEntity, report)
+		case dryRun:
+			c.JSON(http.StatusOK, report)
+		default:
+			events.Notify()
+			// รายงานมีรหัสผ่านชั่วคราว ห้าม cache
+			c.Header("Cache-Control", "no-store")
+			c.JSON(http.StatusCreated, report)
+		}
+	})
+}
@@ -9,4 +9,56 @@ CREATE TABLE IF NOT EXISTS student (
 	"year_level" INTEGER NOT NULL,
 	"graded_subject" VARCHAR(255) ARRAY,
 	PRIMARY KEY("student_id")
-);
\ No newline at end of file
+);
+-- version เพิ่มทุกครั้งที่แก้ไขโปรไฟล์ ใช้เป็น ETag / If-Match กันการเขียนทับกัน
+ALTER TABLE student ADD COLUMN IF NOT EXISTS "version" INTEGER NOT NULL DEFAULT 1;
+-- อีเมลไม่ซ้ำกันแบบไม่สนตัวพิมพ์เล็กใหญ่ ถ้าข้อมูลเดิมมีอีเมลซ้ำจะแจ้งรายการที่ซ้ำและยังไม่สร้าง index
+-- (แก้ข้อมูลแล้วรัน ./student-service migrate-unique-email)
+DO $$
+DECLARE
+	dup RECORD;
+	found BOOLEAN := FALSE;
+BEGIN
+	FOR dup IN
+		SELECT LOWER(email) AS email, array_agg(student_id ORDER BY student_id) AS student_ids
+		FROM student GROUP BY LOWER(email) HAVING COUNT(*) > 1 ORDER BY LOWER(email)
+	LOOP
+		found := TRUE;
+		RAISE WARNING 'duplicate email % used by students %', dup.email, dup.student_ids;
+	END LOOP;
+	IF NOT found THEN
+		CREATE UNIQUE INDEX IF NOT EXISTS student_email_lower_key ON student (LOWER(email));
+	END IF;
+END $$;
+-- refresh token ที่ออกไปแล้ว (ใช้ได้ครั้งเดียว และเพิกถอนตอน logout)
+CREATE TABLE IF NOT EXISTS refresh_token (
+	"jti" VARCHAR(64) PRIMARY KEY,
+	"student_id" INTEGER NOT NULL REFERENCES student("student_id") ON DELETE CASCADE,
+	"expires_at" TIMESTAMPTZ NOT NULL,
+	"revoked_at" TIMESTAMPTZ
+);
+CREATE INDEX IF NOT EXISTS refresh_token_student_idx ON refresh_token ("student_id");
+-- role ของบัญชี (student, instructor, advisor, registrar, admin) ใส่ลงใน access token ให้ service อื่นตรวจสิทธิ์
+-- บัญชีใหม่เป็น student ส่วน admin คนแรกตั้งด้วย ./student-service set-roles -roles admin <email>
+ALTER TABLE student ADD COLUMN IF NOT EXISTS "roles" VARCHAR(32) ARRAY NOT NULL DEFAULT '{student}';
+DO $$
+BEGIN
+	IF NOT EXISTS (SELECT 1 FROM pg_constraint WHERE conname = 'student_roles_check') THEN
+		ALTER TABLE student ADD CONSTRAINT student_roles_check CHECK (
+			cardinality("roles") > 0 AND "roles" <@ ARRAY['student', 'instructor', 'advisor', 'registrar', 'admin']::VARCHAR(32)[]
+		);
+	END IF;
+END $$;
+-- transactional outbox ของ domain event (บันทึกใน transaction เดียวกับการเปลี่ยนแปลง แล้ว relay ส่งออกพร้อมรอ publisher confirm)
+CREATE TABLE IF NOT EXISTS student_event_outbox (
+	"outbox_id" BIGSERIAL PRIMARY KEY,
+	"event_id" VARCHAR(255) NOT NULL UNIQUE,
+	"event_type" VARCHAR(255) NOT NULL,
+	"student_id" INTEGER NOT NULL,
+	"payload" JSONB NOT NULL,
+	"occurred_at" TIMESTAMPTZ NOT NULL,
+	"published_at" TIMESTAMPTZ,
+	"attempts" INTEGER NOT NULL DEFAULT 0,
+	"last_error" TEXT
+);
+CREATE INDEX IF NOT EXISTS student_event_outbox_pending_idx ON student_event_outbox ("outbox_id") WHERE "published_at" IS NULL;
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// studentEmailIndex unique index ของอีเมลแบบไม่สนตัวพิมพ์เล็กใหญ่ (ชื่อเดียวกับใน db/schema.sql)
+const studentEmailIndex = "student_email_lower_key"
+
+// errEmailTaken อีเมลนี้มีคนใช้แล้ว (เทียบแบบไม่สนตัวพิมพ์เล็กใหญ่)
+var errEmailTaken = errors.New("email is already registered")
+
+// DuplicateEmail อีเมลที่ซ้ำกันอยู่ก่อนแล้ว ต้องแก้ให้เหลือบัญชีเดียวก่อนสร้าง unique index
+type DuplicateEmail struct {
+	Email      string `json:"email"`
+	StudentIDs []int  `json:"student_ids"`
+}
+
+// EmailMigrationReport ผลของ migrate-unique-email
+type EmailMigrationReport struct {
+	DryRun       bool             `json:"dry_run"`
+	IndexCreated bool             `json:"index_created"`
+	Duplicates   []DuplicateEmail `json:"duplicates"`
+}
+
+// queryer ใช้ได้ทั้ง *pgx.Conn และ pgx.Tx
+type queryer interface {
+	Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error)
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+}
+
+// emailTaken มีนักเรียนคนอื่นใช้อีเมลนี้แล้วหรือไม่
+func emailTaken(ctx context.Context, q queryer, email string) (bool, error) {
+	var taken bool
+	err := q.QueryRow(ctx, `SELECT EXISTS (SELECT 1 FROM student WHERE LOWER(email) = LOWER($1))`, email).Scan(&taken)
+	return taken, err
+}
+
+// isUniqueViolation error จาก Postgres ว่าชน unique constraint/index ชื่อนี้
+func isUniqueViolation(err error, constraint string) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == "23505" && pgErr.ConstraintName == constraint
+}
+
+// findDuplicateEmails อีเมลที่มีมากกว่า 1 บัญชี (ไม่สนตัวพิมพ์เล็กใหญ่)
+func findDuplicateEmails(ctx context.Context, q queryer) ([]DuplicateEmail, error) {
+	rows, err := q.Query(ctx,
+		`SELECT LOWER(email), array_agg(student_id ORDER BY student_id)
+		 FROM student GROUP BY LOWER(email) HAVING COUNT(*) > 1 ORDER BY LOWER(email)`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	duplicates := []DuplicateEmail{}
+	for rows.Next() {
+		var d DuplicateEmail
+		if err := rows.Scan(&d.Email, &d.StudentIDs); err != nil {
+			return nil, err
+		}
+		duplicates = append(duplicates, d)
+	}
+	return duplicates, rows.Err()
+}
+
+// migrateUniqueEmail สร้าง unique index ของอีเมล ถ้ามีอีเมลซ้ำอยู่จะไม่สร้างและคืนรายการที่ซ้ำให้แก้ก่อน
+func migrateUniqueEmail(ctx context.Context, conn *pgx.Conn, dryRun bool) (*EmailMigrationReport, error) {
+	duplicates, err := findDuplicateEmails(ctx, conn)
+	if err != nil {
+		return nil, err
+	}
+	report := &EmailMigrationReport{DryRun: dryRun, Duplicates: duplicates}
+	if len(duplicates) > 0 || dryRun {
+		return report, nil
+	}
+	if _, err := conn.Exec(ctx, fmt.Sprintf(`CREATE UNIQUE INDEX IF NOT EXISTS %s ON student (LOWER(email))`, studentEmailIndex)); err != nil {
+		return nil, err
+	}
+	report.IndexCreated = true
+	return report, nil
+}
+
+// runEmailCommand คำสั่ง migrate-unique-email สำหรับฐานข้อมูลที่สร้างไว้ก่อนมี unique index
+// ออกด้วย exit code 1 ถ้ายังมีอีเมลซ้ำ
+func runEmailCommand(args []string) {
+	command := args[0]
+	if command != "migrate-unique-email" {
+		log.Fatalf("Unknown command %q (expected migrate-unique-email)", command)
+	}
+	flags := flag.NewFlagSet(command, flag.ExitOnError)
+	dryRun := flags.Bool("dry-run", false, "report duplicate emails without creating the index")
+	flags.Parse(args[1:])
+
+	writeConn := connectToWriteDB()
+	defer writeConn.Close(context.Background())
+
+	report, err := migrateUniqueEmail(context.Background(), writeConn, *dryRun)
+	if err != nil {
+		log.Fatal("Failed to migrate email index: ", err)
+	}
+	out, _ := json.MarshalIndent(report, "", "  ")
+	fmt.Println(string(out))
+	if len(report.Duplicates) > 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+)
+
+// errVersionMismatch version ใน If-Match ไม่ตรงกับข้อมูลปัจจุบัน (มีการแก้ไขไปก่อนแล้ว)
+var errVersionMismatch = errors.New("version mismatch")
+
+// etagFor ETag ของข้อมูลที่ version ระบุ
+func etagFor(version int) string {
+	return fmt.Sprintf(`"%d"`, version)
+}
+
+// requireIfMatch อ่าน version จาก header If-Match (รับทั้ง "3" และ W/"3")
+// ถ้าไม่มีจะตอบ 428 ถ้ารูปแบบผิดจะตอบ 400 แล้วคืน false
+func requireIfMatch(c *gin.Context) (int, bool) {
+	header := strings.TrimSpace(c.GetHeader("If-Match"))
+	if header == "" {
+		c.JSON(http.StatusPreconditionRequired, gin.H{"error": "If-Match header is required, use the ETag from GET"})
+		return 0, false
+	}
+
+	version, err := strconv.Atoi(strings.Trim(strings.TrimPrefix(header, "W/"), `"`))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid If-Match header: " + header})
+		return 0, false
+	}
+	return version, true
+}
+
+// checkStudentVersion lock แถวของนักเรียนแล้วเทียบ version กับที่ client ส่งมา
+// คืน version ปัจจุบันด้วยเพื่อใช้ตอบ ETag เมื่อไม่ตรงกัน
+func checkStudentVersion(ctx context.Context, tx pgx.Tx, studentID interface{}, expected int) (int, error) {
+	var version int
+	err := tx.QueryRow(ctx, `SELECT "version" FROM student WHERE student_id = $1 FOR UPDATE`, studentID).Scan(&version)
+	if err != nil {
+		return 0, err
+	}
+	if version != expected {
+		return version, errVersionMismatch
+	}
+	return version, nil
+}
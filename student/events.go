@@ -0,0 +1,315 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+	amqp "github.com/rabbitmq/amqp091-go"
+
+	"shared/rabbitmq"
+)
+
+// studentEventsExchange topic exchange สำหรับ domain event ของนักเรียน (routing key = ชื่อ event)
+const studentEventsExchange = "student_events"
+
+// studentEventVersion เวอร์ชันของ schema (ดู schemas/student_event.v1.json)
+const studentEventVersion = 1
+
+const (
+	EventStudentRegistered    = "student.registered"
+	EventStudentUpdated       = "student.updated"
+	EventStudentGradesChanged = "student.grades_changed"
+)
+
+// StudentEvent ข้อความที่ publish ออกไปทุกครั้งที่ข้อมูลนักเรียนเปลี่ยน (บันทึกลง student_event_outbox ใน transaction เดียวกับการเปลี่ยนแปลง)
+// Student เป็น snapshot ล่าสุดหลังการเปลี่ยนแปลง (ไม่มี password)
+type StudentEvent struct {
+	EventID    string    `json:"event_id"`
+	Type       string    `json:"type"`
+	Version    int       `json:"version"`
+	OccurredAt time.Time `json:"occurred_at"`
+	StudentID  int       `json:"student_id"`
+	Student    *Student  `json:"student"`
+}
+
+// outboxWriter ใช้ได้ทั้ง pgx.Tx และ *pgx.Conn
+// ปกติให้ส่ง transaction เดียวกับที่เปลี่ยนข้อมูลนักเรียน เพื่อให้ event ถูกบันทึกพร้อมกับการเปลี่ยนแปลงเสมอ
+type outboxWriter interface {
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+	Exec(ctx context.Context, sql string, arguments ...any) (pgconn.CommandTag, error)
+}
+
+// studentBeginner ใช้ได้ทั้ง *pgx.Conn และ *pgxpool.Pool
+type studentBeginner interface {
+	Begin(ctx context.Context) (pgx.Tx, error)
+}
+
+func newStudentEvent(eventType string, student Student) StudentEvent {
+	student.Password = ""
+	now := time.Now().UTC()
+	return StudentEvent{
+		EventID:    fmt.Sprintf("%s-%d-%d", eventType, student.StudentID, now.UnixNano()),
+		Type:       eventType,
+		Version:    studentEventVersion,
+		OccurredAt: now,
+		StudentID:  student.StudentID,
+		Student:    &student,
+	}
+}
+
+// enqueueStudentEvent บันทึก event ลง student_event_outbox แล้ว EventPublisher จะส่งออกไปหลัง commit
+func enqueueStudentEvent(ctx context.Context, db outboxWriter, eventType string, student Student) error {
+	event := newStudentEvent(eventType, student)
+	body, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to marshal %s event for student %d: %v", eventType, student.StudentID, err)
+	}
+	_, err = db.Exec(ctx,
+		`INSERT INTO student_event_outbox ("event_id", "event_type", "student_id", "payload", "occurred_at") VALUES ($1, $2, $3, $4, $5)`,
+		event.EventID, event.Type, event.StudentID, body, event.OccurredAt,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to store %s event for student %d: %v", eventType, student.StudentID, err)
+	}
+	return nil
+}
+
+// enqueueStudentEvents โหลดข้อมูลล่าสุดของนักเรียน (ภายใน transaction) แล้วบันทึก event ทุกประเภทที่ระบุ
+func enqueueStudentEvents(ctx context.Context, db outboxWriter, studentID int, eventTypes ...string) error {
+	student, err := loadStudent(ctx, db, studentID)
+	if err != nil {
+		return fmt.Errorf("failed to load student %d for events %v: %v", studentID, eventTypes, err)
+	}
+	for _, eventType := range eventTypes {
+		if err := enqueueStudentEvent(ctx, db, eventType, student); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// outboxEvent event ใน student_event_outbox ที่ยังไม่ได้ส่ง
+type outboxEvent struct {
+	EventID    string
+	EventType  string
+	StudentID  int
+	Payload    []byte
+	OccurredAt time.Time
+}
+
+// ขนาดของแต่ละรอบที่ relay ส่ง และระยะเวลาที่เก็บ event ที่ส่งแล้วไว้ตรวจสอบย้อนหลัง
+const (
+	outboxRelayBatch     = 100
+	outboxRetention      = 7 * 24 * time.Hour
+	outboxConfirmTimeout = 5 * time.Second
+)
+
+// relayOutbox ส่ง event ที่ค้างอยู่ตามลำดับที่บันทึก และทำเครื่องหมายว่าส่งแล้วเมื่อ send สำเร็จเท่านั้น
+// ถ้าส่งไม่สำเร็จจะหยุดรอบนี้ไว้ (event ยังค้างอยู่ รอบถัดไปจะลองใหม่) เพื่อไม่ให้ event ของนักเรียนคนเดียวกันสลับลำดับ
+// lock แถวด้วย SKIP LOCKED เพื่อให้รันหลาย instance พร้อมกันได้โดยไม่ส่งซ้ำกัน
+func relayOutbox(ctx context.Context, db studentBeginner, send func(outboxEvent) error) (int, error) {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback(ctx)
+
+	rows, err := tx.Query(ctx,
+		`SELECT "outbox_id", "event_id", "event_type", "student_id", "payload", "occurred_at" FROM student_event_outbox
+		WHERE "published_at" IS NULL ORDER BY "outbox_id" LIMIT $1 FOR UPDATE SKIP LOCKED`,
+		outboxRelayBatch,
+	)
+	if err != nil {
+		return 0, err
+	}
+	var ids []int64
+	var pending []outboxEvent
+	for rows.Next() {
+		var id int64
+		var e outboxEvent
+		if err := rows.Scan(&id, &e.EventID, &e.EventType, &e.StudentID, &e.Payload, &e.OccurredAt); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		ids = append(ids, id)
+		pending = append(pending, e)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	sent := 0
+	var sendErr error
+	for i, e := range pending {
+		if sendErr = send(e); sendErr != nil {
+			_, err := tx.Exec(ctx,
+				`UPDATE student_event_outbox SET "attempts" = "attempts" + 1, "last_error" = $2 WHERE "outbox_id" = $1`,
+				ids[i], sendErr.Error(),
+			)
+			if err != nil {
+				return 0, err
+			}
+			break
+		}
+		if _, err := tx.Exec(ctx, `UPDATE student_event_outbox SET "published_at" = NOW() WHERE "outbox_id" = $1`, ids[i]); err != nil {
+			return 0, err
+		}
+		sent++
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return 0, err
+	}
+	if sendErr != nil {
+		return sent, fmt.Errorf("failed to publish %s event for student %d: %v", pending[sent].EventType, pending[sent].StudentID, sendErr)
+	}
+	return sent, nil
+}
+
+// EventPublisher ส่ง event จาก student_event_outbox ไปยัง RabbitMQ (transactional outbox)
+// channel อยู่ใน confirm mode และ event จะถูกนับว่าส่งแล้วก็ต่อเมื่อ broker ยืนยัน (ack) เท่านั้น
+// ระหว่าง RabbitMQ หลุด event จะค้างอยู่ในตารางแล้วถูกส่งเมื่อเชื่อมต่อใหม่ได้
+// ถ้าเป็น nil (เช่นตอนเทส) event จะค้างอยู่ในตารางโดยไม่มีใครส่ง
+type EventPublisher struct {
+	pool    *pgxpool.Pool
+	wake    chan struct{}
+	mu      sync.Mutex
+	channel *amqp.Channel
+}
+
+// newEventPublisher เปิด channel แบบ confirm mode สำหรับ publish event ประกาศ exchange แล้วเริ่ม relay เบื้องหลัง
+// relay ใช้ pool ของตัวเอง ไม่ใช้ WriteConn ร่วมกับ request
+func newEventPublisher(rabbit *rabbitmq.Connection, pool *pgxpool.Pool) *EventPublisher {
+	p := &EventPublisher{pool: pool, wake: make(chan struct{}, 1)}
+	err := rabbit.OnChannel("event publisher", func(ch *amqp.Channel) error {
+		if err := ch.ExchangeDeclare(studentEventsExchange, "topic", true, false, false, false, nil); err != nil {
+			return err
+		}
+		if err := ch.Confirm(false); err != nil {
+			return err
+		}
+
+		p.mu.Lock()
+		p.channel = ch
+		p.mu.Unlock()
+		p.Notify()
+		return nil
+	})
+	if err != nil {
+		log.Fatal("RabbitMQ Event Channel Error:", err)
+	}
+	go p.run()
+	return p
+}
+
+// Notify ปลุก relay ให้ส่ง event ทันทีหลัง commit (ไม่เช่นนั้นจะถูกส่งในรอบถัดไปของ OUTBOX_RELAY_INTERVAL)
+func (p *EventPublisher) Notify() {
+	if p == nil {
+		return
+	}
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
+
+// run วนส่ง event ที่ค้างอยู่ทุกครั้งที่ถูกปลุกหรือครบรอบ และลบ event ที่ส่งแล้วเกิน outboxRetention
+func (p *EventPublisher) run() {
+	interval := 5 * time.Second
+	if v, err := time.ParseDuration(os.Getenv("OUTBOX_RELAY_INTERVAL")); err == nil && v > 0 {
+		interval = v
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	cleanup := time.NewTicker(time.Hour)
+	defer cleanup.Stop()
+
+	for {
+		select {
+		case <-p.wake:
+		case <-ticker.C:
+		case <-cleanup.C:
+			_, err := p.pool.Exec(context.Background(),
+				`DELETE FROM student_event_outbox WHERE "published_at" < $1`, time.Now().Add(-outboxRetention))
+			if err != nil {
+				log.Printf("Failed to clean up published student events: %v", err)
+			}
+			continue
+		}
+
+		for {
+			n, err := relayOutbox(context.Background(), p.pool, p.send)
+			if err != nil {
+				log.Printf("Student event relay: %v", err)
+				break
+			}
+			if n < outboxRelayBatch {
+				break
+			}
+		}
+	}
+}
+
+// send publish event 1 รายการแล้วรอให้ broker ยืนยัน
+func (p *EventPublisher) send(e outboxEvent) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.channel == nil || p.channel.IsClosed() {
+		return rabbitmq.ErrUnavailable
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), outboxConfirmTimeout)
+	defer cancel()
+
+	confirm, err := p.channel.PublishWithDeferredConfirmWithContext(ctx,
+		studentEventsExchange, // exchange
+		e.EventType,           // routing key
+		false,                 // mandatory
+		false,                 // immediate
+		amqp.Publishing{
+			ContentType:  "application/json",
+			DeliveryMode: amqp.Persistent,
+			MessageId:    e.EventID,
+			Type:         e.EventType,
+			Timestamp:    e.OccurredAt,
+			Body:         e.Payload,
+		})
+	if err != nil {
+		return err
+	}
+	acked, err := confirm.WaitContext(ctx)
+	if err != nil {
+		return fmt.Errorf("no publisher confirm: %v", err)
+	}
+	if !acked {
+		return fmt.Errorf("event nacked by broker")
+	}
+	log.Printf("Published %s event for student %d", e.EventType, e.StudentID)
+	return nil
+}
+
+// sameSubjects เช็คว่ารายวิชาที่ผ่านแล้วสองชุดเหมือนกันหรือไม่ (ไม่สนลำดับ)
+func sameSubjects(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	count := make(map[string]int)
+	for _, s := range a {
+		count[s]++
+	}
+	for _, s := range b {
+		count[s]--
+		if count[s] < 0 {
+			return false
+		}
+	}
+	return true
+}
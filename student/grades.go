@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+	"github.com/sony/gobreaker"
+)
+
+// วิชาที่ผ่านแล้ว (graded_subject) ใช้ตรวจวิชาบังคับก่อนตอนลงทะเบียน นักเรียนจึงแก้เองไม่ได้
+// แก้ได้เฉพาะ registrar/advisor ผ่าน PUT /students/:id/graded-subjects หรือนำเข้าจาก CSV
+
+// gradedSubjectsUpdate body ของ PUT /students/:id/graded-subjects (ส่ง [] เพื่อล้าง)
+type gradedSubjectsUpdate struct {
+	GradedSubject []string `json:"graded_subject" binding:"required,unique,dive,required,max=255"`
+}
+
+// respondGradedSubjectForbidden ตอบ 403 เมื่อนักเรียนพยายามกำหนดวิชาที่ผ่านแล้วเอง
+func respondGradedSubjectForbidden(c *gin.Context) {
+	c.JSON(http.StatusForbidden, gin.H{"error": "graded_subject can only be changed by a registrar or advisor (PUT /students/:id/graded-subjects)"})
+}
+
+// registerGradedSubjectRoutes กำหนดวิชาที่ผ่านแล้วของนักเรียน (registrar/advisor)
+func registerGradedSubjectRoutes(r *gin.Engine, dbConns *DBConnections, tokens *TokenIssuer, events *EventPublisher, writeCircuitBreaker *gobreaker.CircuitBreaker) {
+	r.PUT("/students/:id/graded-subjects", RoleRequired(tokens, roleRegistrar, roleAdvisor), func(c *gin.Context) {
+		studentID, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid student ID"})
+			return
+		}
+		var body gradedSubjectsUpdate
+		if !bindAndValidate(c, &body) {
+			return
+		}
+		expectedVersion, ok := requireIfMatch(c)
+		if !ok {
+			return
+		}
+
+		var currentVersion, newVersion int
+		var before Student
+		notFound := false
+		_, err = writeCircuitBreaker.Execute(func() (interface{}, error) {
+			ctx := context.Background()
+			tx, err := dbConns.WriteConn.Begin(ctx)
+			if err != nil {
+				return nil, err
+			}
+			defer tx.Rollback(ctx)
+
+			currentVersion, err = checkStudentVersion(ctx, tx, studentID, expectedVersion)
+			if err == pgx.ErrNoRows {
+				// ไม่ใช่ความผิดของฐานข้อมูล ไม่นับเป็น failure ของ circuit breaker
+				notFound = true
+				return nil, nil
+			}
+			if err == errVersionMismatch {
+				return nil, nil
+			}
+			if err != nil {
+				return nil, err
+			}
+			if err := tx.QueryRow(ctx, `SELECT graded_subject FROM student WHERE student_id = $1`, studentID).Scan(&before.GradedSubject); err != nil {
+				return nil, err
+			}
+			err = tx.QueryRow(ctx,
+				`UPDATE student SET graded_subject = $1, "version" = "version" + 1 WHERE student_id = $2 RETURNING "version"`,
+				body.GradedSubject, studentID,
+			).Scan(&newVersion)
+			if err != nil {
+				return nil, err
+			}
+			// grades_changed ทำให้ enrollment-service ตรวจวิชาบังคับก่อนด้วยข้อมูลใหม่ จึงต้องบันทึกพร้อมกับการแก้
+			eventTypes := []string{EventStudentUpdated}
+			if !sameSubjects(before.GradedSubject, body.GradedSubject) {
+				eventTypes = append(eventTypes, EventStudentGradesChanged)
+			}
+			if err := enqueueStudentEvents(ctx, tx, studentID, eventTypes...); err != nil {
+				return nil, err
+			}
+			return nil, tx.Commit(ctx)
+		})
+
+		if err == gobreaker.ErrOpenState {
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Service temporarily unavailable (circuit breaker is open)"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to set graded subjects: " + err.Error()})
+			return
+		}
+		if notFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Student not found"})
+			return
+		}
+		if newVersion == 0 {
+			c.Header("ETag", etagFor(currentVersion))
+			c.JSON(http.StatusPreconditionFailed, gin.H{"error": "Student was modified by someone else, reload and try again"})
+			return
+		}
+
+		events.Notify()
+
+		c.Header("ETag", etagFor(newVersion))
+		c.JSON(http.StatusOK, gin.H{"student_id": studentID, "graded_subject": body.GradedSubject, "version": newVersion})
+	})
+}
@@ -9,10 +9,9 @@ import (
 	"net/http"
 	"os"
 
-	"github.com/gin-contrib/sessions"
-	"github.com/gin-contrib/sessions/cookie"
 	"github.com/gin-gonic/gin"
 	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/sony/gobreaker"
 	"golang.org/x/crypto/bcrypt"
 
@@ -20,6 +19,8 @@ import (
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"shared/rabbitmq"
 )
 
 func registerConsul(serviceName string, port int) {
@@ -103,6 +104,46 @@ type Student struct {
 	Gender        string   `json:"gender"`
 	YearLevel     int      `json:"year_level"`
 	GradedSubject []string `json:"graded_subject"`
+	Version       int      `json:"version"`
+}
+
+// StudentProfile ข้อมูลที่นักเรียนแก้เองได้ผ่าน PUT /profile (graded_subject แก้ได้เฉพาะ registrar/advisor ดู grades.go)
+type StudentProfile struct {
+	FirstName string `json:"first_name" binding:"required,max=255"`
+	LastName  string `json:"last_name"  binding:"required,max=255"`
+	Birthdate string `json:"birthdate"  binding:"required,birthdate"`
+	Gender    string `json:"gender"     binding:"required,oneof=Male Female Other"`
+	YearLevel int    `json:"year_level" binding:"required,gte=1,lte=8"`
+}
+
+// NewStudent ข้อมูลนักเรียนใหม่ (ใช้ทั้งสมัครเองและนำเข้าจาก CSV)
+// สมัครเองต้องไม่มี graded_subject ส่วนการนำเข้าจาก CSV (registrar) กำหนดได้
+type NewStudent struct {
+	StudentID int `json:"student_id" binding:"required,gt=0"`
+	StudentProfile
+	Email         string   `json:"email"          binding:"required,email,max=255"`
+	GradedSubject []string `json:"graded_subject" binding:"omitempty,unique,dive,required,max=255"`
+}
+
+// RegisterRequest body ของ POST /register (bcrypt ใช้ได้ไม่เกิน 72 byte)
+type RegisterRequest struct {
+	NewStudent
+	Password string `json:"password" binding:"required,min=8,max=72"`
+}
+
+// Student ข้อมูลนักเรียนจากคำขอ (ไม่รวม password)
+func (n NewStudent) Student() Student {
+	return Student{
+		StudentID:     n.StudentID,
+		FirstName:     n.FirstName,
+		LastName:      n.LastName,
+		Email:         n.Email,
+		Birthdate:     n.Birthdate,
+		Gender:        n.Gender,
+		YearLevel:     n.YearLevel,
+		GradedSubject: n.GradedSubject,
+		Version:       1,
+	}
 }
 
 // ฟังก์ชันสำหรับ Hash Password
@@ -151,29 +192,47 @@ func connectToWriteDB() *pgx.Conn {
 	return conn
 }
 
-func AuthRequired() gin.HandlerFunc {
-	return func(c *gin.Context) {
-		session := sessions.Default(c)
-		user := session.Get("user_id")
-		if user == nil {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "กรุณา Login ก่อนเข้าใช้งาน"})
-			c.Abort()
-			return
-		}
-		c.Next()
+// connectToOutboxPool pool เล็ก ๆ สำหรับ relay ของ student_event_outbox
+// relay ทำงานพร้อมกับ request จึงใช้ *pgx.Conn ของ WriteConn ร่วมไม่ได้
+func connectToOutboxPool() *pgxpool.Pool {
+	host := os.Getenv("DB_WRITE_HOST")
+	if host == "" {
+		host = "localhost"
+	}
+	connStr := fmt.Sprintf("user=postgres password=1234 host=%s port=5432 dbname=register sslmode=disable pool_max_conns=2", host)
+	pool, err := pgxpool.New(context.Background(), connStr)
+	if err != nil {
+		log.Fatal("Unable to create outbox connection pool:", err)
 	}
+	if err := pool.Ping(context.Background()); err != nil {
+		log.Fatal("Outbox pool ping failed:", err)
+	}
+	fmt.Println("Successfully created PostgreSQL outbox connection pool (Student Service)!")
+	return pool
+}
+
+// studentQuerier ใช้ได้ทั้ง *pgx.Conn และ pgx.Tx
+type studentQuerier interface {
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+}
+
+// loadStudent ดึงข้อมูลนักเรียน 1 คน (ไม่รวม password)
+func loadStudent(ctx context.Context, conn studentQuerier, studentID interface{}) (Student, error) {
+	var s Student
+	err := conn.QueryRow(ctx,
+		`SELECT student_id, first_name, last_name, email, birthdate, gender, year_level, graded_subject, "version" FROM student WHERE student_id = $1`,
+		studentID,
+	).Scan(&s.StudentID, &s.FirstName, &s.LastName, &s.Email, &s.Birthdate, &s.Gender, &s.YearLevel, &s.GradedSubject, &s.Version)
+	return s, err
 }
 
-func SetupRouter(dbConns *DBConnections) *gin.Engine {
+func SetupRouter(dbConns *DBConnections, events *EventPublisher, tokens *TokenIssuer) *gin.Engine {
 	r := gin.Default()
 
 	// ใช้งาน Prometheus Middleware
 	r.Use(PrometheusMiddleware())
 	r.GET("/metrics", gin.WrapH(promhttp.Handler()))
 
-	store := cookie.NewStore([]byte("super-secret-key"))
-	r.Use(sessions.Sessions("student_session", store))
-
 	// สร้าง circuit breaker สำหรับ database read
 	readSettings := gobreaker.Settings{
 		Name:        "Database-Read-Operations",
@@ -200,12 +259,16 @@ func SetupRouter(dbConns *DBConnections) *gin.Engine {
 	}
 	writeCircuitBreaker := gobreaker.NewCircuitBreaker(writeSettings)
 
+	// ข้อมูลนักเรียนเห็นได้เฉพาะเจ้าของ อาจารย์ที่ปรึกษา และ registrar (role ดู roles.go)
+	requireStaff := RoleRequired(tokens, roleAdvisor, roleRegistrar)
+	requireRegistrar := RoleRequired(tokens, roleRegistrar)
+
 	// GET all students
-	r.GET("/students", func(c *gin.Context) {
+	r.GET("/students", requireStaff, func(c *gin.Context) {
 		var students []Student
 
 		_, err := readCircuitBreaker.Execute(func() (interface{}, error) {
-			rows, err := dbConns.ReadConn.Query(context.Background(), `SELECT student_id, first_name, last_name, email, birthdate, gender, year_level, graded_subject FROM student`)
+			rows, err := dbConns.ReadConn.Query(context.Background(), `SELECT student_id, first_name, last_name, email, birthdate, gender, year_level, graded_subject, "version" FROM student`)
 			if err != nil {
 				return nil, err
 			}
@@ -213,7 +276,7 @@ func SetupRouter(dbConns *DBConnections) *gin.Engine {
 
 			for rows.Next() {
 				var s Student
-				err := rows.Scan(&s.StudentID, &s.FirstName, &s.LastName, &s.Email, &s.Birthdate, &s.Gender, &s.YearLevel, &s.GradedSubject)
+				err := rows.Scan(&s.StudentID, &s.FirstName, &s.LastName, &s.Email, &s.Birthdate, &s.Gender, &s.YearLevel, &s.GradedSubject, &s.Version)
 				if err != nil {
 					return nil, err
 				}
@@ -234,16 +297,85 @@ func SetupRouter(dbConns *DBConnections) *gin.Engine {
 		c.JSON(http.StatusOK, students)
 	})
 
+	// snapshot ของนักเรียนทั้งหมด ใช้สำหรับ rebuild read model ของ service อื่น
+	// service อื่นเรียกด้วย service token ที่ออกให้ student-service ส่วนผู้ใช้ต้องเป็น registrar
+	r.GET("/students/snapshot", RoleRequired(tokens, roleRegistrar, roleService), func(c *gin.Context) {
+		snapshotAt := time.Now().UTC()
+		students := []Student{}
+
+		_, err := readCircuitBreaker.Execute(func() (interface{}, error) {
+			rows, err := dbConns.ReadConn.Query(context.Background(), `SELECT student_id, first_name, last_name, email, birthdate, gender, year_level, graded_subject, "version" FROM student ORDER BY student_id`)
+			if err != nil {
+				return nil, err
+			}
+			defer rows.Close()
+
+			for rows.Next() {
+				var s Student
+				err := rows.Scan(&s.StudentID, &s.FirstName, &s.LastName, &s.Email, &s.Birthdate, &s.Gender, &s.YearLevel, &s.GradedSubject, &s.Version)
+				if err != nil {
+					return nil, err
+				}
+				students = append(students, s)
+			}
+			return students, rows.Err()
+		})
+
+		if err == gobreaker.ErrOpenState {
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Service temporarily unavailable (circuit breaker is open)"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to query students: " + err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"snapshot_at": snapshotAt,
+			"version":     studentEventVersion,
+			"students":    students,
+		})
+	})
+
+	// ค้นหานักเรียนจากอีเมล (ไม่สนตัวพิมพ์เล็กใหญ่) GET /students/lookup?email=...
+	r.GET("/students/lookup", requireStaff, func(c *gin.Context) {
+		email := c.Query("email")
+		if email == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "email query parameter is required"})
+			return
+		}
+		var s Student
+
+		_, err := readCircuitBreaker.Execute(func() (interface{}, error) {
+			return nil, dbConns.ReadConn.QueryRow(context.Background(),
+				`SELECT student_id, first_name, last_name, email, birthdate, gender, year_level, graded_subject, "version" FROM student WHERE LOWER(email) = LOWER($1)`,
+				email,
+			).Scan(&s.StudentID, &s.FirstName, &s.LastName, &s.Email, &s.Birthdate, &s.Gender, &s.YearLevel, &s.GradedSubject, &s.Version)
+		})
+
+		if err == gobreaker.ErrOpenState {
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Service temporarily unavailable (circuit breaker is open)"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Student not found"})
+			return
+		}
+
+		c.Header("ETag", etagFor(s.Version))
+		c.JSON(http.StatusOK, s)
+	})
+
 	// GET student by ID
-	r.GET("/students/:id", func(c *gin.Context) {
+	r.GET("/students/:id", SelfOrRoleRequired(tokens, "id", roleAdvisor, roleRegistrar), func(c *gin.Context) {
 		id := c.Param("id")
 		var s Student
 
 		_, err := readCircuitBreaker.Execute(func() (interface{}, error) {
 			return nil, dbConns.ReadConn.QueryRow(context.Background(),
-				`SELECT student_id, first_name, last_name, email, birthdate, gender, year_level, graded_subject FROM student WHERE student_id = $1`,
+				`SELECT student_id, first_name, last_name, email, birthdate, gender, year_level, graded_subject, "version" FROM student WHERE student_id = $1`,
 				id,
-			).Scan(&s.StudentID, &s.FirstName, &s.LastName, &s.Email, &s.Birthdate, &s.Gender, &s.YearLevel, &s.GradedSubject)
+			).Scan(&s.StudentID, &s.FirstName, &s.LastName, &s.Email, &s.Birthdate, &s.Gender, &s.YearLevel, &s.GradedSubject, &s.Version)
 		})
 
 		if err == gobreaker.ErrOpenState {
@@ -255,39 +387,86 @@ func SetupRouter(dbConns *DBConnections) *gin.Engine {
 			return
 		}
 
+		c.Header("ETag", etagFor(s.Version))
 		c.JSON(http.StatusOK, s)
 	})
 
+	// นำเข้านักเรียนทั้งรุ่นจาก CSV (ดู bulk_import.go)
+	registerStudentImportRoutes(r, dbConns, events, writeCircuitBreaker, requireRegistrar)
+
+	// role ของบัญชี
+	registerRoleRoutes(r, dbConns, tokens, readCircuitBreaker, writeCircuitBreaker)
+
+	// วิชาที่ผ่านแล้ว (registrar/advisor)
+	registerGradedSubjectRoutes(r, dbConns, tokens, events, writeCircuitBreaker)
+
 	// 1. Register พร้อม Hash Password
 	r.POST("/register", func(c *gin.Context) {
-		var s Student
-		if err := c.ShouldBindJSON(&s); err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		var req RegisterRequest
+		if !bindAndValidate(c, &req) {
 			return
 		}
+		if len(req.GradedSubject) > 0 {
+			respondGradedSubjectForbidden(c)
+			return
+		}
+		s := req.Student()
 
-		hashedPassword, err := hashPassword(s.Password)
+		hashedPassword, err := hashPassword(req.Password)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to hash password"})
 			return
 		}
 
 		_, err = writeCircuitBreaker.Execute(func() (interface{}, error) {
-			return dbConns.WriteConn.Exec(context.Background(),
+			ctx := context.Background()
+			tx, err := dbConns.WriteConn.Begin(ctx)
+			if err != nil {
+				return nil, err
+			}
+			defer tx.Rollback(ctx)
+
+			// เช็คก่อนเพื่อให้ได้ 409 แม้ฐานข้อมูลเก่ายังไม่มี unique index (ดู email.go)
+			taken, err := emailTaken(ctx, tx, s.Email)
+			if err != nil {
+				return nil, err
+			}
+			if taken {
+				return nil, errEmailTaken
+			}
+			_, err = tx.Exec(ctx,
 				`INSERT INTO student (student_id, first_name, last_name, email, password, birthdate, gender, year_level, graded_subject) 
 				 VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`,
 				s.StudentID, s.FirstName, s.LastName, s.Email, hashedPassword, s.Birthdate, s.Gender, s.YearLevel, s.GradedSubject,
 			)
+			if err != nil {
+				return nil, err
+			}
+			if err := enqueueStudentEvent(ctx, tx, EventStudentRegistered, s); err != nil {
+				return nil, err
+			}
+			return nil, tx.Commit(ctx)
 		})
 
 		if err == gobreaker.ErrOpenState {
 			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Service temporarily unavailable (circuit breaker is open)"})
 			return
 		}
+		if err == errEmailTaken || isUniqueViolation(err, studentEmailIndex) {
+			c.JSON(http.StatusConflict, gin.H{"error": "Email " + s.Email + " is already registered"})
+			return
+		}
+		if isUniqueViolation(err, "student_pkey") || isUniqueViolation(err, "student_student_id_key") {
+			c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("student_id %d already exists", s.StudentID)})
+			return
+		}
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Registration failed: " + err.Error()})
 			return
 		}
+
+		events.Notify()
+
 		c.JSON(http.StatusCreated, gin.H{"message": "ลงทะเบียนสำเร็จ"})
 	})
 
@@ -302,12 +481,12 @@ func SetupRouter(dbConns *DBConnections) *gin.Engine {
 			return
 		}
 
-		var studentID int
+		var id Identity
 		var dbPassword string
 
 		_, err := readCircuitBreaker.Execute(func() (interface{}, error) {
 			return nil, dbConns.ReadConn.QueryRow(context.Background(),
-				`SELECT student_id, password FROM student WHERE email = $1`, loginData.Email).Scan(&studentID, &dbPassword)
+				`SELECT student_id, email, roles, password FROM student WHERE LOWER(email) = LOWER($1)`, loginData.Email).Scan(&id.StudentID, &id.Email, &id.Roles, &dbPassword)
 		})
 
 		if err == gobreaker.ErrOpenState {
@@ -320,32 +499,66 @@ func SetupRouter(dbConns *DBConnections) *gin.Engine {
 			return
 		}
 
-		session := sessions.Default(c)
-		session.Set("user_id", studentID)
-		session.Save()
+		// ออก JWT (ดู token.go) service อื่นตรวจ access token เองได้จาก /.well-known/jwks.json
+		var pair *TokenPair
+		_, err = writeCircuitBreaker.Execute(func() (interface{}, error) {
+			result, err := tokens.issueTokens(context.Background(), dbConns.WriteConn, id)
+			pair = result
+			return result, err
+		})
+		if err == gobreaker.ErrOpenState {
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Service temporarily unavailable (circuit breaker is open)"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to issue token: " + err.Error()})
+			return
+		}
 
-		c.JSON(http.StatusOK, gin.H{"message": "Login สำเร็จ", "student_id": studentID})
+		c.Header("Cache-Control", "no-store")
+		c.JSON(http.StatusOK, gin.H{
+			"message":            "Login สำเร็จ",
+			"student_id":         id.StudentID,
+			"roles":              id.Roles,
+			"access_token":       pair.AccessToken,
+			"refresh_token":      pair.RefreshToken,
+			"token_type":         pair.TokenType,
+			"expires_in":         pair.ExpiresIn,
+			"refresh_expires_in": pair.RefreshExpiresIn,
+		})
 	})
 
-	r.POST("/logout", func(c *gin.Context) {
-		session := sessions.Default(c)
-		session.Clear()
-		session.Save()
+	// JWKS, POST /token/refresh และ POST /token/service
+	registerTokenRoutes(r, dbConns, tokens, writeCircuitBreaker)
+
+	// logout เพิกถอน refresh token ทั้งหมด ส่วน access token ใช้ได้จนหมดอายุ (ไม่เกิน JWT_ACCESS_TTL)
+	r.POST("/logout", AuthRequired(tokens), func(c *gin.Context) {
+		_, err := writeCircuitBreaker.Execute(func() (interface{}, error) {
+			return nil, revokeRefreshTokens(context.Background(), dbConns.WriteConn, identityFrom(c).StudentID)
+		})
+		if err == gobreaker.ErrOpenState {
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Service temporarily unavailable (circuit breaker is open)"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Logout failed: " + err.Error()})
+			return
+		}
 		c.JSON(http.StatusOK, gin.H{"message": "Logout สำเร็จ"})
 	})
 
 	profile := r.Group("/profile")
-	profile.Use(AuthRequired())
+	profile.Use(AuthRequired(tokens))
 	{
 		profile.GET("", func(c *gin.Context) {
-			userID := sessions.Default(c).Get("user_id")
+			userID := identityFrom(c).StudentID
 			var s Student
 
 			_, err := readCircuitBreaker.Execute(func() (interface{}, error) {
 				return nil, dbConns.ReadConn.QueryRow(context.Background(),
-					`SELECT student_id, first_name, last_name, email, birthdate, gender, year_level, graded_subject 
+					`SELECT student_id, first_name, last_name, email, birthdate, gender, year_level, graded_subject, "version"
 					 FROM student WHERE student_id = $1`, userID).Scan(
-					&s.StudentID, &s.FirstName, &s.LastName, &s.Email, &s.Birthdate, &s.Gender, &s.YearLevel, &s.GradedSubject,
+					&s.StudentID, &s.FirstName, &s.LastName, &s.Email, &s.Birthdate, &s.Gender, &s.YearLevel, &s.GradedSubject, &s.Version,
 				)
 			})
 
@@ -357,33 +570,84 @@ func SetupRouter(dbConns *DBConnections) *gin.Engine {
 				c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
 				return
 			}
+			c.Header("ETag", etagFor(s.Version))
 			c.JSON(http.StatusOK, s)
 		})
 
 		profile.PUT("", func(c *gin.Context) {
-			userID := sessions.Default(c).Get("user_id")
-			var up Student
-			if err := c.ShouldBindJSON(&up); err != nil {
-				c.JSON(http.StatusBadRequest, gin.H{"error": "ข้อมูลไม่ถูกต้อง"})
+			userID := identityFrom(c).StudentID
+			var up struct {
+				StudentProfile
+				// รับไว้เพื่อให้ส่งข้อมูลจาก GET /profile กลับมาทั้งก้อนได้ แต่ต้องเท่าเดิม
+				GradedSubject []string `json:"graded_subject"`
+			}
+			if !bindAndValidate(c, &up) {
 				return
 			}
 
+			expectedVersion, ok := requireIfMatch(c)
+			if !ok {
+				return
+			}
+
+			// วิชาที่ผ่านแล้วแก้เองไม่ได้
+			if up.GradedSubject != nil {
+				before, err := loadStudent(context.Background(), dbConns.WriteConn, userID)
+				if err == nil && !sameSubjects(before.GradedSubject, up.GradedSubject) {
+					respondGradedSubjectForbidden(c)
+					return
+				}
+			}
+
+			// lock แถวแล้วเทียบ version ก่อนแก้ ถ้ามีคนแก้ไปก่อนจะไม่เขียนทับ
+			var currentVersion, newVersion int
 			_, err := writeCircuitBreaker.Execute(func() (interface{}, error) {
-				return dbConns.WriteConn.Exec(context.Background(),
-					`UPDATE student SET first_name=$1, last_name=$2, birthdate=$3, gender=$4, year_level=$5, graded_subject=$6 WHERE student_id=$7`,
-					up.FirstName, up.LastName, up.Birthdate, up.Gender, up.YearLevel, up.GradedSubject, userID,
-				)
+				ctx := context.Background()
+				tx, err := dbConns.WriteConn.Begin(ctx)
+				if err != nil {
+					return nil, err
+				}
+				defer tx.Rollback(ctx)
+
+				currentVersion, err = checkStudentVersion(ctx, tx, userID, expectedVersion)
+				if err != nil {
+					return nil, err
+				}
+				err = tx.QueryRow(ctx,
+					`UPDATE student SET first_name=$1, last_name=$2, birthdate=$3, gender=$4, year_level=$5, "version" = "version" + 1 WHERE student_id=$6 RETURNING "version"`,
+					up.FirstName, up.LastName, up.Birthdate, up.Gender, up.YearLevel, userID,
+				).Scan(&newVersion)
+				if err != nil {
+					return nil, err
+				}
+				if err := enqueueStudentEvents(ctx, tx, userID, EventStudentUpdated); err != nil {
+					return nil, err
+				}
+				return nil, tx.Commit(ctx)
 			})
 
 			if err == gobreaker.ErrOpenState {
 				c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Service temporarily unavailable (circuit breaker is open)"})
 				return
 			}
+			if err == errVersionMismatch {
+				c.Header("ETag", etagFor(currentVersion))
+				c.JSON(http.StatusPreconditionFailed, gin.H{"error": "Profile was modified by someone else, reload and try again"})
+				return
+			}
+			if err == pgx.ErrNoRows {
+				c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+				return
+			}
 			if err != nil {
 				c.JSON(http.StatusInternalServerError, gin.H{"error": "Update failed"})
 				return
 			}
-			c.JSON(http.StatusOK, gin.H{"message": "อัปเดตข้อมูลสำเร็จ"})
+
+			events.Notify()
+
+			c.Header("ETag", etagFor(newVersion))
+			c.JSON(http.StatusOK, gin.H{"message": "อัปเดตข้อมูลสำเร็จ", "version": newVersion})
 		})
 	}
 
@@ -391,6 +655,21 @@ func SetupRouter(dbConns *DBConnections) *gin.Engine {
 }
 
 func main() {
+	// คำสั่งดูแลฐานข้อมูล
+	// ใช้งาน: ./student-service migrate-unique-email [-dry-run] (ดู email.go)
+	//        ./student-service set-roles -roles admin,registrar <email> (ดู roles.go)
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "migrate-unique-email":
+			runEmailCommand(os.Args[1:])
+		case "set-roles":
+			runSetRolesCommand(os.Args[2:])
+		default:
+			log.Fatalf("Unknown command: %s", os.Args[1])
+		}
+		return
+	}
+
 	registerConsul("student-service", 8001)
 
 	readConn := connectToReadDB()
@@ -403,7 +682,18 @@ func main() {
 		WriteConn: writeConn,
 	}
 
-	r := SetupRouter(dbConns)
+	// เชื่อมต่อ RabbitMQ สำหรับส่ง domain event (เชื่อมต่อใหม่เองเมื่อหลุด)
+	rabbit := rabbitmq.Connect("Student Service")
+	defer rabbit.Close()
+
+	// event ถูกบันทึกลง student_event_outbox พร้อมกับการเปลี่ยนแปลง แล้ว relay ส่งออกแบบรอ publisher confirm
+	outboxPool := connectToOutboxPool()
+	defer outboxPool.Close()
+	events := newEventPublisher(rabbit, outboxPool)
+
+	tokens := loadTokenIssuer()
+
+	r := SetupRouter(dbConns, events, tokens)
 
 	port := ":8001" // แยกพอร์ตเป็น 8001 ไม่ให้ชนกับ Course
 	fmt.Printf("Student Service started on port %s\n", port)
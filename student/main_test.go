@@ -3,17 +3,29 @@ package main
 import (
 	"bytes"
 	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
 	"encoding/json"
+	"encoding/pem"
 	"fmt"
 	"log"
+	"math/big"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
 	"github.com/jackc/pgx/v5"
 	"github.com/stretchr/testify/assert"
+
+	"shared/rabbitmq"
 )
 
 // ---- Global Test Variables ----
@@ -22,6 +34,7 @@ var (
 	testReadConn  *pgx.Conn
 	testWriteConn *pgx.Conn
 	testDBConns   *DBConnections
+	testTokens    *TokenIssuer
 )
 
 // ---- Test Setup & Teardown ----
@@ -29,6 +42,12 @@ var (
 func TestMain(m *testing.M) {
 	setupTestDB()
 	gin.SetMode(gin.TestMode)
+	// key ขนาดเล็กให้เทสเร็ว ของจริงใช้ JWT_PRIVATE_KEY_FILE
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		log.Fatal("Failed to generate signing key:", err)
+	}
+	testTokens = newTokenIssuer(key)
 	fmt.Println("Connected to test database (read and write)")
 	code := m.Run()
 	teardownTestDB()
@@ -99,6 +118,8 @@ func ensureSchemas() {
 	ctx := context.Background()
 
 	studentSchema := `
+		DROP TABLE IF EXISTS refresh_token;
+		DROP TABLE IF EXISTS student_event_outbox;
 		DROP TABLE IF EXISTS student CASCADE;
 		CREATE TABLE IF NOT EXISTS student (
 			"student_id" INTEGER NOT NULL UNIQUE,
@@ -111,6 +132,26 @@ func ensureSchemas() {
 			"year_level" INTEGER NOT NULL,
 			"graded_subject" VARCHAR(255) ARRAY,
 			PRIMARY KEY("student_id")
+		);
+		ALTER TABLE student ADD COLUMN IF NOT EXISTS "version" INTEGER NOT NULL DEFAULT 1;
+		CREATE UNIQUE INDEX IF NOT EXISTS student_email_lower_key ON student (LOWER(email));
+		ALTER TABLE student ADD COLUMN IF NOT EXISTS "roles" VARCHAR(32) ARRAY NOT NULL DEFAULT '{student}';
+		CREATE TABLE IF NOT EXISTS refresh_token (
+			"jti" VARCHAR(64) PRIMARY KEY,
+			"student_id" INTEGER NOT NULL REFERENCES student("student_id") ON DELETE CASCADE,
+			"expires_at" TIMESTAMPTZ NOT NULL,
+			"revoked_at" TIMESTAMPTZ
+		);
+		CREATE TABLE IF NOT EXISTS student_event_outbox (
+			"outbox_id" BIGSERIAL PRIMARY KEY,
+			"event_id" VARCHAR(255) NOT NULL UNIQUE,
+			"event_type" VARCHAR(255) NOT NULL,
+			"student_id" INTEGER NOT NULL,
+			"payload" JSONB NOT NULL,
+			"occurred_at" TIMESTAMPTZ NOT NULL,
+			"published_at" TIMESTAMPTZ,
+			"attempts" INTEGER NOT NULL DEFAULT 0,
+			"last_error" TEXT
 		);`
 
 	if _, err := testWriteConn.Exec(ctx, studentSchema); err != nil {
@@ -121,6 +162,10 @@ func ensureSchemas() {
 // ---- HTTP Helpers ----
 
 func performRequest(router *gin.Engine, method, path string, body interface{}) *httptest.ResponseRecorder {
+	return performRequestWithHeaders(router, method, path, body, nil)
+}
+
+func performRequestWithHeaders(router *gin.Engine, method, path string, body interface{}, headers map[string]string) *httptest.ResponseRecorder {
 	var reqBody *bytes.Buffer
 	if body != nil {
 		jsonBody, _ := json.Marshal(body)
@@ -133,18 +178,51 @@ func performRequest(router *gin.Engine, method, path string, body interface{}) *
 	if body != nil {
 		req.Header.Set("Content-Type", "application/json")
 	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
 
 	w := httptest.NewRecorder()
 	router.ServeHTTP(w, req)
 	return w
 }
 
+// login แล้วคืน token ที่ได้
+func login(t *testing.T, router *gin.Engine, email, password string) TokenPair {
+	w := performRequest(router, "POST", "/login", map[string]interface{}{"email": email, "password": password})
+	assert.Equal(t, http.StatusOK, w.Code)
+	var pair TokenPair
+	json.Unmarshal(w.Body.Bytes(), &pair)
+	return pair
+}
+
+func bearer(token string) map[string]string {
+	return map[string]string{"Authorization": "Bearer " + token}
+}
+
+// asRole header Authorization ของบัญชี studentID ที่มี role ที่ระบุ (ไม่ต้อง login)
+func asRole(studentID int, roles ...string) map[string]string {
+	token, _, _, err := testTokens.sign(Identity{StudentID: studentID, Roles: roles}, tokenUseAccess, time.Hour)
+	if err != nil {
+		log.Fatal("Failed to sign test token:", err)
+	}
+	return bearer(token)
+}
+
+func withHeader(headers map[string]string, key, value string) map[string]string {
+	merged := map[string]string{key: value}
+	for k, v := range headers {
+		merged[k] = v
+	}
+	return merged
+}
+
 // ---- Tests ----
 
 func TestGetStudents_Success(t *testing.T) {
 	resetDB()
-	router := SetupRouter(testDBConns)
-	w := performRequest(router, "GET", "/students", nil)
+	router := SetupRouter(testDBConns, nil, testTokens)
+	w := performRequestWithHeaders(router, "GET", "/students", nil, asRole(9, roleRegistrar))
 
 	assert.Equal(t, http.StatusOK, w.Code)
 
@@ -156,8 +234,8 @@ func TestGetStudents_Success(t *testing.T) {
 
 func TestGetStudent_Success(t *testing.T) {
 	resetDB()
-	router := SetupRouter(testDBConns)
-	w := performRequest(router, "GET", "/students/1", nil)
+	router := SetupRouter(testDBConns, nil, testTokens)
+	w := performRequestWithHeaders(router, "GET", "/students/1", nil, asRole(9, roleRegistrar))
 
 	assert.Equal(t, http.StatusOK, w.Code)
 
@@ -170,15 +248,15 @@ func TestGetStudent_Success(t *testing.T) {
 
 func TestGetStudent_NotFound(t *testing.T) {
 	resetDB()
-	router := SetupRouter(testDBConns)
-	w := performRequest(router, "GET", "/students/999", nil)
+	router := SetupRouter(testDBConns, nil, testTokens)
+	w := performRequestWithHeaders(router, "GET", "/students/999", nil, asRole(9, roleRegistrar))
 
 	assert.Equal(t, http.StatusNotFound, w.Code)
 }
 
 func TestRegisterStudent_Success(t *testing.T) {
 	resetDB()
-	router := SetupRouter(testDBConns)
+	router := SetupRouter(testDBConns, nil, testTokens)
 
 	body := map[string]interface{}{
 		"student_id":     3,
@@ -205,9 +283,127 @@ func TestRegisterStudent_Success(t *testing.T) {
 	assert.Equal(t, 3, count)
 }
 
+func TestRegisterStudent_FieldErrors(t *testing.T) {
+	resetDB()
+	router := SetupRouter(testDBConns, nil, testTokens)
+
+	body := map[string]interface{}{
+		"student_id": 4,
+		"first_name": "Bob",
+		"last_name":  "Builder",
+		"email":      "",
+		"password":   "",
+		"birthdate":  "yesterday",
+		"gender":     "robot",
+		"year_level": -1,
+	}
+	w := performRequest(router, "POST", "/register", body)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	var resp struct {
+		Fields []FieldError `json:"fields"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	var fields []string
+	for _, f := range resp.Fields {
+		fields = append(fields, f.Field)
+	}
+	assert.ElementsMatch(t, []string{"email", "password", "birthdate", "gender", "year_level"}, fields)
+
+	var count int
+	testWriteConn.QueryRow(context.Background(), `SELECT COUNT(*) FROM student`).Scan(&count)
+	assert.Equal(t, 2, count)
+}
+
+func TestRegisterStudent_Conflict(t *testing.T) {
+	resetDB()
+	router := SetupRouter(testDBConns, nil, testTokens)
+
+	body := map[string]interface{}{
+		"student_id":     3,
+		"first_name":     "Johnny",
+		"last_name":      "Doe",
+		"email":          "JOHN@Example.com",
+		"password":       "johnny123",
+		"birthdate":      "2002-03-03",
+		"gender":         "Male",
+		"year_level":     1,
+		"graded_subject": []string{},
+	}
+	w := performRequest(router, "POST", "/register", body)
+	assert.Equal(t, http.StatusConflict, w.Code)
+	assert.Contains(t, w.Body.String(), "JOHN@Example.com")
+
+	// รหัสนักเรียนซ้ำก็ได้ 409 เช่นกัน
+	body["student_id"] = 1
+	body["email"] = "johnny@example.com"
+	w = performRequest(router, "POST", "/register", body)
+	assert.Equal(t, http.StatusConflict, w.Code)
+
+	// ฐานข้อมูลกันไว้อีกชั้นแม้ข้ามการเช็คของ API
+	_, err := testWriteConn.Exec(context.Background(),
+		`INSERT INTO student (student_id, first_name, last_name, email, password, birthdate, gender, year_level)
+		 VALUES (5, 'J', 'D', 'John@Example.COM', 'x', '2000-01-01', 'Male', 1)`)
+	assert.True(t, isUniqueViolation(err, studentEmailIndex))
+
+	var count int
+	testWriteConn.QueryRow(context.Background(), `SELECT COUNT(*) FROM student`).Scan(&count)
+	assert.Equal(t, 2, count)
+}
+
+func TestLoginAndLookup_CaseInsensitiveEmail(t *testing.T) {
+	resetDB()
+	router := SetupRouter(testDBConns, nil, testTokens)
+
+	w := performRequest(router, "POST", "/login", map[string]interface{}{
+		"email":    "John@Example.COM",
+		"password": "password123",
+	})
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	staff := asRole(9, roleAdvisor)
+	w = performRequestWithHeaders(router, "GET", "/students/lookup?email=JANE@example.com", nil, staff)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var s Student
+	json.Unmarshal(w.Body.Bytes(), &s)
+	assert.Equal(t, 2, s.StudentID)
+	assert.Equal(t, `"1"`, w.Header().Get("ETag"))
+
+	w = performRequestWithHeaders(router, "GET", "/students/lookup?email=nobody@example.com", nil, staff)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	w = performRequestWithHeaders(router, "GET", "/students/lookup", nil, staff)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestMigrateUniqueEmail_ReportsDuplicates(t *testing.T) {
+	resetDB()
+	ctx := context.Background()
+	defer ensureSchemas()
+
+	// จำลองฐานข้อมูลเดิมที่ยังไม่มี index และมีอีเมลซ้ำ
+	_, err := testWriteConn.Exec(ctx, `DROP INDEX student_email_lower_key`)
+	assert.Nil(t, err)
+	_, err = testWriteConn.Exec(ctx,
+		`INSERT INTO student (student_id, first_name, last_name, email, password, birthdate, gender, year_level)
+		 VALUES (3, 'J', 'D', 'John@Example.com', 'x', '2000-01-01', 'Male', 1)`)
+	assert.Nil(t, err)
+
+	report, err := migrateUniqueEmail(ctx, testWriteConn, false)
+	assert.Nil(t, err)
+	assert.False(t, report.IndexCreated)
+	assert.Equal(t, []DuplicateEmail{{Email: "john@example.com", StudentIDs: []int{1, 3}}}, report.Duplicates)
+
+	_, err = testWriteConn.Exec(ctx, `DELETE FROM student WHERE student_id = 3`)
+	assert.Nil(t, err)
+	report, err = migrateUniqueEmail(ctx, testWriteConn, false)
+	assert.Nil(t, err)
+	assert.True(t, report.IndexCreated)
+	assert.Empty(t, report.Duplicates)
+}
+
 func TestLoginStudent_Success(t *testing.T) {
 	resetDB()
-	router := SetupRouter(testDBConns)
+	router := SetupRouter(testDBConns, nil, testTokens)
 
 	body := map[string]interface{}{
 		"email":    "john@example.com",
@@ -222,11 +418,12 @@ func TestLoginStudent_Success(t *testing.T) {
 	json.Unmarshal(w.Body.Bytes(), &resp)
 	assert.Equal(t, "Login สำเร็จ", resp["message"])
 	assert.Equal(t, float64(1), resp["student_id"])
+	assert.Equal(t, []interface{}{roleStudent}, resp["roles"])
 }
 
 func TestLoginStudent_InvalidCredentials(t *testing.T) {
 	resetDB()
-	router := SetupRouter(testDBConns)
+	router := SetupRouter(testDBConns, nil, testTokens)
 
 	body := map[string]interface{}{
 		"email":    "john@example.com",
@@ -237,3 +434,411 @@ func TestLoginStudent_InvalidCredentials(t *testing.T) {
 
 	assert.Equal(t, http.StatusUnauthorized, w.Code)
 }
+
+// key ที่ mount ไว้ต้องถูกใช้ซ้ำข้าม restart (kid เดิม)
+func TestLoadTokenIssuer_UsesMountedKey(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.Nil(t, err)
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	assert.Nil(t, err)
+	path := filepath.Join(t.TempDir(), "jwt_private.pem")
+	assert.Nil(t, os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600))
+	t.Setenv("JWT_PRIVATE_KEY_FILE", path)
+
+	first, second := loadTokenIssuer(), loadTokenIssuer()
+	assert.Equal(t, first.keyID, second.keyID)
+	assert.Equal(t, keyThumbprint(&key.PublicKey), first.keyID)
+
+	t.Setenv("APP_ENV", "production")
+	assert.False(t, isDevMode())
+	t.Setenv("APP_ENV", "development")
+	assert.True(t, isDevMode())
+}
+
+func TestTokens_JWKSRefreshAndLogout(t *testing.T) {
+	resetDB()
+	router := SetupRouter(testDBConns, nil, testTokens)
+
+	pair := login(t, router, "john@example.com", "password123")
+	assert.Equal(t, "Bearer", pair.TokenType)
+
+	// service อื่นตรวจ access token ได้ด้วย public key จาก JWKS อย่างเดียว
+	w := performRequest(router, "GET", "/.well-known/jwks.json", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var jwks struct {
+		Keys []struct {
+			Kid string `json:"kid"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &jwks)
+	assert.Equal(t, 1, len(jwks.Keys))
+	n, _ := base64.RawURLEncoding.DecodeString(jwks.Keys[0].N)
+	e, _ := base64.RawURLEncoding.DecodeString(jwks.Keys[0].E)
+	publicKey := &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	claims := &TokenClaims{}
+	token, err := jwt.ParseWithClaims(pair.AccessToken, claims, func(token *jwt.Token) (interface{}, error) {
+		assert.Equal(t, jwks.Keys[0].Kid, token.Header["kid"])
+		return publicKey, nil
+	})
+	assert.Nil(t, err)
+	assert.True(t, token.Valid)
+	assert.Equal(t, "1", claims.Subject)
+	assert.Equal(t, tokenUseAccess, claims.TokenUse)
+
+	// ไม่มี token หรือใช้ refresh token แทน access token ไม่ได้
+	w = performRequest(router, "GET", "/profile", nil)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	w = performRequestWithHeaders(router, "GET", "/profile", nil, bearer(pair.RefreshToken))
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	// refresh token ใช้ได้ครั้งเดียว
+	w = performRequest(router, "POST", "/token/refresh", map[string]string{"refresh_token": pair.RefreshToken})
+	assert.Equal(t, http.StatusOK, w.Code)
+	var refreshed TokenPair
+	json.Unmarshal(w.Body.Bytes(), &refreshed)
+	assert.NotEqual(t, pair.RefreshToken, refreshed.RefreshToken)
+	w = performRequestWithHeaders(router, "GET", "/profile", nil, bearer(refreshed.AccessToken))
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	// ใช้ refresh token เดิมซ้ำ = ถูกขโมย เพิกถอนทุก token ของคนนี้
+	w = performRequest(router, "POST", "/token/refresh", map[string]string{"refresh_token": pair.RefreshToken})
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	w = performRequest(router, "POST", "/token/refresh", map[string]string{"refresh_token": refreshed.RefreshToken})
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	// logout เพิกถอน refresh token ที่เหลือ
+	pair = login(t, router, "john@example.com", "password123")
+	w = performRequestWithHeaders(router, "POST", "/logout", nil, bearer(pair.AccessToken))
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = performRequest(router, "POST", "/token/refresh", map[string]string{"refresh_token": pair.RefreshToken})
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
+
+// ทดสอบสิทธิ์ตาม role: นักเรียนเห็นเฉพาะข้อมูลของตัวเอง
+func TestRoles_StudentsReadOnlyTheirOwnData(t *testing.T) {
+	resetDB()
+	router := SetupRouter(testDBConns, nil, testTokens)
+	john := bearer(login(t, router, "john@example.com", "password123").AccessToken)
+
+	w := performRequestWithHeaders(router, "GET", "/students/1", nil, john)
+	assert.Equal(t, http.StatusOK, w.Code)
+	for _, path := range []string{"/students/2", "/students", "/students/snapshot", "/students/lookup?email=jane@example.com"} {
+		w = performRequestWithHeaders(router, "GET", path, nil, john)
+		assert.Equal(t, http.StatusForbidden, w.Code, path)
+	}
+	w = performRequest(router, "GET", "/students/1", nil)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	// อาจารย์ที่ปรึกษาดูได้ทุกคนแต่ดึง snapshot หรือนำเข้าไม่ได้
+	advisor := asRole(30, roleAdvisor)
+	w = performRequestWithHeaders(router, "GET", "/students/2", nil, advisor)
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = performRequestWithHeaders(router, "GET", "/students/snapshot", nil, advisor)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+}
+
+func TestRoles_AdminAssignsRoles(t *testing.T) {
+	resetDB()
+	router := SetupRouter(testDBConns, nil, testTokens)
+	pair := login(t, router, "jane@example.com", "password123")
+
+	// เฉพาะ admin กำหนด role ได้
+	body := map[string][]string{"roles": {"Registrar", "instructor", "registrar"}}
+	w := performRequestWithHeaders(router, "PUT", "/students/2/roles", body, asRole(9, roleRegistrar))
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	w = performRequestWithHeaders(router, "PUT", "/students/2/roles", map[string][]string{"roles": {"dean"}}, asRole(7, roleAdmin))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = performRequestWithHeaders(router, "PUT", "/students/999/roles", body, asRole(7, roleAdmin))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	w = performRequestWithHeaders(router, "PUT", "/students/7/roles", body, asRole(7, roleAdmin))
+	assert.Equal(t, http.StatusConflict, w.Code)
+
+	w = performRequestWithHeaders(router, "PUT", "/students/2/roles", body, asRole(7, roleAdmin))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"student_id": 2, "roles": ["registrar", "instructor"]}`, w.Body.String())
+
+	// refresh token เดิมถูกเพิกถอน login ใหม่ได้ token ที่มี role ใหม่
+	w = performRequest(router, "POST", "/token/refresh", map[string]string{"refresh_token": pair.RefreshToken})
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	pair = login(t, router, "jane@example.com", "password123")
+	claims, err := testTokens.Parse(pair.AccessToken, tokenUseAccess)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{roleRegistrar, roleInstructor}, claims.Roles)
+
+	w = performRequestWithHeaders(router, "GET", "/students/snapshot", nil, bearer(pair.AccessToken))
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = performRequestWithHeaders(router, "GET", "/students/2/roles", nil, bearer(pair.AccessToken))
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = performRequestWithHeaders(router, "GET", "/students/2/roles", nil, asRole(1, roleStudent))
+	assert.Equal(t, http.StatusForbidden, w.Code)
+}
+
+func TestNormalizeRoles(t *testing.T) {
+	roles, err := normalizeRoles([]string{" student", "ADMIN", "student", ""})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{roleAdmin, roleStudent}, roles)
+
+	_, err = normalizeRoles([]string{""})
+	assert.NotNil(t, err)
+	_, err = normalizeRoles([]string{"dean"})
+	assert.NotNil(t, err)
+}
+
+func TestGetStudentSnapshot_Success(t *testing.T) {
+	resetDB()
+	router := SetupRouter(testDBConns, nil, testTokens)
+	w := performRequestWithHeaders(router, "GET", "/students/snapshot", nil, asRole(9, roleRegistrar))
+
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var snapshot struct {
+		Version  int       `json:"version"`
+		Students []Student `json:"students"`
+	}
+	err := json.Unmarshal(w.Body.Bytes(), &snapshot)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, snapshot.Version)
+	assert.Equal(t, 2, len(snapshot.Students))
+	assert.Empty(t, snapshot.Students[0].Password)
+}
+
+// service ภายในแลก client secret เป็น service token อายุสั้นที่ใช้ได้กับ audience เดียว
+func TestServiceToken_ClientCredentials(t *testing.T) {
+	resetDB()
+	dir := t.TempDir()
+	os.MkdirAll(filepath.Join(dir, "enrollment-service"), 0o700)
+	os.WriteFile(filepath.Join(dir, "enrollment-service", "secret"), []byte("s3cret\n"), 0o600)
+	t.Setenv("SERVICE_CLIENTS_DIR", dir)
+	router := SetupRouter(testDBConns, nil, testTokens)
+
+	requestToken := func(clientID, secret, audience string) *httptest.ResponseRecorder {
+		return performRequest(router, "POST", "/token/service", map[string]string{"client_id": clientID, "client_secret": secret, "audience": audience})
+	}
+	assert.Equal(t, http.StatusUnauthorized, requestToken("enrollment-service", "wrong", "student-service").Code)
+	assert.Equal(t, http.StatusUnauthorized, requestToken("../enrollment-service", "s3cret", "student-service").Code)
+	assert.Equal(t, http.StatusBadRequest, requestToken("enrollment-service", "s3cret", "payment-service").Code)
+
+	w := requestToken("enrollment-service", "s3cret", "student-service")
+	assert.Equal(t, http.StatusOK, w.Code)
+	var result struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &result)
+	assert.Equal(t, int(defaultServiceTokenTTL.Seconds()), result.ExpiresIn)
+	claims, err := testTokens.Parse(result.AccessToken, tokenUseService)
+	assert.Nil(t, err)
+	assert.Equal(t, "enrollment-service", claims.Subject)
+	assert.Equal(t, jwt.ClaimStrings{"student-service"}, claims.Audience)
+
+	w = performRequestWithHeaders(router, "GET", "/students/snapshot", nil, bearer(result.AccessToken))
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	// service token ไม่ใช่บัญชีผู้ใช้ และไม่มีสิทธิ์อื่น
+	w = performRequestWithHeaders(router, "GET", "/profile", nil, bearer(result.AccessToken))
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	w = performRequestWithHeaders(router, "GET", "/students/0/roles", nil, bearer(result.AccessToken))
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	// token ที่ออกให้ course-service ใช้กับ student-service ไม่ได้
+	w = requestToken("enrollment-service", "s3cret", "course-service")
+	json.Unmarshal(w.Body.Bytes(), &result)
+	w = performRequestWithHeaders(router, "GET", "/students/snapshot", nil, bearer(result.AccessToken))
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
+
+func TestUpdateProfile_IfMatch(t *testing.T) {
+	resetDB()
+	router := SetupRouter(testDBConns, nil, testTokens)
+
+	auth := bearer(login(t, router, "john@example.com", "password123").AccessToken)
+
+	w := performRequestWithHeaders(router, "GET", "/profile", nil, auth)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, `"1"`, w.Header().Get("ETag"))
+
+	update := map[string]interface{}{
+		"first_name":     "Johnny",
+		"last_name":      "Doe",
+		"birthdate":      "2000-01-01",
+		"gender":         "Male",
+		"year_level":     3,
+		"graded_subject": []string{"Computer Science"},
+	}
+
+	w = performRequestWithHeaders(router, "PUT", "/profile", update, auth)
+	assert.Equal(t, http.StatusPreconditionRequired, w.Code)
+
+	w = performRequestWithHeaders(router, "PUT", "/profile", update, withHeader(auth, "If-Match", `"1"`))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, `"2"`, w.Header().Get("ETag"))
+
+	// วิชาที่ผ่านแล้วส่งกลับมาได้แต่ต้องเท่าเดิม
+	w = performRequestWithHeaders(router, "PUT", "/profile", map[string]interface{}{
+		"first_name": "Johnny", "last_name": "Doe", "birthdate": "2000-01-01", "gender": "Male", "year_level": 3,
+		"graded_subject": []string{"Computer Science", "Advanced Physics"},
+	}, withHeader(auth, "If-Match", `"2"`))
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	// อีกแท็บยังถือ version เก่าอยู่
+	update["first_name"] = "Jack"
+	w = performRequestWithHeaders(router, "PUT", "/profile", update, withHeader(auth, "If-Match", `"1"`))
+	assert.Equal(t, http.StatusPreconditionFailed, w.Code)
+	assert.Equal(t, `"2"`, w.Header().Get("ETag"))
+
+	var firstName string
+	testWriteConn.QueryRow(context.Background(), `SELECT first_name FROM student WHERE student_id = 1`).Scan(&firstName)
+	assert.Equal(t, "Johnny", firstName)
+}
+
+// วิชาที่ผ่านแล้วกำหนดได้เฉพาะ registrar/advisor
+func TestGradedSubjects_OnlyRegistrarOrAdvisor(t *testing.T) {
+	resetDB()
+	router := SetupRouter(testDBConns, nil, testTokens)
+	body := map[string]interface{}{"graded_subject": []string{"Computer Science", "Mathematics"}}
+
+	w := performRequestWithHeaders(router, "PUT", "/students/1/graded-subjects", body, withHeader(asRole(1, roleStudent), "If-Match", `"1"`))
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	w = performRequestWithHeaders(router, "PUT", "/students/1/graded-subjects", body, asRole(8, roleAdvisor))
+	assert.Equal(t, http.StatusPreconditionRequired, w.Code)
+
+	w = performRequestWithHeaders(router, "PUT", "/students/1/graded-subjects", body, withHeader(asRole(8, roleAdvisor), "If-Match", `"1"`))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, `"2"`, w.Header().Get("ETag"))
+
+	var subjects []string
+	testWriteConn.QueryRow(context.Background(), `SELECT graded_subject FROM student WHERE student_id = 1`).Scan(&subjects)
+	assert.Equal(t, []string{"Computer Science", "Mathematics"}, subjects)
+
+	w = performRequestWithHeaders(router, "PUT", "/students/1/graded-subjects", body, withHeader(asRole(9, roleRegistrar), "If-Match", `"1"`))
+	assert.Equal(t, http.StatusPreconditionFailed, w.Code)
+	w = performRequestWithHeaders(router, "PUT", "/students/99/graded-subjects", body, withHeader(asRole(9, roleRegistrar), "If-Match", `"1"`))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	// สมัครเองพร้อมวิชาที่ผ่านแล้วไม่ได้
+	w = performRequest(router, "POST", "/register", map[string]interface{}{
+		"student_id": 5, "first_name": "Eve", "last_name": "Doe", "email": "eve@example.com", "password": "eve12345",
+		"birthdate": "2002-03-03", "gender": "Female", "year_level": 1, "graded_subject": []string{"Mathematics"},
+	})
+	assert.Equal(t, http.StatusForbidden, w.Code)
+}
+
+// event ถูกบันทึกลง outbox ใน transaction เดียวกับการแก้ไข และค้างไว้จนกว่า broker จะยืนยัน
+func TestStudentEvents_OutboxRelay(t *testing.T) {
+	resetDB()
+	ctx := context.Background()
+	router := SetupRouter(testDBConns, nil, testTokens)
+
+	body := map[string]interface{}{"graded_subject": []string{"Computer Science", "Mathematics"}}
+	w := performRequestWithHeaders(router, "PUT", "/students/1/graded-subjects", body, withHeader(asRole(8, roleAdvisor), "If-Match", `"1"`))
+	assert.Equal(t, http.StatusOK, w.Code)
+	// version ไม่ตรง ไม่มีการแก้ไขจึงไม่มี event
+	w = performRequestWithHeaders(router, "PUT", "/students/1/graded-subjects", body, withHeader(asRole(8, roleAdvisor), "If-Match", `"1"`))
+	assert.Equal(t, http.StatusPreconditionFailed, w.Code)
+
+	var types []string
+	testWriteConn.QueryRow(ctx, `SELECT array_agg("event_type" ORDER BY "outbox_id") FROM student_event_outbox WHERE "published_at" IS NULL`).Scan(&types)
+	assert.Equal(t, []string{EventStudentUpdated, EventStudentGradesChanged}, types)
+
+	// ส่งไม่สำเร็จ event ยังค้างอยู่และนับจำนวนครั้ง
+	n, err := relayOutbox(ctx, testWriteConn, func(outboxEvent) error { return rabbitmq.ErrUnavailable })
+	assert.NotNil(t, err)
+	assert.Equal(t, 0, n)
+	var attempts int
+	testWriteConn.QueryRow(ctx, `SELECT MAX("attempts") FROM student_event_outbox`).Scan(&attempts)
+	assert.Equal(t, 1, attempts)
+
+	var sent []StudentEvent
+	n, err = relayOutbox(ctx, testWriteConn, func(e outboxEvent) error {
+		var event StudentEvent
+		json.Unmarshal(e.Payload, &event)
+		sent = append(sent, event)
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, n)
+	assert.Equal(t, EventStudentGradesChanged, sent[1].Type)
+	assert.Equal(t, []string{"Computer Science", "Mathematics"}, sent[1].Student.GradedSubject)
+	assert.Empty(t, sent[1].Student.Password)
+
+	n, err = relayOutbox(ctx, testWriteConn, func(outboxEvent) error { return nil })
+	assert.Nil(t, err)
+	assert.Equal(t, 0, n, "published events are not sent again")
+}
+
+func TestSameSubjects(t *testing.T) {
+	assert.True(t, sameSubjects([]string{"Mathematics", "Physics"}, []string{"Physics", "Mathematics"}))
+	assert.False(t, sameSubjects([]string{"Mathematics"}, []string{"Mathematics", "Physics"}))
+	assert.False(t, sameSubjects([]string{"Mathematics", "Mathematics"}, []string{"Mathematics", "Physics"}))
+}
+
+// ทดสอบนำเข้านักเรียนจาก CSV
+func performCSVRequest(router *gin.Engine, path, body string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest("POST", path, strings.NewReader(body))
+	req.Header.Set("Content-Type", "text/csv")
+	req.Header.Set("Authorization", asRole(9, roleRegistrar)["Authorization"])
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func TestImportStudents_DryRunAndCommit(t *testing.T) {
+	resetDB()
+	router := SetupRouter(testDBConns, nil, testTokens)
+	csvBody := "student_id,first_name,last_name,email,birthdate,gender,year_level,graded_subject\n" +
+		"10,Somchai,Jaidee,somchai@example.com,2006-05-01,Male,1,\n" +
+		"11,Suda,Rakdee,suda@example.com,2006-07-12,Female,1,Mathematics;Physics\n"
+
+	w := performCSVRequest(router, "/students/import?dry_run=true", csvBody)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var report StudentImportReport
+	json.Unmarshal(w.Body.Bytes(), &report)
+	assert.Equal(t, 2, report.Valid)
+	assert.Empty(t, report.Credentials)
+
+	var count int
+	testWriteConn.QueryRow(context.Background(), `SELECT COUNT(*) FROM student`).Scan(&count)
+	assert.Equal(t, 2, count)
+
+	w = performCSVRequest(router, "/students/import", csvBody)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	json.Unmarshal(w.Body.Bytes(), &report)
+	assert.Equal(t, 2, report.Imported)
+	assert.Equal(t, 2, len(report.Credentials))
+
+	// นักเรียนใหม่ login ด้วยรหัสผ่านชั่วคราวได้
+	w = performRequest(router, "POST", "/login", map[string]interface{}{
+		"email":    report.Credentials[1].Email,
+		"password": report.Credentials[1].TemporaryPassword,
+	})
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestImportStudents_Duplicates(t *testing.T) {
+	resetDB()
+	router := SetupRouter(testDBConns, nil, testTokens)
+	csvBody := "student_id,first_name,last_name,email,birthdate,gender,year_level\n" +
+		"10,Somchai,Jaidee,somchai@example.com,2006-05-01,Male,1\n" +
+		"10,Suda,Rakdee,JOHN@example.com,2006-07-12,Female,1\n" +
+		"12,Malee,,SOMCHAI@example.com,2006-07-12,Female,x\n"
+
+	w := performCSVRequest(router, "/students/import", csvBody)
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+
+	var report StudentImportReport
+	json.Unmarshal(w.Body.Bytes(), &report)
+	assert.Equal(t, 1, report.Valid)
+	assert.Equal(t, 2, len(report.Errors))
+	assert.ElementsMatch(t, []string{
+		"student_id 10 is duplicated in row 1",
+		"email JOHN@example.com is already registered",
+	}, report.Errors[0].Errors)
+	assert.Equal(t, []string{`year_level must be a number, got "x"`}, report.Errors[1].Errors)
+
+	var count int
+	testWriteConn.QueryRow(context.Background(), `SELECT COUNT(*) FROM student`).Scan(&count)
+	assert.Equal(t, 2, count)
+}
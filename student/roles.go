@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+	"github.com/sony/gobreaker"
+)
+
+// role ของบัญชี (ชื่อเดียวกับ CHECK ของคอลัมน์ roles ใน db/schema.sql) admin ทำได้ทุกอย่าง
+const (
+	roleStudent    = "student"
+	roleInstructor = "instructor"
+	roleAdvisor    = "advisor"
+	roleRegistrar  = "registrar"
+	roleAdmin      = "admin"
+)
+
+// roleService role ของ service token (ดู service_token.go) ไม่อยู่ใน allRoles จึงกำหนดให้บัญชีไม่ได้
+const roleService = "service"
+
+// allRoles role ทั้งหมด เรียงจากสิทธิ์มากไปน้อย
+var allRoles = []string{roleAdmin, roleRegistrar, roleAdvisor, roleInstructor, roleStudent}
+
+// errStudentNotFound ไม่มีบัญชีตามรหัสหรืออีเมลที่ระบุ
+var errStudentNotFound = errors.New("student not found")
+
+// StudentRoles role ของบัญชี 1 บัญชี
+type StudentRoles struct {
+	StudentID int      `json:"student_id"`
+	Roles     []string `json:"roles"`
+}
+
+// HasRole มี role ใด role หนึ่งที่ระบุ (admin ผ่านเสมอ)
+func (id Identity) HasRole(roles ...string) bool {
+	for _, have := range id.Roles {
+		if have == roleAdmin {
+			return true
+		}
+		for _, want := range roles {
+			if have == want {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// IsSelfOr เป็นเจ้าของข้อมูลของ studentID เอง หรือมี role ที่ระบุ (service ไม่เป็นเจ้าของข้อมูลของใคร)
+func (id Identity) IsSelfOr(studentID int, roles ...string) bool {
+	return (id.Service == "" && id.StudentID == studentID) || id.HasRole(roles...)
+}
+
+// normalizeRoles ตัดช่องว่าง/ตัวพิมพ์ใหญ่ ตัดตัวซ้ำ และเรียงตาม allRoles ต้องมีอย่างน้อย 1 role
+func normalizeRoles(roles []string) ([]string, error) {
+	wanted := map[string]bool{}
+	for _, role := range roles {
+		role = strings.ToLower(strings.TrimSpace(role))
+		if role == "" {
+			continue
+		}
+		known := false
+		for _, r := range allRoles {
+			known = known || r == role
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown role %q (expected one of %s)", role, strings.Join(allRoles, ", "))
+		}
+		wanted[role] = true
+	}
+	normalized := []string{}
+	for _, role := range allRoles {
+		if wanted[role] {
+			normalized = append(normalized, role)
+		}
+	}
+	if len(normalized) == 0 {
+		return nil, fmt.Errorf("at least one role is required")
+	}
+	return normalized, nil
+}
+
+// setStudentRoles แทนที่ role ของบัญชี แล้วเพิกถอน refresh token เพื่อให้ token ชุดถัดไปใช้ role ใหม่
+// access token ที่ออกไปแล้วยังใช้ role เดิมได้จนหมดอายุ (ไม่เกิน JWT_ACCESS_TTL)
+func setStudentRoles(ctx context.Context, conn *pgx.Conn, studentID int, roles []string) error {
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	tag, err := tx.Exec(ctx, `UPDATE student SET roles = $2 WHERE student_id = $1`, studentID, roles)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return errStudentNotFound
+	}
+	if err := revokeRefreshTokens(ctx, tx, studentID); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// respondForbidden ตอบ 403 เมื่อ login แล้วแต่ไม่มีสิทธิ์
+func respondForbidden(c *gin.Context) {
+	c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "You do not have permission to perform this action"})
+}
+
+// RoleRequired ต้อง login และมี role ใด role หนึ่งที่ระบุ
+func RoleRequired(tokens *TokenIssuer, roles ...string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, ok := authenticate(c, tokens)
+		if !ok {
+			return
+		}
+		if !id.HasRole(roles...) {
+			respondForbidden(c)
+			return
+		}
+		c.Next()
+	}
+}
+
+// SelfOrRoleRequired ต้อง login และเป็นเจ้าของข้อมูล (student_id ใน path param ที่ระบุ) หรือมี role ที่ระบุ
+func SelfOrRoleRequired(tokens *TokenIssuer, param string, roles ...string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, ok := authenticate(c, tokens)
+		if !ok {
+			return
+		}
+		if studentID, err := strconv.Atoi(c.Param(param)); (err != nil || !id.IsSelfOr(studentID)) && !id.HasRole(roles...) {
+			respondForbidden(c)
+			return
+		}
+		c.Next()
+	}
+}
+
+// registerRoleRoutes ดูและกำหนด role ของบัญชี (กำหนดได้เฉพาะ admin)
+func registerRoleRoutes(r *gin.Engine, dbConns *DBConnections, tokens *TokenIssuer, readCircuitBreaker, writeCircuitBreaker *gobreaker.CircuitBreaker) {
+	r.GET("/students/:id/roles", SelfOrRoleRequired(tokens, "id", roleRegistrar), func(c *gin.Context) {
+		result := StudentRoles{}
+		_, err := readCircuitBreaker.Execute(func() (interface{}, error) {
+			return nil, dbConns.ReadConn.QueryRow(context.Background(),
+				`SELECT student_id, roles FROM student WHERE student_id = $1`, c.Param("id"),
+			).Scan(&result.StudentID, &result.Roles)
+		})
+		if err == gobreaker.ErrOpenState {
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Service temporarily unavailable (circuit breaker is open)"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Student not found"})
+			return
+		}
+		c.JSON(http.StatusOK, result)
+	})
+
+	r.PUT("/students/:id/roles", RoleRequired(tokens, roleAdmin), func(c *gin.Context) {
+		studentID, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid student ID"})
+			return
+		}
+		var body struct {
+			Roles []string `json:"roles" binding:"required"`
+		}
+		if err := c.ShouldBindJSON(&body); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "roles is required"})
+			return
+		}
+		roles, err := normalizeRoles(body.Roles)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		// กันไม่ให้ admin ถอดสิทธิ์ตัวเองจนไม่มีใครจัดการ role ได้ (แก้ได้ด้วยคำสั่ง set-roles)
+		if studentID == identityFrom(c).StudentID && roles[0] != roleAdmin {
+			c.JSON(http.StatusConflict, gin.H{"error": "You cannot remove your own admin role"})
+			return
+		}
+
+		notFound := false
+		_, err = writeCircuitBreaker.Execute(func() (interface{}, error) {
+			err := setStudentRoles(context.Background(), dbConns.WriteConn, studentID, roles)
+			if err == errStudentNotFound {
+				// ไม่ใช่ความผิดของฐานข้อมูล ไม่นับเป็น failure ของ circuit breaker
+				notFound = true
+				return nil, nil
+			}
+			return nil, err
+		})
+		if err == gobreaker.ErrOpenState {
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Service temporarily unavailable (circuit breaker is open)"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to set roles: " + err.Error()})
+			return
+		}
+		if notFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Student not found"})
+			return
+		}
+		c.JSON(http.StatusOK, StudentRoles{StudentID: studentID, Roles: roles})
+	})
+}
+
+// runSetRolesCommand คำสั่ง set-roles สำหรับตั้ง admin คนแรก (ยังไม่มีใครเรียก PUT /students/:id/roles ได้)
+// ใช้งาน: ./student-service set-roles -roles admin,registrar someone@example.com
+func runSetRolesCommand(args []string) {
+	flags := flag.NewFlagSet("set-roles", flag.ExitOnError)
+	rolesFlag := flags.String("roles", "", "comma-separated roles ("+strings.Join(allRoles, ", ")+")")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		log.Fatal("Usage: set-roles -roles admin,registrar <email>")
+	}
+	roles, err := normalizeRoles(strings.Split(*rolesFlag, ","))
+	if err != nil {
+		log.Fatal("Invalid roles: ", err)
+	}
+
+	writeConn := connectToWriteDB()
+	defer writeConn.Close(context.Background())
+
+	ctx := context.Background()
+	var studentID int
+	err = writeConn.QueryRow(ctx, `SELECT student_id FROM student WHERE LOWER(email) = LOWER($1)`, flags.Arg(0)).Scan(&studentID)
+	if err == pgx.ErrNoRows {
+		err = errStudentNotFound
+	}
+	if err == nil {
+		err = setStudentRoles(ctx, writeConn, studentID, roles)
+	}
+	if err != nil {
+		log.Fatalf("Failed to set roles of %s: %v", flags.Arg(0), err)
+	}
+	out, _ := json.MarshalIndent(StudentRoles{StudentID: studentID, Roles: roles}, "", "  ")
+	fmt.Println(string(out))
+}
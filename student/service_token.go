@@ -0,0 +1,102 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// serviceAudiences service ปลายทางที่ออก service token ให้ได้ (ตรงกับ realm ที่ service นั้นใช้ตรวจ token)
+var serviceAudiences = []string{"course-service", "student-service"}
+
+// serviceClientIDPattern client id ใช้เป็นชื่อโฟลเดอร์ใน SERVICE_CLIENTS_DIR จึงต้องไม่มี / หรือ ..
+var serviceClientIDPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]*$`)
+
+// errServiceClientInvalid client id หรือ secret ไม่ถูกต้อง (ไม่บอกว่าผิดส่วนไหน)
+var errServiceClientInvalid = errors.New("invalid service client credentials")
+
+// verifyServiceClient ตรวจ secret ของ service ภายในกับไฟล์ SERVICE_CLIENTS_DIR/<client_id>/secret
+// แต่ละ service มี secret ของตัวเอง อ่านไฟล์ทุกครั้งจึงเปลี่ยน secret ได้โดยไม่ต้อง restart
+func verifyServiceClient(clientID, secret string) error {
+	dir := os.Getenv("SERVICE_CLIENTS_DIR")
+	if dir == "" || !serviceClientIDPattern.MatchString(clientID) || secret == "" {
+		return errServiceClientInvalid
+	}
+	data, err := os.ReadFile(filepath.Join(dir, clientID, "secret"))
+	if err != nil {
+		return errServiceClientInvalid
+	}
+	expected := strings.TrimSpace(string(data))
+	if expected == "" || subtle.ConstantTimeCompare([]byte(secret), []byte(expected)) != 1 {
+		return errServiceClientInvalid
+	}
+	return nil
+}
+
+// issueServiceToken ออก service token อายุ serviceTTL ให้ clientID ใช้เรียก audience ได้ที่เดียว
+func (t *TokenIssuer) issueServiceToken(clientID, audience string) (string, error) {
+	signed, _, _, err := t.signClaims(TokenClaims{
+		RegisteredClaims: jwt.RegisteredClaims{Subject: clientID, Audience: jwt.ClaimStrings{audience}},
+		Roles:            []string{roleService},
+		TokenUse:         tokenUseService,
+	}, t.serviceTTL)
+	return signed, err
+}
+
+// serviceIdentity Identity ของ service token ที่ aud ตรงกับ audience ของ service ที่ตรวจ
+func serviceIdentity(claims *TokenClaims, audience string) (Identity, error) {
+	if claims.Subject == "" {
+		return Identity{}, fmt.Errorf("invalid token subject")
+	}
+	for _, aud := range claims.Audience {
+		if aud == audience {
+			return Identity{Service: claims.Subject, Roles: []string{roleService}}, nil
+		}
+	}
+	return Identity{}, fmt.Errorf("service token is not issued for %s", audience)
+}
+
+// handleServiceToken POST /token/service แลก client id + secret เป็น service token (client credentials)
+func handleServiceToken(c *gin.Context, tokens *TokenIssuer) {
+	var body struct {
+		ClientID     string `json:"client_id" binding:"required"`
+		ClientSecret string `json:"client_secret" binding:"required"`
+		Audience     string `json:"audience" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "client_id, client_secret and audience are required"})
+		return
+	}
+	known := false
+	for _, aud := range serviceAudiences {
+		known = known || aud == body.Audience
+	}
+	if !known {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("unknown audience %q (expected one of %s)", body.Audience, strings.Join(serviceAudiences, ", "))})
+		return
+	}
+	if err := verifyServiceClient(body.ClientID, body.ClientSecret); err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		return
+	}
+
+	token, err := tokens.issueServiceToken(body.ClientID, body.Audience)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to issue service token: " + err.Error()})
+		return
+	}
+	c.Header("Cache-Control", "no-store")
+	c.JSON(http.StatusOK, gin.H{
+		"access_token": token,
+		"token_type":   "Bearer",
+		"expires_in":   int(tokens.serviceTTL.Seconds()),
+	})
+}
@@ -0,0 +1,441 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/sony/gobreaker"
+)
+
+// tokenIssuer ค่า iss ของทุก token ที่ course-service และ enrollment-service ยอมรับ
+const tokenIssuer = "student-service"
+
+// ชนิดของ token (claim token_use) access ใช้เรียก API ส่วน refresh ใช้ขอ token ชุดใหม่เท่านั้น
+// service ออกให้ service ภายในเรียก service ปลายทางตาม aud (ดู service_token.go)
+const (
+	tokenUseAccess  = "access"
+	tokenUseRefresh = "refresh"
+	tokenUseService = "service"
+)
+
+// อายุของ token ปรับได้ด้วย JWT_ACCESS_TTL / JWT_REFRESH_TTL / SERVICE_TOKEN_TTL
+const (
+	defaultAccessTokenTTL  = 15 * time.Minute
+	defaultRefreshTokenTTL = 7 * 24 * time.Hour
+	defaultServiceTokenTTL = 5 * time.Minute
+)
+
+// errRefreshTokenInvalid refresh token หมดอายุ ถูกเพิกถอน หรือไม่มีในระบบ
+var errRefreshTokenInvalid = errors.New("refresh token is invalid or has been revoked")
+
+// TokenClaims claim ของ access/refresh token (sub คือ student_id, roles ดู roles.go)
+type TokenClaims struct {
+	jwt.RegisteredClaims
+	Email    string   `json:"email,omitempty"`
+	Roles    []string `json:"roles,omitempty"`
+	TokenUse string   `json:"token_use"`
+}
+
+// Identity ผู้เรียก API ที่ยืนยันจาก access token แล้ว (Service ไม่ว่างเมื่อเป็น service ภายในที่ใช้ service token)
+type Identity struct {
+	StudentID int      `json:"student_id"`
+	Email     string   `json:"email"`
+	Roles     []string `json:"roles"`
+	Service   string   `json:"service,omitempty"`
+}
+
+// TokenPair คำตอบของ /login และ /token/refresh
+type TokenPair struct {
+	AccessToken      string `json:"access_token"`
+	RefreshToken     string `json:"refresh_token"`
+	TokenType        string `json:"token_type"`
+	ExpiresIn        int    `json:"expires_in"`
+	RefreshExpiresIn int    `json:"refresh_expires_in"`
+}
+
+// pgxExecer ใช้ได้ทั้ง *pgx.Conn และ pgx.Tx
+type pgxExecer interface {
+	Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error)
+}
+
+// TokenIssuer เซ็น token ด้วย RSA (RS256) service อื่นตรวจเองได้ด้วย public key จาก JWKS
+type TokenIssuer struct {
+	key        *rsa.PrivateKey
+	keyID      string
+	accessTTL  time.Duration
+	refreshTTL time.Duration
+	serviceTTL time.Duration
+}
+
+func newTokenIssuer(key *rsa.PrivateKey) *TokenIssuer {
+	issuer := &TokenIssuer{
+		key:        key,
+		keyID:      keyThumbprint(&key.PublicKey),
+		accessTTL:  defaultAccessTokenTTL,
+		refreshTTL: defaultRefreshTokenTTL,
+		serviceTTL: defaultServiceTokenTTL,
+	}
+	if v, err := time.ParseDuration(os.Getenv("JWT_ACCESS_TTL")); err == nil && v > 0 {
+		issuer.accessTTL = v
+	}
+	if v, err := time.ParseDuration(os.Getenv("JWT_REFRESH_TTL")); err == nil && v > 0 {
+		issuer.refreshTTL = v
+	}
+	if v, err := time.ParseDuration(os.Getenv("SERVICE_TOKEN_TTL")); err == nil && v > 0 {
+		issuer.serviceTTL = v
+	}
+	return issuer
+}
+
+// isDevMode รันเพื่อพัฒนาบนเครื่องตัวเอง (APP_ENV=development หรือ dev)
+func isDevMode() bool {
+	env := strings.ToLower(os.Getenv("APP_ENV"))
+	return env == "development" || env == "dev"
+}
+
+// loadTokenIssuer อ่าน private key (PEM) จาก JWT_PRIVATE_KEY_FILE
+// ถ้าไม่ได้ตั้งไว้จะไม่ยอมเปิด service ยกเว้น dev mode ซึ่งจะสุ่ม key ใหม่ทุกครั้งที่เปิด
+// (token เก่าใช้ไม่ได้หลัง restart และแต่ละ instance ออก token ที่ instance อื่นไม่รู้จัก)
+func loadTokenIssuer() *TokenIssuer {
+	path := os.Getenv("JWT_PRIVATE_KEY_FILE")
+	if path == "" {
+		if !isDevMode() {
+			log.Fatal("JWT_PRIVATE_KEY_FILE is not set. Mount an RSA private key (PEM) and point JWT_PRIVATE_KEY_FILE at it, or set APP_ENV=development to use a temporary key")
+		}
+		log.Println("WARNING: JWT_PRIVATE_KEY_FILE is not set, generating a TEMPORARY signing key (APP_ENV=development).")
+		log.Println("WARNING: every token is invalidated when student-service restarts. Never run like this in production.")
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			log.Fatal("Failed to generate signing key: ", err)
+		}
+		return newTokenIssuer(key)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		log.Fatal("Failed to read signing key: ", err)
+	}
+	key, err := parsePrivateKey(data)
+	if err != nil {
+		log.Fatal("Invalid signing key: ", err)
+	}
+	return newTokenIssuer(key)
+}
+
+// parsePrivateKey รองรับทั้ง PKCS#1 ("RSA PRIVATE KEY") และ PKCS#8 ("PRIVATE KEY")
+func parsePrivateKey(data []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM block found")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("signing key must be an RSA key")
+	}
+	return key, nil
+}
+
+// keyThumbprint kid ตาม RFC 7638 (SHA-256 ของ JWK) เปลี่ยน key แล้ว kid เปลี่ยนตาม
+func keyThumbprint(key *rsa.PublicKey) string {
+	jwk := fmt.Sprintf(`{"e":"%s","kty":"RSA","n":"%s"}`, encodeExponent(key.E), base64.RawURLEncoding.EncodeToString(key.N.Bytes()))
+	sum := sha256.Sum256([]byte(jwk))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+func encodeExponent(e int) string {
+	return base64.RawURLEncoding.EncodeToString(big.NewInt(int64(e)).Bytes())
+}
+
+// JWKS public key ในรูปแบบ JSON Web Key Set (RFC 7517)
+func (t *TokenIssuer) JWKS() gin.H {
+	return gin.H{"keys": []gin.H{{
+		"kty": "RSA",
+		"use": "sig",
+		"alg": "RS256",
+		"kid": t.keyID,
+		"n":   base64.RawURLEncoding.EncodeToString(t.key.N.Bytes()),
+		"e":   encodeExponent(t.key.E),
+	}}}
+}
+
+func (t *TokenIssuer) sign(id Identity, use string, ttl time.Duration) (string, string, time.Time, error) {
+	return t.signClaims(TokenClaims{
+		RegisteredClaims: jwt.RegisteredClaims{Subject: strconv.Itoa(id.StudentID)},
+		Email:            id.Email,
+		Roles:            id.Roles,
+		TokenUse:         use,
+	}, ttl)
+}
+
+// signClaims เติม iss, iat, exp และ jti แล้วเซ็น
+func (t *TokenIssuer) signClaims(claims TokenClaims, ttl time.Duration) (string, string, time.Time, error) {
+	now := time.Now()
+	jti := make([]byte, 16)
+	if _, err := rand.Read(jti); err != nil {
+		return "", "", time.Time{}, err
+	}
+	claims.Issuer = tokenIssuer
+	claims.IssuedAt = jwt.NewNumericDate(now)
+	claims.ExpiresAt = jwt.NewNumericDate(now.Add(ttl))
+	claims.ID = hex.EncodeToString(jti)
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = t.keyID
+	signed, err := token.SignedString(t.key)
+	return signed, claims.ID, claims.ExpiresAt.Time, err
+}
+
+// Parse ตรวจลายเซ็น อายุ ผู้ออก และชนิดของ token
+func (t *TokenIssuer) Parse(tokenString, use string) (*TokenClaims, error) {
+	claims, err := t.parseClaims(tokenString)
+	if err != nil {
+		return nil, err
+	}
+	if claims.TokenUse != use {
+		return nil, fmt.Errorf("expected an %s token", use)
+	}
+	return claims, nil
+}
+
+// parseClaims ตรวจลายเซ็น อายุ และผู้ออก โดยยังไม่ดูชนิดของ token
+func (t *TokenIssuer) parseClaims(tokenString string) (*TokenClaims, error) {
+	claims := &TokenClaims{}
+	_, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+		return &t.key.PublicKey, nil
+	}, jwt.WithValidMethods([]string{"RS256"}), jwt.WithIssuer(tokenIssuer), jwt.WithExpirationRequired())
+	if err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// issueTokens ออก access + refresh token ชุดใหม่ refresh token ถูกบันทึกไว้เพื่อเพิกถอนได้
+func (t *TokenIssuer) issueTokens(ctx context.Context, q pgxExecer, id Identity) (*TokenPair, error) {
+	access, _, _, err := t.sign(id, tokenUseAccess, t.accessTTL)
+	if err != nil {
+		return nil, err
+	}
+	refresh, jti, expiresAt, err := t.sign(id, tokenUseRefresh, t.refreshTTL)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := q.Exec(ctx, `INSERT INTO refresh_token (jti, student_id, expires_at) VALUES ($1, $2, $3)`, jti, id.StudentID, expiresAt); err != nil {
+		return nil, err
+	}
+	return &TokenPair{
+		AccessToken:      access,
+		RefreshToken:     refresh,
+		TokenType:        "Bearer",
+		ExpiresIn:        int(t.accessTTL.Seconds()),
+		RefreshExpiresIn: int(t.refreshTTL.Seconds()),
+	}, nil
+}
+
+// refreshTokens ใช้ refresh token แลก token ชุดใหม่ (refresh token ใช้ได้ครั้งเดียว)
+// ถ้ามีคนนำ refresh token ที่ใช้ไปแล้วมาใช้ซ้ำ ถือว่าถูกขโมย จะเพิกถอนทุก token ของนักเรียนคนนั้น
+func (t *TokenIssuer) refreshTokens(ctx context.Context, conn *pgx.Conn, refreshToken string) (*TokenPair, error) {
+	claims, err := t.Parse(refreshToken, tokenUseRefresh)
+	if err != nil {
+		return nil, errRefreshTokenInvalid
+	}
+
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	var studentID int
+	var revoked bool
+	err = tx.QueryRow(ctx,
+		`SELECT student_id, revoked_at IS NOT NULL FROM refresh_token WHERE jti = $1 FOR UPDATE`, claims.ID,
+	).Scan(&studentID, &revoked)
+	if err == pgx.ErrNoRows {
+		return nil, errRefreshTokenInvalid
+	}
+	if err != nil {
+		return nil, err
+	}
+	if revoked {
+		if err := revokeRefreshTokens(ctx, tx, studentID); err != nil {
+			return nil, err
+		}
+		if err := tx.Commit(ctx); err != nil {
+			return nil, err
+		}
+		return nil, errRefreshTokenInvalid
+	}
+	if _, err := tx.Exec(ctx, `UPDATE refresh_token SET revoked_at = NOW() WHERE jti = $1`, claims.ID); err != nil {
+		return nil, err
+	}
+
+	// อ่านอีเมลและ role ล่าสุดแทนการคัดลอกจาก token เดิม
+	var id Identity
+	err = tx.QueryRow(ctx, `SELECT student_id, email, roles FROM student WHERE student_id = $1`, studentID).Scan(&id.StudentID, &id.Email, &id.Roles)
+	if err == pgx.ErrNoRows {
+		return nil, errRefreshTokenInvalid
+	}
+	if err != nil {
+		return nil, err
+	}
+	pair, err := t.issueTokens(ctx, tx, id)
+	if err != nil {
+		return nil, err
+	}
+	return pair, tx.Commit(ctx)
+}
+
+// revokeRefreshTokens เพิกถอน refresh token ทั้งหมดของนักเรียน (access token ใช้ได้จนหมดอายุ)
+func revokeRefreshTokens(ctx context.Context, q pgxExecer, studentID int) error {
+	_, err := q.Exec(ctx, `UPDATE refresh_token SET revoked_at = NOW() WHERE student_id = $1 AND revoked_at IS NULL`, studentID)
+	return err
+}
+
+// bearerToken อ่าน token จาก header Authorization: Bearer <token>
+func bearerToken(c *gin.Context) (string, bool) {
+	header := c.GetHeader("Authorization")
+	scheme, token, ok := strings.Cut(header, " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") || strings.TrimSpace(token) == "" {
+		return "", false
+	}
+	return strings.TrimSpace(token), true
+}
+
+// authenticate ตรวจ access token (หรือ service token ที่ออกให้ student-service) แล้วเก็บ Identity ไว้ใน context
+// ถ้าไม่ผ่านจะตอบ 401 และคืน false
+func authenticate(c *gin.Context, tokens *TokenIssuer) (Identity, bool) {
+	token, ok := bearerToken(c)
+	if !ok {
+		c.Header("WWW-Authenticate", `Bearer realm="student-service"`)
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "กรุณา Login ก่อนเข้าใช้งาน"})
+		return Identity{}, false
+	}
+	claims, err := tokens.parseClaims(token)
+	if err == nil && claims.TokenUse == tokenUseService {
+		id, err := serviceIdentity(claims, tokenIssuer)
+		if err != nil {
+			c.Header("WWW-Authenticate", `Bearer error="invalid_token"`)
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired token: " + err.Error()})
+			return Identity{}, false
+		}
+		c.Set("identity", id)
+		return id, true
+	}
+	if err == nil && claims.TokenUse != tokenUseAccess {
+		err = fmt.Errorf("expected an %s token", tokenUseAccess)
+	}
+	if err != nil {
+		c.Header("WWW-Authenticate", `Bearer error="invalid_token"`)
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired token: " + err.Error()})
+		return Identity{}, false
+	}
+	studentID, err := strconv.Atoi(claims.Subject)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid token subject"})
+		return Identity{}, false
+	}
+	// token รุ่นก่อนมี role ถือว่าเป็นนักเรียน
+	roles := claims.Roles
+	if len(roles) == 0 {
+		roles = []string{roleStudent}
+	}
+	id := Identity{StudentID: studentID, Email: claims.Email, Roles: roles}
+	c.Set("identity", id)
+	return id, true
+}
+
+// AuthRequired ต้อง login (role ใดก็ได้) handler อ่านผู้เรียกได้จาก identityFrom
+// service token ไม่ใช่บัญชีผู้ใช้ จึงใช้ได้เฉพาะ route ที่ระบุ roleService ใน RoleRequired
+func AuthRequired(tokens *TokenIssuer) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, ok := authenticate(c, tokens)
+		if !ok {
+			return
+		}
+		if id.Service != "" {
+			respondForbidden(c)
+			return
+		}
+		c.Next()
+	}
+}
+
+// identityFrom ผู้เรียกที่ AuthRequired ตรวจแล้ว
+func identityFrom(c *gin.Context) Identity {
+	id, _ := c.MustGet("identity").(Identity)
+	return id
+}
+
+// registerTokenRoutes JWKS สำหรับ service อื่น การต่ออายุ token และ service token
+func registerTokenRoutes(r *gin.Engine, dbConns *DBConnections, tokens *TokenIssuer, writeCircuitBreaker *gobreaker.CircuitBreaker) {
+	r.GET("/.well-known/jwks.json", func(c *gin.Context) {
+		c.Header("Cache-Control", "public, max-age=300")
+		c.JSON(http.StatusOK, tokens.JWKS())
+	})
+
+	r.POST("/token/service", func(c *gin.Context) {
+		handleServiceToken(c, tokens)
+	})
+
+	r.POST("/token/refresh", func(c *gin.Context) {
+		var body struct {
+			RefreshToken string `json:"refresh_token" binding:"required"`
+		}
+		if err := c.ShouldBindJSON(&body); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "refresh_token is required"})
+			return
+		}
+		var pair *TokenPair
+		_, err := writeCircuitBreaker.Execute(func() (interface{}, error) {
+			result, err := tokens.refreshTokens(context.Background(), dbConns.WriteConn, body.RefreshToken)
+			pair = result
+			if err == errRefreshTokenInvalid {
+				// token ผิดไม่ใช่ความผิดของฐานข้อมูล ไม่นับเป็น failure ของ circuit breaker
+				return nil, nil
+			}
+			return result, err
+		})
+		if err == gobreaker.ErrOpenState {
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Service temporarily unavailable (circuit breaker is open)"})
+			return
+		}
+		if err == nil && pair == nil {
+			err = errRefreshTokenInvalid
+		}
+		if err == errRefreshTokenInvalid {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to refresh token: " + err.Error()})
+			return
+		}
+		c.Header("Cache-Control", "no-store")
+		c.JSON(http.StatusOK, pair)
+	})
+}